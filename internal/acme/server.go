@@ -0,0 +1,1133 @@
+package acme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chmike/domain"
+	"github.com/open-uem/openuem-cert-manager/internal/authz"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+)
+
+// Ref: https://datatracker.ietf.org/doc/html/rfc8555
+
+const (
+	ChallengeHTTP01 = "http-01"
+	// ChallengeApproval is validated by an operator instead of by network access, it's meant for air-gapped networks
+	ChallengeApproval = "openuem-approval-01"
+
+	StatusPending     = "pending"
+	StatusProcessing  = "processing"
+	StatusReady       = "ready"
+	StatusValid       = "valid"
+	StatusInvalid     = "invalid"
+	StatusDeactivated = "deactivated"
+
+	nonceLifetime = time.Hour
+	orderLifetime = 24 * time.Hour
+)
+
+// Store persists the ACME accounts, orders and authorizations
+type Store interface {
+	CreateACMEAccount(a *models.ACMEAccount) error
+	GetACMEAccount(id string) (*models.ACMEAccount, error)
+	GetACMEAccountByThumbprint(thumbprint string) (*models.ACMEAccount, error)
+	UpdateACMEAccount(a *models.ACMEAccount) error
+	CreateACMEOrder(o *models.ACMEOrder, authzs []*models.ACMEAuthorization) error
+	GetACMEOrder(id string) (*models.ACMEOrder, error)
+	GetACMEOrderIDs(accountID string) ([]string, error)
+	GetACMEOrderBySerial(serial int64) (*models.ACMEOrder, error)
+	UpdateACMEOrder(o *models.ACMEOrder) error
+	UpdateACMEOrderStatus(id string, from string, to string) error
+	GetACMEAuthorization(id string) (*models.ACMEAuthorization, error)
+	GetACMEAuthorizations(orderID string) ([]*models.ACMEAuthorization, error)
+	UpdateACMEAuthorization(a *models.ACMEAuthorization) error
+	IsRevoked(serial int64) (bool, error)
+}
+
+// Issuer signs the certificate requested in a finalized order by an account and returns the PEM encoded chain
+type Issuer func(accountID string, csr *x509.CertificateRequest, names []string) (chain []byte, serial int64, err error)
+
+// Revoker revokes a certificate issued by an order, accountID is empty when the request is signed with the
+// certificate key instead of the account key
+type Revoker func(accountID string, serial int64, reason int) error
+
+type Server struct {
+	// BaseURL is the external URL clients use to reach the server, e.g https://acme.example.com
+	BaseURL string
+	Store   Store
+	Issue   Issuer
+	// Revoke is optional, revocation requests are rejected without it
+	Revoke Revoker
+	// Authorize is optional, it's called before creating an order to check that the account may
+	// get certificates for those names
+	Authorize func(accountID string, names []string) error
+	// CertType is the OpenUEM type of the certificates issued, it's stored with the authorizations so
+	// the operator approvals are checked against it
+	CertType string
+	// HTTPPort is the port used to fetch http-01 challenges, 80 by default
+	HTTPPort string
+	// HTTPClient is used to fetch http-01 challenges
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *problem) Error() string {
+	return p.Detail
+}
+
+func newProblem(status int, kind string, format string, a ...any) *problem {
+	return &problem{Type: "urn:ietf:params:acme:error:" + kind, Detail: fmt.Sprintf(format, a...), Status: status}
+}
+
+type accountResource struct {
+	Status  string   `json:"status"`
+	Contact []string `json:"contact,omitempty"`
+	Orders  string   `json:"orders"`
+}
+
+type orderResource struct {
+	Status         string                  `json:"status"`
+	Expires        string                  `json:"expires"`
+	Identifiers    []models.ACMEIdentifier `json:"identifiers"`
+	Authorizations []string                `json:"authorizations"`
+	Finalize       string                  `json:"finalize"`
+	Certificate    string                  `json:"certificate,omitempty"`
+	Error          *problem                `json:"error,omitempty"`
+}
+
+type challengeResource struct {
+	Type      string   `json:"type"`
+	URL       string   `json:"url"`
+	Status    string   `json:"status"`
+	Token     string   `json:"token"`
+	Validated string   `json:"validated,omitempty"`
+	Error     *problem `json:"error,omitempty"`
+}
+
+type authorizationResource struct {
+	Identifier models.ACMEIdentifier `json:"identifier"`
+	Status     string                `json:"status"`
+	Expires    string                `json:"expires"`
+	Challenges []challengeResource   `json:"challenges"`
+}
+
+// request is an authenticated ACME request
+type request struct {
+	payload []byte
+	account *models.ACMEAccount
+	jwk     crypto.PublicKey
+	rawJWK  []byte
+	kid     string
+	url     string
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /acme/directory", s.directory)
+	mux.HandleFunc("GET /acme/new-nonce", s.newNonce)
+	mux.HandleFunc("HEAD /acme/new-nonce", s.newNonce)
+	mux.HandleFunc("POST /acme/new-account", s.newAccount)
+	mux.HandleFunc("POST /acme/account/{id}", s.account)
+	mux.HandleFunc("POST /acme/account/{id}/orders", s.accountOrders)
+	mux.HandleFunc("POST /acme/new-order", s.newOrder)
+	mux.HandleFunc("POST /acme/order/{id}", s.order)
+	mux.HandleFunc("POST /acme/order/{id}/finalize", s.finalize)
+	mux.HandleFunc("POST /acme/authz/{id}", s.authorization)
+	mux.HandleFunc("POST /acme/chall/{id}/{type}", s.challenge)
+	mux.HandleFunc("POST /acme/cert/{id}", s.certificate)
+	mux.HandleFunc("POST /acme/revoke-cert", s.revokeCert)
+	mux.HandleFunc("POST /acme/key-change", s.keyChange)
+	return mux
+}
+
+func (s *Server) url(format string, a ...any) string {
+	return strings.TrimSuffix(s.BaseURL, "/") + fmt.Sprintf(format, a...)
+}
+
+func (s *Server) directory(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"newNonce":   s.url("/acme/new-nonce"),
+		"newAccount": s.url("/acme/new-account"),
+		"newOrder":   s.url("/acme/new-order"),
+		"revokeCert": s.url("/acme/revoke-cert"),
+		"keyChange":  s.url("/acme/key-change"),
+		"meta": map[string]any{
+			"externalAccountRequired": false,
+		},
+	})
+}
+
+func (s *Server) newNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := s.setNonce(w); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) newAccount(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, false)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	payload := struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode account request"))
+		return
+	}
+
+	tp, err := thumbprint(req.jwk)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "badPublicKey", "%v", err))
+		return
+	}
+
+	account, err := s.Store.GetACMEAccountByThumbprint(tp)
+	if err == nil {
+		w.Header().Set("Location", s.url("/acme/account/%s", account.ID))
+		s.writeJSON(w, http.StatusOK, s.accountResource(account))
+		return
+	}
+	if !errors.Is(err, models.ErrACMENotFound) {
+		s.writeError(w, err)
+		return
+	}
+
+	if payload.OnlyReturnExisting {
+		s.writeError(w, newProblem(http.StatusBadRequest, "accountDoesNotExist", "no account exists with this key"))
+		return
+	}
+
+	for _, c := range payload.Contact {
+		if !strings.HasPrefix(c, "mailto:") {
+			s.writeError(w, newProblem(http.StatusBadRequest, "unsupportedContact", "only mailto contacts are supported"))
+			return
+		}
+	}
+
+	account = &models.ACMEAccount{
+		ID:         randomID(),
+		Thumbprint: tp,
+		JWK:        string(req.rawJWK),
+		Contact:    payload.Contact,
+		Status:     StatusValid,
+		Created:    time.Now(),
+	}
+	if err := s.Store.CreateACMEAccount(account); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	log.Printf("... ACME account %s created", account.ID)
+	w.Header().Set("Location", s.url("/acme/account/%s", account.ID))
+	s.writeJSON(w, http.StatusCreated, s.accountResource(account))
+}
+
+func (s *Server) account(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if req.account.ID != r.PathValue("id") {
+		s.writeError(w, newProblem(http.StatusForbidden, "unauthorized", "the account doesn't belong to this key"))
+		return
+	}
+
+	if len(req.payload) > 0 {
+		payload := struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}{}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode account update"))
+			return
+		}
+		if payload.Contact != nil {
+			req.account.Contact = payload.Contact
+		}
+		if payload.Status == StatusDeactivated {
+			req.account.Status = StatusDeactivated
+		}
+		if err := s.Store.UpdateACMEAccount(req.account); err != nil {
+			s.writeError(w, err)
+			return
+		}
+	}
+
+	s.writeJSON(w, http.StatusOK, s.accountResource(req.account))
+}
+
+func (s *Server) accountOrders(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if req.account.ID != r.PathValue("id") {
+		s.writeError(w, newProblem(http.StatusForbidden, "unauthorized", "the account doesn't belong to this key"))
+		return
+	}
+
+	ids, err := s.Store.GetACMEOrderIDs(req.account.ID)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	orders := []string{}
+	for _, id := range ids {
+		orders = append(orders, s.url("/acme/order/%s", id))
+	}
+	s.writeJSON(w, http.StatusOK, map[string]any{"orders": orders})
+}
+
+func (s *Server) newOrder(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	payload := struct {
+		Identifiers []models.ACMEIdentifier `json:"identifiers"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "the order must contain at least one identifier"))
+		return
+	}
+
+	now := time.Now()
+	order := &models.ACMEOrder{
+		ID:        randomID(),
+		AccountID: req.account.ID,
+		Status:    StatusPending,
+		Expires:   now.Add(orderLifetime),
+		Created:   now,
+	}
+
+	authzs := []*models.ACMEAuthorization{}
+	for _, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			s.writeError(w, newProblem(http.StatusBadRequest, "unsupportedIdentifier", "identifier type %s is not supported", id.Type))
+			return
+		}
+		id.Value = strings.ToLower(id.Value)
+		if strings.HasPrefix(id.Value, "*.") {
+			s.writeError(w, newProblem(http.StatusBadRequest, "rejectedIdentifier", "wildcard identifiers are not supported"))
+			return
+		}
+		if err := domain.Check(id.Value); err != nil {
+			s.writeError(w, newProblem(http.StatusBadRequest, "rejectedIdentifier", "%s is not a valid DNS name", id.Value))
+			return
+		}
+		if slices.Contains(order.Identifiers, id) {
+			continue
+		}
+		order.Identifiers = append(order.Identifiers, id)
+		authzs = append(authzs, &models.ACMEAuthorization{
+			ID:              randomID(),
+			AccountID:       req.account.ID,
+			Identifier:      id,
+			CertType:        s.CertType,
+			Token:           randomID(),
+			Status:          StatusPending,
+			ChallengeStatus: StatusPending,
+			Expires:         order.Expires,
+		})
+	}
+
+	if s.Authorize != nil {
+		names := []string{}
+		for _, id := range order.Identifiers {
+			names = append(names, id.Value)
+		}
+		if err := s.Authorize(req.account.ID, names); err != nil {
+			s.writeError(w, newProblem(http.StatusForbidden, "unauthorized", "%s", err.Error()))
+			return
+		}
+	}
+
+	if err := s.Store.CreateACMEOrder(order, authzs); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", s.url("/acme/order/%s", order.ID))
+	s.writeJSON(w, http.StatusCreated, s.orderResource(order, authzs))
+}
+
+func (s *Server) order(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	order, authzs, err := s.getOrder(r.PathValue("id"), req.account)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.orderResource(order, authzs))
+}
+
+func (s *Server) finalize(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	order, authzs, err := s.getOrder(r.PathValue("id"), req.account)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if status := orderStatus(order, authzs); status != StatusReady {
+		s.writeError(w, newProblem(http.StatusForbidden, "orderNotReady", "the order is %s", status))
+		return
+	}
+
+	payload := struct {
+		CSR string `json:"csr"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode finalize request"))
+		return
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "badCSR", "the CSR is not base64url encoded"))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "badCSR", "could not parse the CSR"))
+		return
+	}
+	if err := csr.CheckSignature(); err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "badCSR", "the CSR signature is not valid"))
+		return
+	}
+
+	names := []string{}
+	for _, id := range order.Identifiers {
+		names = append(names, id.Value)
+	}
+	if !sameNames(csr, names) {
+		s.writeError(w, newProblem(http.StatusBadRequest, "badCSR", "the CSR names don't match the order identifiers"))
+		return
+	}
+
+	// Only one finalize request can move the order out of its current status, the others see it changed
+	if err := s.Store.UpdateACMEOrderStatus(order.ID, order.Status, StatusProcessing); err != nil {
+		if errors.Is(err, models.ErrACMEOrderChanged) {
+			err = newProblem(http.StatusForbidden, "orderNotReady", "the order is already being finalized")
+		}
+		s.writeError(w, err)
+		return
+	}
+	order.Status = StatusProcessing
+
+	chain, serial, err := s.Issue(order.AccountID, csr, names)
+	if err != nil {
+		log.Printf("[ERROR]: could not issue certificate for ACME order %s, reason: %v", order.ID, err)
+		order.Status = StatusInvalid
+		order.Error = err.Error()
+	} else {
+		order.Status = StatusValid
+		order.Serial = serial
+		order.Certificate = string(chain)
+		log.Printf("... ACME certificate %x issued for order %s", serial, order.ID)
+	}
+	if err := s.Store.UpdateACMEOrder(order); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", s.url("/acme/order/%s", order.ID))
+	s.writeJSON(w, http.StatusOK, s.orderResource(order, authzs))
+}
+
+func (s *Server) authorization(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	authz, err := s.getAuthorization(r.PathValue("id"), req.account)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.authorizationResource(authz))
+}
+
+func (s *Server) challenge(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	authz, err := s.getAuthorization(r.PathValue("id"), req.account)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	challengeType := r.PathValue("type")
+	if challengeType != ChallengeHTTP01 && challengeType != ChallengeApproval {
+		s.writeError(w, newProblem(http.StatusNotFound, "malformed", "unknown challenge"))
+		return
+	}
+
+	// An empty payload is a POST-as-GET, an empty object asks the server to validate the challenge
+	if len(req.payload) > 0 && authz.Status == StatusPending && authz.ChallengeType == "" {
+		authz.ChallengeType = challengeType
+		authz.ChallengeStatus = StatusProcessing
+		if err := s.Store.UpdateACMEAuthorization(authz); err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		if challengeType == ChallengeHTTP01 {
+			go s.validateHTTP01(authz.ID, req.account.Thumbprint)
+		} else {
+			log.Printf("... ACME authorization %s for %s waits for an operator approval", authz.ID, authz.Identifier.Value)
+		}
+	}
+
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="up"`, s.url("/acme/authz/%s", authz.ID)))
+	s.writeJSON(w, http.StatusOK, s.challengeResource(authz, challengeType))
+}
+
+func (s *Server) certificate(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	order, _, err := s.getOrder(r.PathValue("id"), req.account)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if order.Status != StatusValid {
+		s.writeError(w, newProblem(http.StatusNotFound, "malformed", "the certificate has not been issued"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	if _, err := w.Write([]byte(order.Certificate)); err != nil {
+		log.Printf("[ERROR]: could not write ACME certificate, reason: %v", err)
+	}
+}
+
+// revokeCert revokes a certificate issued by this server, the request is signed either by the account
+// that ordered the certificate or by the certificate key
+func (s *Server) revokeCert(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verifyJWS(r, true, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if s.Revoke == nil {
+		s.writeError(w, newProblem(http.StatusForbidden, "unauthorized", "certificate revocation is not enabled"))
+		return
+	}
+
+	payload := struct {
+		Certificate string `json:"certificate"`
+		Reason      *int   `json:"reason"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode revocation request"))
+		return
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "the certificate is not base64url encoded"))
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not parse the certificate"))
+		return
+	}
+
+	reason := 0
+	if payload.Reason != nil {
+		reason = *payload.Reason
+	}
+	// Reason 7 is not used in RFC 5280
+	if reason < 0 || reason > 10 || reason == 7 {
+		s.writeError(w, newProblem(http.StatusBadRequest, "badRevocationReason", "revocation reason %d is not allowed", reason))
+		return
+	}
+
+	var order *models.ACMEOrder
+	if cert.SerialNumber.IsInt64() {
+		order, err = s.Store.GetACMEOrderBySerial(cert.SerialNumber.Int64())
+		if err != nil && !errors.Is(err, models.ErrACMENotFound) {
+			s.writeError(w, err)
+			return
+		}
+	}
+	if order == nil || !bytes.Equal(firstCertificate(order.Certificate), der) {
+		s.writeError(w, newProblem(http.StatusNotFound, "malformed", "the certificate was not issued by this server"))
+		return
+	}
+
+	accountID := ""
+	if req.account != nil {
+		if req.account.ID != order.AccountID {
+			s.writeError(w, newProblem(http.StatusForbidden, "unauthorized", "the account didn't order this certificate"))
+			return
+		}
+		accountID = req.account.ID
+	} else {
+		certThumbprint, err := thumbprint(cert.PublicKey)
+		keyThumbprint, keyErr := thumbprint(req.jwk)
+		if err != nil || keyErr != nil || certThumbprint != keyThumbprint {
+			s.writeError(w, newProblem(http.StatusForbidden, "unauthorized", "the request is not signed with the certificate key"))
+			return
+		}
+	}
+
+	revoked, err := s.Store.IsRevoked(order.Serial)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if revoked {
+		s.writeError(w, newProblem(http.StatusBadRequest, "alreadyRevoked", "the certificate is already revoked"))
+		return
+	}
+
+	if err := s.Revoke(accountID, order.Serial, reason); err != nil {
+		if errors.Is(err, authz.ErrDenied) {
+			err = newProblem(http.StatusForbidden, "unauthorized", "%s", err.Error())
+		}
+		s.writeError(w, err)
+		return
+	}
+
+	log.Printf("... ACME certificate %x revoked, reason %d", order.Serial, reason)
+	if err := s.setNonce(w); err != nil {
+		log.Printf("[ERROR]: could not generate ACME nonce, reason: %v", err)
+	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="index"`, s.url("/acme/directory")))
+	w.WriteHeader(http.StatusOK)
+}
+
+// keyChange replaces the account key, the outer JWS is signed by the account key and the inner
+// JWS by the new key
+func (s *Server) keyChange(w http.ResponseWriter, r *http.Request) {
+	req, err := s.verify(r, true)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	inner := jsonWebSignature{}
+	if err := json.Unmarshal(req.payload, &inner); err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "the payload is not a flattened JWS"))
+		return
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(inner.Protected)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode inner protected header"))
+		return
+	}
+	header := protectedHeader{}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode inner protected header"))
+		return
+	}
+	if len(header.JWK) == 0 || header.KID != "" || header.Nonce != "" {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "the inner JWS must be signed with a jwk and have no nonce"))
+		return
+	}
+	if header.URL != req.url {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "the inner url header doesn't match the request"))
+		return
+	}
+
+	newKey, err := parseJWK(header.JWK)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "badPublicKey", "%v", err))
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(inner.Signature)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode inner signature"))
+		return
+	}
+	if err := verifySignature(header.Alg, newKey, []byte(inner.Protected+"."+inner.Payload), sig); err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "badSignatureAlgorithm", "%v", err))
+		return
+	}
+
+	rawPayload, err := base64.RawURLEncoding.DecodeString(inner.Payload)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode inner payload"))
+		return
+	}
+	payload := struct {
+		Account string          `json:"account"`
+		OldKey  json.RawMessage `json:"oldKey"`
+	}{}
+	if err := json.Unmarshal(rawPayload, &payload); err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode key change request"))
+		return
+	}
+	if payload.Account != req.kid {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "the account doesn't match the kid header"))
+		return
+	}
+
+	oldKey, err := parseJWK(payload.OldKey)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "could not decode the old key"))
+		return
+	}
+	if oldThumbprint, err := thumbprint(oldKey); err != nil || oldThumbprint != req.account.Thumbprint {
+		s.writeError(w, newProblem(http.StatusBadRequest, "malformed", "the old key is not the account key"))
+		return
+	}
+
+	newThumbprint, err := thumbprint(newKey)
+	if err != nil {
+		s.writeError(w, newProblem(http.StatusBadRequest, "badPublicKey", "%v", err))
+		return
+	}
+	existing, err := s.Store.GetACMEAccountByThumbprint(newThumbprint)
+	if err == nil {
+		w.Header().Set("Location", s.url("/acme/account/%s", existing.ID))
+		s.writeError(w, newProblem(http.StatusConflict, "malformed", "the new key is already used by an account"))
+		return
+	}
+	if !errors.Is(err, models.ErrACMENotFound) {
+		s.writeError(w, err)
+		return
+	}
+
+	req.account.Thumbprint = newThumbprint
+	req.account.JWK = string(header.JWK)
+	if err := s.Store.UpdateACMEAccount(req.account); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	log.Printf("... ACME account %s key changed", req.account.ID)
+	s.writeJSON(w, http.StatusOK, s.accountResource(req.account))
+}
+
+// validateHTTP01 fetches the key authorization from the identifier's web server
+func (s *Server) validateHTTP01(authzID string, accountThumbprint string) {
+	authz, err := s.Store.GetACMEAuthorization(authzID)
+	if err != nil {
+		log.Printf("[ERROR]: could not get ACME authorization %s, reason: %v", authzID, err)
+		return
+	}
+
+	port := s.HTTPPort
+	if port == "" {
+		port = "80"
+	}
+	client := s.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	url := fmt.Sprintf("http://%s:%s/.well-known/acme-challenge/%s", authz.Identifier.Value, port, authz.Token)
+	expected := authz.Token + "." + accountThumbprint
+
+	var validationErr error
+	for attempt := range 3 {
+		if attempt > 0 {
+			time.Sleep(2 * time.Second)
+		}
+		validationErr = fetchKeyAuthorization(client, url, expected)
+		if validationErr == nil {
+			break
+		}
+	}
+
+	if validationErr != nil {
+		log.Printf("[WARN]: ACME http-01 challenge for %s failed, reason: %v", authz.Identifier.Value, validationErr)
+		authz.Status = StatusInvalid
+		authz.ChallengeStatus = StatusInvalid
+		authz.Error = validationErr.Error()
+	} else {
+		now := time.Now()
+		authz.Status = StatusValid
+		authz.ChallengeStatus = StatusValid
+		authz.Validated = &now
+	}
+
+	if err := s.Store.UpdateACMEAuthorization(authz); err != nil {
+		log.Printf("[ERROR]: could not update ACME authorization %s, reason: %v", authzID, err)
+	}
+}
+
+func fetchKeyAuthorization(client *http.Client, url string, expected string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != expected {
+		return fmt.Errorf("the key authorization doesn't match")
+	}
+	return nil
+}
+
+// verify checks the JWS signature, nonce and URL of a request. Requests must be signed by an existing
+// account (kid) unless it's a new account request (jwk)
+func (s *Server) verify(r *http.Request, withAccount bool) (*request, error) {
+	return s.verifyJWS(r, withAccount, !withAccount)
+}
+
+// verifyJWS checks a request signed by an account (kid) or by the key in the jwk header, as allowed
+func (s *Server) verifyJWS(r *http.Request, allowKID bool, allowJWK bool) (*request, error) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/jose+json" {
+		return nil, newProblem(http.StatusUnsupportedMediaType, "malformed", "the content type must be application/jose+json")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "could not read request")
+	}
+
+	jws := jsonWebSignature{}
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "the request is not a flattened JWS")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "could not decode protected header")
+	}
+	header := protectedHeader{}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "could not decode protected header")
+	}
+
+	if !s.useNonce(header.Nonce) {
+		return nil, newProblem(http.StatusBadRequest, "badNonce", "the nonce is not valid")
+	}
+
+	if header.URL != s.url("%s", r.URL.Path) {
+		return nil, newProblem(http.StatusUnauthorized, "unauthorized", "the url header doesn't match the request")
+	}
+
+	if header.KID != "" && len(header.JWK) > 0 {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "the request can't have both a jwk and a kid")
+	}
+
+	req := &request{url: header.URL}
+	switch {
+	case allowKID && header.KID != "":
+		id := strings.TrimPrefix(header.KID, s.url("/acme/account/"))
+		req.account, err = s.Store.GetACMEAccount(id)
+		if errors.Is(err, models.ErrACMENotFound) {
+			return nil, newProblem(http.StatusBadRequest, "accountDoesNotExist", "the account doesn't exist")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if req.account.Status != StatusValid {
+			return nil, newProblem(http.StatusUnauthorized, "unauthorized", "the account is %s", req.account.Status)
+		}
+		req.jwk, err = parseJWK([]byte(req.account.JWK))
+		if err != nil {
+			return nil, err
+		}
+		req.kid = header.KID
+	case allowJWK && len(header.JWK) > 0:
+		req.jwk, err = parseJWK(header.JWK)
+		if err != nil {
+			return nil, newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+		}
+		req.rawJWK = header.JWK
+	default:
+		return nil, newProblem(http.StatusBadRequest, "malformed", "the request must be signed with a jwk or a kid")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "could not decode signature")
+	}
+	if err := verifySignature(header.Alg, req.jwk, []byte(jws.Protected+"."+jws.Payload), sig); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "badSignatureAlgorithm", "%v", err)
+	}
+
+	req.payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "could not decode payload")
+	}
+	return req, nil
+}
+
+func (s *Server) getOrder(id string, account *models.ACMEAccount) (*models.ACMEOrder, []*models.ACMEAuthorization, error) {
+	order, err := s.Store.GetACMEOrder(id)
+	if errors.Is(err, models.ErrACMENotFound) || (err == nil && order.AccountID != account.ID) {
+		return nil, nil, newProblem(http.StatusNotFound, "malformed", "order not found")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	authzs, err := s.Store.GetACMEAuthorizations(order.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return order, authzs, nil
+}
+
+func (s *Server) getAuthorization(id string, account *models.ACMEAccount) (*models.ACMEAuthorization, error) {
+	authz, err := s.Store.GetACMEAuthorization(id)
+	if errors.Is(err, models.ErrACMENotFound) || (err == nil && authz.AccountID != account.ID) {
+		return nil, newProblem(http.StatusNotFound, "malformed", "authorization not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if authz.Status == StatusPending && time.Now().After(authz.Expires) {
+		authz.Status = StatusInvalid
+	}
+	return authz, nil
+}
+
+func orderStatus(order *models.ACMEOrder, authzs []*models.ACMEAuthorization) string {
+	if order.Status != StatusPending {
+		return order.Status
+	}
+	if time.Now().After(order.Expires) {
+		return StatusInvalid
+	}
+
+	status := StatusReady
+	for _, a := range authzs {
+		switch a.Status {
+		case StatusInvalid:
+			return StatusInvalid
+		case StatusValid:
+		default:
+			status = StatusPending
+		}
+	}
+	return status
+}
+
+func (s *Server) accountResource(a *models.ACMEAccount) accountResource {
+	return accountResource{
+		Status:  a.Status,
+		Contact: a.Contact,
+		Orders:  s.url("/acme/account/%s/orders", a.ID),
+	}
+}
+
+func (s *Server) orderResource(o *models.ACMEOrder, authzs []*models.ACMEAuthorization) orderResource {
+	res := orderResource{
+		Status:         orderStatus(o, authzs),
+		Expires:        o.Expires.UTC().Format(time.RFC3339),
+		Identifiers:    o.Identifiers,
+		Authorizations: []string{},
+		Finalize:       s.url("/acme/order/%s/finalize", o.ID),
+	}
+	for _, a := range authzs {
+		res.Authorizations = append(res.Authorizations, s.url("/acme/authz/%s", a.ID))
+	}
+	if o.Status == StatusValid {
+		res.Certificate = s.url("/acme/cert/%s", o.ID)
+	}
+	if o.Error != "" {
+		res.Error = newProblem(http.StatusInternalServerError, "serverInternal", "%s", o.Error)
+	}
+	return res
+}
+
+func (s *Server) authorizationResource(a *models.ACMEAuthorization) authorizationResource {
+	return authorizationResource{
+		Identifier: a.Identifier,
+		Status:     a.Status,
+		Expires:    a.Expires.UTC().Format(time.RFC3339),
+		Challenges: []challengeResource{
+			s.challengeResource(a, ChallengeHTTP01),
+			s.challengeResource(a, ChallengeApproval),
+		},
+	}
+}
+
+func (s *Server) challengeResource(a *models.ACMEAuthorization, challengeType string) challengeResource {
+	c := challengeResource{
+		Type:   challengeType,
+		URL:    s.url("/acme/chall/%s/%s", a.ID, challengeType),
+		Status: StatusPending,
+		Token:  a.Token,
+	}
+	if a.ChallengeType == challengeType {
+		c.Status = a.ChallengeStatus
+		if a.Validated != nil {
+			c.Validated = a.Validated.UTC().Format(time.RFC3339)
+		}
+		if a.Error != "" {
+			c.Error = newProblem(http.StatusForbidden, "incorrectResponse", "%s", a.Error)
+		}
+	}
+	return c
+}
+
+func (s *Server) setNonce(w http.ResponseWriter) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nonces == nil {
+		s.nonces = map[string]time.Time{}
+	}
+	now := time.Now()
+	for n, expires := range s.nonces {
+		if now.After(expires) {
+			delete(s.nonces, n)
+		}
+	}
+	s.nonces[nonce] = now.Add(nonceLifetime)
+
+	w.Header().Set("Replay-Nonce", nonce)
+	return nil
+}
+
+func (s *Server) useNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	return ok && time.Now().Before(expires)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	if err := s.setNonce(w); err != nil {
+		log.Printf("[ERROR]: could not generate ACME nonce, reason: %v", err)
+	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="index"`, s.url("/acme/directory")))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[ERROR]: could not encode ACME response, reason: %v", err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	p := &problem{}
+	if !errors.As(err, &p) {
+		log.Printf("[ERROR]: ACME request failed, reason: %v", err)
+		p = newProblem(http.StatusInternalServerError, "serverInternal", "internal server error")
+	}
+	if err := s.setNonce(w); err != nil {
+		log.Printf("[ERROR]: could not generate ACME nonce, reason: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Printf("[ERROR]: could not encode ACME error, reason: %v", err)
+	}
+}
+
+// sameNames checks that the CSR requests exactly the names in the order
+func sameNames(csr *x509.CertificateRequest, names []string) bool {
+	requested := []string{}
+	for _, n := range csr.DNSNames {
+		requested = append(requested, strings.ToLower(n))
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" && !slices.Contains(requested, cn) {
+		requested = append(requested, cn)
+	}
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return false
+	}
+
+	slices.Sort(requested)
+	requested = slices.Compact(requested)
+	expected := slices.Clone(names)
+	slices.Sort(expected)
+	return slices.Equal(requested, expected)
+}
+
+// firstCertificate returns the DER of the leaf certificate in a PEM chain
+func firstCertificate(chain string) []byte {
+	block, _ := pem.Decode([]byte(chain))
+	if block == nil {
+		return nil
+	}
+	return block.Bytes
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,374 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"golang.org/x/crypto/acme"
+)
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	issued atomic.Int32
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ACME test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(accountID string, csr *x509.CertificateRequest, names []string) ([]byte, int64, error) {
+	// Give concurrent finalize requests time to race
+	time.Sleep(100 * time.Millisecond)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, 0, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, 0, err
+	}
+	ca.issued.Add(1)
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	return chain, serial.Int64(), nil
+}
+
+// challenges serves the http-01 key authorizations like the web server of the identifier would
+type challenges struct {
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func (c *challenges) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keyAuth, ok := c.tokens[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = w.Write([]byte(keyAuth))
+}
+
+type testEnv struct {
+	ca         *testCA
+	model      *models.Model
+	server     *httptest.Server
+	challenges *challenges
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	model, err := models.New("sqlite://" + filepath.Join(t.TempDir(), "acme.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(model.Close)
+
+	env := &testEnv{ca: newTestCA(t), model: model, challenges: &challenges{tokens: map[string]string{}}}
+
+	challengeServer := httptest.NewServer(env.challenges)
+	t.Cleanup(challengeServer.Close)
+	u, err := url.Parse(challengeServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Store:    model,
+		Issue:    env.ca.issue,
+		HTTPPort: u.Port(),
+		Revoke: func(accountID string, serial int64, reason int) error {
+			return model.AddRevocation(serial, reason, "revoked by ACME account "+accountID)
+		},
+	}
+	env.server = httptest.NewServer(s.Handler())
+	t.Cleanup(env.server.Close)
+	s.BaseURL = env.server.URL
+	return env
+}
+
+func (env *testEnv) newClient(t *testing.T) *acme.Client {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &acme.Client{Key: key, DirectoryURL: env.server.URL + "/acme/directory"}
+	if _, err := c.Register(context.Background(), &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatalf("could not register account: %v", err)
+	}
+	return c
+}
+
+// readyOrder creates an order for localhost and validates its http-01 challenge
+func (env *testEnv) readyOrder(t *testing.T, c *acme.Client) *acme.Order {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	order, err := c.AuthorizeOrder(ctx, acme.DomainIDs("localhost"))
+	if err != nil {
+		t.Fatalf("could not create order: %v", err)
+	}
+
+	for _, u := range order.AuthzURLs {
+		authz, err := c.GetAuthorization(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var chal *acme.Challenge
+		for _, ch := range authz.Challenges {
+			if ch.Type == ChallengeHTTP01 {
+				chal = ch
+			}
+		}
+		if chal == nil {
+			t.Fatal("the authorization has no http-01 challenge")
+		}
+
+		keyAuth, err := c.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.challenges.mu.Lock()
+		env.challenges.tokens[c.HTTP01ChallengePath(chal.Token)] = keyAuth
+		env.challenges.mu.Unlock()
+
+		if _, err := c.Accept(ctx, chal); err != nil {
+			t.Fatalf("could not accept challenge: %v", err)
+		}
+		if _, err := c.WaitAuthorization(ctx, u); err != nil {
+			t.Fatalf("the authorization was not validated: %v", err)
+		}
+	}
+
+	order, err = c.WaitOrder(ctx, order.URI)
+	if err != nil {
+		t.Fatalf("the order is not ready: %v", err)
+	}
+	return order
+}
+
+func newCSR(t *testing.T) ([]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"localhost"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr, key
+}
+
+func TestIssueCertificate(t *testing.T) {
+	env := newTestEnv(t)
+	c := env.newClient(t)
+	order := env.readyOrder(t, c)
+
+	csr, _ := newCSR(t)
+	chain, _, err := c.CreateOrderCert(context.Background(), order.FinalizeURL, csr, true)
+	if err != nil {
+		t.Fatalf("could not finalize order: %v", err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("expected a chain with 2 certificates, got %d", len(chain))
+	}
+
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(env.ca.cert); err != nil {
+		t.Fatalf("the certificate is not signed by the CA: %v", err)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "localhost" {
+		t.Fatalf("unexpected DNS names %v", cert.DNSNames)
+	}
+}
+
+func TestFinalizeOnce(t *testing.T) {
+	env := newTestEnv(t)
+	c := env.newClient(t)
+	order := env.readyOrder(t, c)
+
+	csr, _ := newCSR(t)
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, _, err := c.CreateOrderCert(context.Background(), order.FinalizeURL, csr, false)
+			errs <- err
+		}()
+	}
+
+	failed := 0
+	for range 2 {
+		if err := <-errs; err != nil {
+			failed++
+			e := &acme.Error{}
+			if !errors.As(err, &e) || !strings.HasSuffix(e.ProblemType, "orderNotReady") {
+				t.Fatalf("expected an orderNotReady error, got %v", err)
+			}
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("expected one finalize request to fail, %d failed", failed)
+	}
+	if n := env.ca.issued.Load(); n != 1 {
+		t.Fatalf("expected one certificate to be issued, got %d", n)
+	}
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	env := newTestEnv(t)
+	c := env.newClient(t)
+	ctx := context.Background()
+
+	csr, _ := newCSR(t)
+	chain, _, err := c.CreateOrderCert(ctx, env.readyOrder(t, c).FinalizeURL, csr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := env.newClient(t)
+	if err := other.RevokeCert(ctx, nil, chain[0], acme.CRLReasonKeyCompromise); err == nil {
+		t.Fatal("an account revoked a certificate it didn't order")
+	}
+
+	if err := c.RevokeCert(ctx, nil, chain[0], acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatalf("could not revoke with the account key: %v", err)
+	}
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocation, err := env.model.GetRevocation(cert.SerialNumber.Int64())
+	if err != nil {
+		t.Fatalf("the revocation was not stored: %v", err)
+	}
+	if revocation.Reason != int(acme.CRLReasonKeyCompromise) {
+		t.Fatalf("expected reason %d, got %d", acme.CRLReasonKeyCompromise, revocation.Reason)
+	}
+
+	// The client ignores alreadyRevoked errors, the first revocation must be kept
+	if err := c.RevokeCert(ctx, nil, chain[0], acme.CRLReasonSuperseded); err != nil {
+		t.Fatalf("expected the alreadyRevoked error to be ignored, got %v", err)
+	}
+	revocation, err = env.model.GetRevocation(cert.SerialNumber.Int64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revocation.Reason != int(acme.CRLReasonKeyCompromise) {
+		t.Fatalf("the revocation reason changed to %d", revocation.Reason)
+	}
+
+	csr, certKey := newCSR(t)
+	chain, _, err = c.CreateOrderCert(ctx, env.readyOrder(t, c).FinalizeURL, csr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.RevokeCert(ctx, certKey, chain[0], acme.CRLReasonUnspecified); err != nil {
+		t.Fatalf("could not revoke with the certificate key: %v", err)
+	}
+}
+
+func TestKeyChange(t *testing.T) {
+	env := newTestEnv(t)
+	c := env.newClient(t)
+	ctx := context.Background()
+
+	account, err := c.GetReg(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AccountKeyRollover(ctx, newKey); err != nil {
+		t.Fatalf("could not change the account key: %v", err)
+	}
+
+	// The client now signs with the new key
+	rolled, err := c.GetReg(ctx, "")
+	if err != nil {
+		t.Fatalf("the new key is not accepted: %v", err)
+	}
+	if rolled.URI != account.URI {
+		t.Fatalf("expected account %s, got %s", account.URI, rolled.URI)
+	}
+
+	other := env.newClient(t)
+	err = other.AccountKeyRollover(ctx, newKey)
+	e := &acme.Error{}
+	if !errors.As(err, &e) || e.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a conflict when reusing an account key, got %v", err)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, err := http.Post(env.server.URL+"/acme/new-account", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status %d, got %d", http.StatusUnsupportedMediaType, resp.StatusCode)
+	}
+}
@@ -0,0 +1,219 @@
+package authz
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+)
+
+// Actions that can be allowed on a certificate type
+const (
+	ActionIssue  = "issue"
+	ActionRenew  = "renew"
+	ActionRevoke = "revoke"
+	ActionRead   = "read"
+	// ActionApprove allows approving or rejecting the requests of a certificate type
+	ActionApprove = "approve"
+
+	// Any matches every identity, action or certificate type in a rule
+	Any = "*"
+
+	// SCEPChallengeIdentity is the identity of SCEP clients that know the static challenge password
+	SCEPChallengeIdentity = "scep:challenge"
+	// EnrollmentTokenIdentity is the identity of clients that present a valid enrollment token
+	EnrollmentTokenIdentity = "enroll:token"
+)
+
+var Actions = []string{ActionIssue, ActionRenew, ActionRevoke, ActionRead, ActionApprove}
+
+var ErrDenied = errors.New("the operation is not allowed by the authorization policy")
+
+// Policy maps identities to the actions they're allowed to perform on each certificate type, anything
+// that isn't allowed by a rule is denied. A policy file looks like:
+//
+//	{
+//	  "tokens": [{"name": "ci", "hash": "<sha256 of the token in hex>"}],
+//	  "rules": [
+//	    {"identities": ["cert:CN=console,*"], "actions": ["issue", "renew", "read"], "types": ["user"]},
+//	    {"identities": ["token:ci"], "actions": ["*"], "types": ["proxy"]}
+//	  ]
+//	}
+//
+// Identities are prefixed by how they were authenticated: cert:<subject DN>, token:<name>,
+// basic:<username>, acme:<account id>, cli:<name>, scep:challenge or enroll:token, and may contain * wildcards
+type Policy struct {
+	Tokens []Token `json:"tokens"`
+	Rules  []Rule  `json:"rules"`
+}
+
+type Token struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+type Rule struct {
+	Identities []string `json:"identities"`
+	Actions    []string `json:"actions"`
+	Types      []string `json:"types"`
+}
+
+// Load reads and validates a policy file
+func Load(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read policy file, reason: %s", err.Error())
+	}
+
+	p := Policy{}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("could not decode policy file, reason: %s", err.Error())
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Policy) Validate() error {
+	for _, t := range p.Tokens {
+		if t.Name == "" {
+			return fmt.Errorf("policy tokens must have a name")
+		}
+		if b, err := hex.DecodeString(t.Hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("the hash of token %s is not a SHA-256 hex string", t.Name)
+		}
+	}
+
+	for i, r := range p.Rules {
+		if len(r.Identities) == 0 || len(r.Actions) == 0 || len(r.Types) == 0 {
+			return fmt.Errorf("rule %d must have identities, actions and types", i+1)
+		}
+		for _, id := range r.Identities {
+			if _, err := path.Match(id, ""); err != nil {
+				return fmt.Errorf("rule %d has an invalid identity pattern %q", i+1, id)
+			}
+		}
+		for _, a := range r.Actions {
+			if a != Any && !slices.Contains(Actions, a) {
+				return fmt.Errorf("rule %d has an unknown action %q", i+1, a)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed evaluates the rules in order and reports if any of them allows the action
+func (p *Policy) Allowed(identity string, action string, certType string) bool {
+	for _, r := range p.Rules {
+		if r.matches(identity, action, certType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matches(identity string, action string, certType string) bool {
+	identityOK := slices.ContainsFunc(r.Identities, func(pattern string) bool {
+		ok, _ := path.Match(pattern, identity)
+		return ok
+	})
+	actionOK := slices.Contains(r.Actions, Any) || slices.Contains(r.Actions, action)
+	typeOK := slices.Contains(r.Types, Any) || slices.Contains(r.Types, certType)
+	return identityOK && actionOK && typeOK
+}
+
+// HashToken returns the value stored in a policy file for a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// LookupToken returns the identity of an API token if the policy knows it
+func (p *Policy) LookupToken(token string) (string, bool) {
+	hash := HashToken(token)
+	for _, t := range p.Tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) == 1 {
+			return TokenIdentity(t.Name), true
+		}
+	}
+	return "", false
+}
+
+func CertificateIdentity(cert *x509.Certificate) string {
+	return "cert:" + cert.Subject.String()
+}
+
+func TokenIdentity(name string) string {
+	return "token:" + name
+}
+
+func BasicIdentity(username string) string {
+	return "basic:" + username
+}
+
+func ACMEIdentity(accountID string) string {
+	return "acme:" + accountID
+}
+
+// CLIIdentity identifies the people that request or approve certificates from the command-line
+func CLIIdentity(name string) string {
+	return "cli:" + name
+}
+
+// DenialStore records the operations denied by a policy
+type DenialStore interface {
+	SaveAuthzDenial(identity string, action string, certType string, resource string) error
+}
+
+// Authorizer checks operations against a policy. Without a policy every operation is allowed
+// so servers behave as they did before policies existed
+type Authorizer struct {
+	Policy *Policy
+	Store  DenialStore
+}
+
+// NewAuthorizer loads the policy file, if any
+func NewAuthorizer(filename string, store DenialStore) (*Authorizer, error) {
+	a := &Authorizer{Store: store}
+	if filename == "" {
+		return a, nil
+	}
+
+	p, err := Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	a.Policy = p
+	return a, nil
+}
+
+// Authorize returns ErrDenied if the identity can't perform the action, denials are logged and stored.
+// The resource is optional and only used in the trail of denials, e.g. a serial number
+func (a *Authorizer) Authorize(identity string, action string, certType string, resource string) error {
+	if a == nil || a.Policy == nil || a.Policy.Allowed(identity, action, certType) {
+		return nil
+	}
+
+	log.Printf("[WARN]: %s is not allowed to %s %s certificates %s", identity, action, certType, resource)
+	if a.Store != nil {
+		if err := a.Store.SaveAuthzDenial(identity, action, certType, resource); err != nil {
+			log.Printf("[ERROR]: could not save authorization denial, reason: %v", err)
+		}
+	}
+	return fmt.Errorf("%w: %s can't %s %s certificates", ErrDenied, identity, action, certType)
+}
+
+// Allowed reports if the identity can perform the action without recording denials, it's meant
+// to filter the results of read operations
+func (a *Authorizer) Allowed(identity string, action string, certType string) bool {
+	return a == nil || a.Policy == nil || a.Policy.Allowed(identity, action, certType)
+}
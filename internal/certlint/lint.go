@@ -0,0 +1,233 @@
+package certlint
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Severities of the findings, a certificate with errors must not be used
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+type Finding struct {
+	Severity string
+	Message  string
+}
+
+func (f Finding) String() string {
+	return f.Severity + ": " + f.Message
+}
+
+// LintError has the findings of a certificate with errors
+type LintError struct {
+	Subject  string
+	Findings []Finding
+}
+
+func (e *LintError) Error() string {
+	messages := []string{}
+	for _, f := range e.Findings {
+		if f.Severity == SeverityError {
+			messages = append(messages, f.Message)
+		}
+	}
+	return fmt.Sprintf("the certificate %s failed the lint checks: %s", e.Subject, strings.Join(messages, "; "))
+}
+
+var attributeNames = map[string]string{
+	"2.5.4.3":                   "CN",
+	"2.5.4.5":                   "SERIALNUMBER",
+	"2.5.4.6":                   "C",
+	"2.5.4.7":                   "L",
+	"2.5.4.8":                   "ST",
+	"2.5.4.9":                   "STREET",
+	"2.5.4.10":                  "O",
+	"2.5.4.11":                  "OU",
+	"2.5.4.17":                  "POSTALCODE",
+	"0.9.2342.19200300.100.1.1": "UID",
+}
+
+// Lint checks a certificate against the rules of RFC 5280 and the CA/Browser Forum baseline requirements
+// that apply to a private PKI
+func Lint(cert *x509.Certificate) []Finding {
+	l := &linter{}
+	l.checkSerialNumber(cert)
+	l.checkValidity(cert)
+	l.checkSubject(cert)
+	l.checkKeyIdentifiers(cert)
+	l.checkBasicConstraints(cert)
+	l.checkKeyUsage(cert)
+	l.checkURLs("OCSP", cert.OCSPServer)
+	l.checkURLs("CRL distribution point", cert.CRLDistributionPoints)
+	l.checkURLs("CA issuers", cert.IssuingCertificateURL)
+	return l.findings
+}
+
+// Check lints a certificate and returns a *LintError if it has errors, warnings are returned anyway
+func Check(cert *x509.Certificate) ([]Finding, error) {
+	findings := Lint(cert)
+	if slices.ContainsFunc(findings, func(f Finding) bool { return f.Severity == SeverityError }) {
+		return findings, &LintError{Subject: cert.Subject.String(), Findings: findings}
+	}
+	return findings, nil
+}
+
+type linter struct {
+	findings []Finding
+}
+
+func (l *linter) errorf(format string, args ...any) {
+	l.findings = append(l.findings, Finding{Severity: SeverityError, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warnf(format string, args ...any) {
+	l.findings = append(l.findings, Finding{Severity: SeverityWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-4.1.2.2
+func (l *linter) checkSerialNumber(cert *x509.Certificate) {
+	if cert.SerialNumber == nil || cert.SerialNumber.Sign() <= 0 {
+		l.errorf("the serial number must be a positive integer")
+		return
+	}
+	if len(cert.SerialNumber.Bytes()) > 20 {
+		l.errorf("the serial number is longer than 20 octets")
+	}
+}
+
+func (l *linter) checkValidity(cert *x509.Certificate) {
+	if !cert.NotAfter.After(cert.NotBefore) {
+		l.errorf("the certificate expires (%s) before it's valid (%s)", cert.NotAfter, cert.NotBefore)
+	}
+}
+
+// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-4.1.2.6
+func (l *linter) checkSubject(cert *x509.Certificate) {
+	for _, attr := range cert.Subject.Names {
+		if value, ok := attr.Value.(string); ok && strings.TrimSpace(value) == "" {
+			l.errorf("the subject attribute %s is empty", attributeName(attr.Type))
+		} else if ok && value != strings.TrimSpace(value) {
+			l.warnf("the subject attribute %s has leading or trailing blanks", attributeName(attr.Type))
+		}
+	}
+
+	hasSAN := len(cert.DNSNames) > 0 || len(cert.IPAddresses) > 0 || len(cert.URIs) > 0 || len(cert.EmailAddresses) > 0
+	if len(cert.Subject.Names) == 0 && !hasSAN {
+		l.errorf("the certificate has neither a subject nor a subject alternative name")
+	}
+}
+
+// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-4.2.1.1 and 4.2.1.2
+func (l *linter) checkKeyIdentifiers(cert *x509.Certificate) {
+	if len(cert.SubjectKeyId) == 0 {
+		if cert.IsCA {
+			l.errorf("the CA certificate has no subject key identifier")
+		} else {
+			l.warnf("the certificate has no subject key identifier")
+		}
+	}
+
+	if len(cert.AuthorityKeyId) == 0 && !isSelfSigned(cert) {
+		l.errorf("the certificate has no authority key identifier")
+	}
+}
+
+// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-4.2.1.9
+func (l *linter) checkBasicConstraints(cert *x509.Certificate) {
+	if cert.IsCA && !cert.BasicConstraintsValid {
+		l.errorf("the CA certificate has no basic constraints")
+	}
+	if cert.IsCA && cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		l.errorf("the CA certificate can't sign certificates (no keyCertSign key usage)")
+	}
+	if !cert.IsCA && cert.KeyUsage&x509.KeyUsageCertSign != 0 {
+		l.errorf("the certificate has the keyCertSign key usage but it's not a CA")
+	}
+}
+
+// checkKeyUsage looks for extended key usages that the key usage doesn't allow
+// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-4.2.1.12
+func (l *linter) checkKeyUsage(cert *x509.Certificate) {
+	if cert.KeyUsage == 0 {
+		if !cert.IsCA {
+			l.warnf("the certificate has no key usage")
+		}
+		return
+	}
+
+	required := map[x509.ExtKeyUsage]x509.KeyUsage{
+		x509.ExtKeyUsageServerAuth:      x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		x509.ExtKeyUsageClientAuth:      x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
+		x509.ExtKeyUsageCodeSigning:     x509.KeyUsageDigitalSignature,
+		x509.ExtKeyUsageEmailProtection: x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		x509.ExtKeyUsageTimeStamping:    x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+		x509.ExtKeyUsageOCSPSigning:     x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+	}
+	names := map[x509.ExtKeyUsage]string{
+		x509.ExtKeyUsageServerAuth:      "serverAuth",
+		x509.ExtKeyUsageClientAuth:      "clientAuth",
+		x509.ExtKeyUsageCodeSigning:     "codeSigning",
+		x509.ExtKeyUsageEmailProtection: "emailProtection",
+		x509.ExtKeyUsageTimeStamping:    "timeStamping",
+		x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+	}
+
+	for _, eku := range cert.ExtKeyUsage {
+		if usages, ok := required[eku]; ok && cert.KeyUsage&usages == 0 {
+			l.errorf("the extended key usage %s contradicts the key usage of the certificate", names[eku])
+		}
+	}
+
+	// Ref: https://datatracker.ietf.org/doc/html/rfc3161#section-2.3
+	if slices.Contains(cert.ExtKeyUsage, x509.ExtKeyUsageTimeStamping) && (len(cert.ExtKeyUsage) > 1 || len(cert.UnknownExtKeyUsage) > 0) {
+		l.errorf("the timeStamping extended key usage must be the only one")
+	}
+}
+
+// checkURLs checks the URLs of the authority information access and CRL distribution points
+// extensions, they must be absolute http or ldap URLs
+func (l *linter) checkURLs(name string, urls []string) {
+	for _, raw := range urls {
+		if raw == "" {
+			l.errorf("the %s URL is empty", name)
+			continue
+		}
+		if strings.TrimSpace(raw) != raw || strings.ContainsAny(raw, " \t\r\n") {
+			l.errorf("the %s URL %q contains blanks", name, raw)
+			continue
+		}
+
+		u, err := url.Parse(raw)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			l.errorf("the %s URL %q is not a valid absolute URL", name, raw)
+			continue
+		}
+
+		switch u.Scheme {
+		case "http", "ldap":
+		case "https":
+			// Relying parties may need these URLs to validate the TLS certificate of the server
+			l.warnf("the %s URL %s uses https, http is recommended", name, raw)
+		default:
+			l.errorf("the %s URL %s must use http or ldap", name, raw)
+		}
+	}
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+func attributeName(oid asn1.ObjectIdentifier) string {
+	if name, ok := attributeNames[oid.String()]; ok {
+		return name
+	}
+	return oid.String()
+}
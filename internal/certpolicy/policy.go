@@ -0,0 +1,328 @@
+package certpolicy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Any sets the constraints of the certificate types that have no constraints of their own
+const Any = "*"
+
+// Key algorithms that can be allowed
+const (
+	KeyRSA     = "RSA"
+	KeyECDSA   = "ECDSA"
+	KeyEd25519 = "Ed25519"
+)
+
+var KeyAlgorithms = []string{KeyRSA, KeyECDSA, KeyEd25519}
+
+// ExtKeyUsages maps the names used in a policy file to extended key usages
+var ExtKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":             x509.ExtKeyUsageAny,
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"ocspSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// SubjectFields are the subject attributes that can be required
+var SubjectFields = []string{"CN", "O", "OU", "C", "ST", "L", "STREET", "POSTALCODE"}
+
+// Policy constrains the certificates issued for each certificate type. A policy file looks like:
+//
+//	{
+//	  "types": {
+//	    "*": {"max_validity_days": 825, "cap_to_ca_expiry": true, "key_algorithms": ["RSA"], "min_rsa_bits": 2048},
+//	    "console": {"dns_allow": ["example.com"], "dns_deny": ["internal.example.com"], "required_subject": ["CN", "O"], "ext_key_usages": ["serverAuth", "clientAuth"]}
+//	  }
+//	}
+//
+// Types are the OpenUEM certificate types, device, radius, code-signing or time-stamping, the "*" entry applies to the types not listed
+type Policy struct {
+	Types map[string]Constraints `json:"types"`
+}
+
+type Constraints struct {
+	// MaxValidityDays is the longest a certificate can be valid, 0 means no limit
+	MaxValidityDays int `json:"max_validity_days"`
+	// CapToCAExpiry shortens the certificates that would expire after the CA, otherwise they're rejected
+	CapToCAExpiry bool     `json:"cap_to_ca_expiry"`
+	KeyAlgorithms []string `json:"key_algorithms"`
+	MinRSABits    int      `json:"min_rsa_bits"`
+	// DNSAllow and DNSDeny are domain suffixes, a name must match an allowed suffix, if any, and no denied suffix.
+	// They apply to the DNS names and to a common name that is a hostname
+	DNSAllow        []string `json:"dns_allow"`
+	DNSDeny         []string `json:"dns_deny"`
+	RequiredSubject []string `json:"required_subject"`
+	ExtKeyUsages    []string `json:"ext_key_usages"`
+}
+
+// ViolationError lists every rule of the policy broken by a certificate
+type ViolationError struct {
+	Type       string
+	Violations []string
+}
+
+func (e *ViolationError) Error() string {
+	return fmt.Sprintf("the %s certificate violates the certificate policy: %s", e.Type, strings.Join(e.Violations, "; "))
+}
+
+// Load reads and validates a policy file
+func Load(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read certificate policy file, reason: %s", err.Error())
+	}
+
+	p := Policy{}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("could not decode certificate policy file, reason: %s", err.Error())
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("the certificate policy is not valid, reason: %s", err.Error())
+	}
+	return &p, nil
+}
+
+// LoadOptional reads a policy file, no policy is enforced if filename is empty
+func LoadOptional(filename string) (*Policy, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	return Load(filename)
+}
+
+func (p *Policy) Validate() error {
+	for certType, c := range p.Types {
+		if c.MaxValidityDays < 0 {
+			return fmt.Errorf("type %s: max_validity_days can't be negative", certType)
+		}
+		if c.MinRSABits < 0 {
+			return fmt.Errorf("type %s: min_rsa_bits can't be negative", certType)
+		}
+		for _, alg := range c.KeyAlgorithms {
+			if !slices.Contains(KeyAlgorithms, alg) {
+				return fmt.Errorf("type %s: key algorithm %s is not one of %s", certType, alg, strings.Join(KeyAlgorithms, ", "))
+			}
+		}
+		for _, field := range c.RequiredSubject {
+			if !slices.Contains(SubjectFields, field) {
+				return fmt.Errorf("type %s: subject field %s is not one of %s", certType, field, strings.Join(SubjectFields, ", "))
+			}
+		}
+		for _, eku := range c.ExtKeyUsages {
+			if _, ok := ExtKeyUsages[eku]; !ok {
+				return fmt.Errorf("type %s: extended key usage %s is not known", certType, eku)
+			}
+		}
+	}
+	return nil
+}
+
+// ConstraintsFor returns the constraints of a certificate type and whether there are any
+func (p *Policy) ConstraintsFor(certType string) (Constraints, bool) {
+	if p == nil {
+		return Constraints{}, false
+	}
+	if c, ok := p.Types[certType]; ok {
+		return c, true
+	}
+	c, ok := p.Types[Any]
+	return c, ok
+}
+
+// Enforce applies the policy of a certificate type to a certificate template before it's signed by
+// the CA, the expiry may be capped to the CA's. A nil policy allows every certificate
+func (p *Policy) Enforce(certType string, cert *x509.Certificate, pub crypto.PublicKey, caCert *x509.Certificate) error {
+	c, ok := p.ConstraintsFor(certType)
+	if !ok {
+		return nil
+	}
+
+	if c.CapToCAExpiry && caCert != nil && cert.NotAfter.After(caCert.NotAfter) {
+		cert.NotAfter = caCert.NotAfter
+	}
+
+	violations := c.Check(cert, pub, caCert)
+	if len(violations) > 0 {
+		return &ViolationError{Type: certType, Violations: violations}
+	}
+	return nil
+}
+
+// Check returns every rule broken by a certificate
+func (c Constraints) Check(cert *x509.Certificate, pub crypto.PublicKey, caCert *x509.Certificate) []string {
+	violations := []string{}
+
+	notBefore := cert.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now()
+	}
+	if c.MaxValidityDays > 0 && cert.NotAfter.Sub(notBefore) > time.Duration(c.MaxValidityDays)*24*time.Hour {
+		violations = append(violations, fmt.Sprintf("the certificate is valid for %d days, the maximum is %d", int(cert.NotAfter.Sub(notBefore).Hours()/24), c.MaxValidityDays))
+	}
+
+	if caCert != nil && cert.NotAfter.After(caCert.NotAfter) {
+		violations = append(violations, fmt.Sprintf("the certificate expires on %s, after the CA (%s)", cert.NotAfter.Format(time.DateOnly), caCert.NotAfter.Format(time.DateOnly)))
+	}
+
+	if pub != nil {
+		violations = append(violations, c.checkKey(pub)...)
+	}
+
+	for _, name := range cert.DNSNames {
+		if v := c.checkDNSName(name); v != "" {
+			violations = append(violations, v)
+		}
+	}
+
+	// Clients that still match the common name as a hostname would accept it as one more DNS name
+	if cn := cert.Subject.CommonName; isHostname(cn) && !slices.ContainsFunc(cert.DNSNames, func(name string) bool { return strings.EqualFold(name, cn) }) {
+		if v := c.checkDNSName(cn); v != "" {
+			violations = append(violations, v)
+		}
+	}
+
+	for _, field := range c.RequiredSubject {
+		if !hasSubjectField(cert, field) {
+			violations = append(violations, fmt.Sprintf("the subject field %s is required", field))
+		}
+	}
+
+	if len(c.ExtKeyUsages) > 0 {
+		for _, eku := range cert.ExtKeyUsage {
+			if !c.allowsExtKeyUsage(eku) {
+				violations = append(violations, fmt.Sprintf("the extended key usage %s is not allowed", extKeyUsageName(eku)))
+			}
+		}
+	}
+	return violations
+}
+
+func (c Constraints) checkKey(pub crypto.PublicKey) []string {
+	alg, bits := "", 0
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		alg, bits = KeyRSA, k.N.BitLen()
+	case *ecdsa.PublicKey:
+		alg = KeyECDSA
+	case ed25519.PublicKey:
+		alg = KeyEd25519
+	default:
+		return []string{fmt.Sprintf("the key algorithm %T is not supported", pub)}
+	}
+
+	violations := []string{}
+	if len(c.KeyAlgorithms) > 0 && !slices.Contains(c.KeyAlgorithms, alg) {
+		violations = append(violations, fmt.Sprintf("the key algorithm %s is not one of %s", alg, strings.Join(c.KeyAlgorithms, ", ")))
+	}
+	if alg == KeyRSA && bits < c.MinRSABits {
+		violations = append(violations, fmt.Sprintf("the RSA key has %d bits, the minimum is %d", bits, c.MinRSABits))
+	}
+	return violations
+}
+
+func (c Constraints) checkDNSName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, suffix := range c.DNSDeny {
+		if matchesSuffix(name, suffix) {
+			return fmt.Sprintf("the DNS name %s is denied by %s", name, suffix)
+		}
+	}
+	if len(c.DNSAllow) == 0 {
+		return ""
+	}
+	for _, suffix := range c.DNSAllow {
+		if matchesSuffix(name, suffix) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("the DNS name %s is not in the allowed domains", name)
+}
+
+// isHostname reports whether a common name is a DNS name with at least two labels, e.g proxy.example.com
+// or *.example.com, single labels are usually names of users or services rather than hosts
+func isHostname(name string) bool {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "*."), ".")
+	if !strings.Contains(name, ".") || net.ParseIP(name) != nil {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchesSuffix reports whether name is the domain or one of its subdomains, a wildcard name
+// matches the domains that would match its base domain
+func matchesSuffix(name string, suffix string) bool {
+	suffix = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(suffix, "*"), "."))
+	name = strings.TrimPrefix(name, "*.")
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
+
+func (c Constraints) allowsExtKeyUsage(eku x509.ExtKeyUsage) bool {
+	for _, name := range c.ExtKeyUsages {
+		if ExtKeyUsages[name] == eku {
+			return true
+		}
+	}
+	return false
+}
+
+func extKeyUsageName(eku x509.ExtKeyUsage) string {
+	for name, value := range ExtKeyUsages {
+		if value == eku {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", eku)
+}
+
+func hasSubjectField(cert *x509.Certificate, field string) bool {
+	s := cert.Subject
+	switch field {
+	case "CN":
+		return s.CommonName != ""
+	case "O":
+		return nonEmpty(s.Organization)
+	case "OU":
+		return nonEmpty(s.OrganizationalUnit)
+	case "C":
+		return nonEmpty(s.Country)
+	case "ST":
+		return nonEmpty(s.Province)
+	case "L":
+		return nonEmpty(s.Locality)
+	case "STREET":
+		return nonEmpty(s.StreetAddress)
+	case "POSTALCODE":
+		return nonEmpty(s.PostalCode)
+	}
+	return false
+}
+
+func nonEmpty(values []string) bool {
+	return slices.ContainsFunc(values, func(v string) bool { return v != "" })
+}
@@ -0,0 +1,41 @@
+package certpolicy
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+)
+
+func TestCheckCommonNameHostname(t *testing.T) {
+	c := Constraints{DNSAllow: []string{"example.com"}, DNSDeny: []string{"internal.example.com"}}
+
+	tests := []struct {
+		cn       string
+		dnsNames []string
+		denied   bool
+	}{
+		{cn: "proxy.example.com"},
+		{cn: "db.internal.example.com", denied: true},
+		{cn: "*.internal.example.com", denied: true},
+		{cn: "proxy.example.org", denied: true},
+		{cn: "DB.Internal.Example.com.", denied: true},
+		// The name is reported once when it's a SAN too
+		{cn: "db.internal.example.com", dnsNames: []string{"db.internal.example.com"}, denied: true},
+		// Common names that aren't hostnames are not DNS names
+		{cn: "console"},
+		{cn: "Alice Smith"},
+		{cn: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: tt.cn}, DNSNames: tt.dnsNames}
+		violations := c.Check(cert, nil, nil)
+		if tt.denied != (len(violations) > 0) {
+			t.Errorf("common name %q: unexpected violations %v", tt.cn, violations)
+		}
+		if len(violations) > 1 {
+			t.Errorf("common name %q: the name was reported more than once: %s", tt.cn, strings.Join(violations, "; "))
+		}
+	}
+}
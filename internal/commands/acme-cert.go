@@ -0,0 +1,434 @@
+package commands
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/acme"
+)
+
+func CreateACMECertificate() *cli.Command {
+	return &cli.Command{
+		Name:   "acme-cert",
+		Usage:  "Get a server certificate, e.g the reverse proxy certificate, from a public ACME CA such as Let's Encrypt",
+		Action: generateACMECert,
+		Flags:  generateACMECertFlags(),
+	}
+}
+
+func generateACMECert(cCtx *cli.Context) error {
+	challengeType := cCtx.String("challenge")
+	if challengeType != "http-01" && challengeType != "dns-01" {
+		return fmt.Errorf("challenge must be one of 'http-01' or 'dns-01'")
+	}
+	if challengeType == "dns-01" && cCtx.String("hook") == "" {
+		return fmt.Errorf("a hook script is required to publish dns-01 challenges")
+	}
+
+	certType := certificate.Type(cCtx.String("type"))
+	if err := certificate.TypeValidator(certType); err != nil {
+		return err
+	}
+
+	log.Printf("... validating your DNS names")
+	dnsNames, err := validateDNSNames(cCtx.String("dns-names"))
+	if err != nil {
+		return err
+	}
+	if len(dnsNames) == 0 {
+		return fmt.Errorf("at least one DNS name is required")
+	}
+
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	path := cCtx.String("dst")
+	if path == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(cwd, "certificates")
+	}
+
+	out, err := newCertificateOutput(cCtx, OutputFormatPEM)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading your ACME account key")
+	accountKey, err := readOrCreateAccountKey(cCtx.String("account-key"))
+	if err != nil {
+		return err
+	}
+
+	httpClient, err := acmeHTTPClient(cCtx.String("directory-ca"))
+	if err != nil {
+		return err
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: cCtx.String("acme-directory"),
+		HTTPClient:   httpClient,
+		UserAgent:    "openuem-cert-manager/" + VERSION,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cCtx.Duration("timeout"))
+	defer cancel()
+
+	log.Printf("... registering your ACME account")
+	account := &acme.Account{}
+	if email := cCtx.String("email"); email != "" {
+		account.Contact = []string{"mailto:" + email}
+	}
+	if _, err := client.Register(ctx, account, func(tosURL string) bool {
+		if !cCtx.Bool("agree-tos") {
+			log.Printf("[WARN]: the ACME CA asks you to agree to its terms of service %s, use --agree-tos", tosURL)
+			return false
+		}
+		return true
+	}); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("could not register ACME account, reason: %v", err)
+	}
+
+	log.Printf("... creating your certificate order")
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(dnsNames...))
+	if err != nil {
+		return fmt.Errorf("could not create ACME order, reason: %v", err)
+	}
+
+	solver := &acmeSolver{client: client, hook: cCtx.String("hook")}
+	if challengeType == "http-01" && solver.hook == "" {
+		if err := solver.startHTTPServer(cCtx.String("http-listen")); err != nil {
+			return err
+		}
+		defer solver.stopHTTPServer()
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := solver.solve(ctx, authzURL, challengeType); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("... waiting for your order to be ready")
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("the ACME order is not ready, reason: %v", err)
+	}
+
+	log.Printf("... generating your private key")
+	certPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: dnsNames[0]},
+		DNSNames: dnsNames,
+	}, certPrivKey)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... finalizing your order")
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("could not get the certificate, reason: %v", err)
+	}
+
+	certs := []*x509.Certificate{}
+	for _, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	cert := certs[0]
+
+	log.Printf("... saving your certificate and its private key in %s format", out.format)
+	keyFilename, err := out.Write(path, cCtx.String("filename"), cert, certs[1:], certPrivKey)
+	if err != nil {
+		return err
+	}
+
+	// Public CAs use serial numbers longer than the 63 bits of our certificates, they're stored on their own
+	serial := hex.EncodeToString(cert.SerialNumber.Bytes())
+
+	log.Printf("... saving certificate info to database")
+	err = model.SaveExternalCertificate(&models.ExternalCertificate{
+		Issuer:      cert.Issuer.String(),
+		Serial:      serial,
+		Type:        string(certType),
+		Description: cCtx.String("description"),
+		Expiry:      cert.NotAfter,
+	})
+	params := cliParameters(cCtx)
+	params["issuer"] = cert.Issuer.String()
+	params["external_serial"] = serial
+	recordAudit(model, cliActor(), cCtx.Command.FullName(), params, 0, err)
+	if err != nil {
+		return err
+	}
+	recordAudit(model, cliActor(), "key-export", map[string]any{"destination": keyFilename, "external_serial": serial}, 0, nil)
+
+	log.Printf("✅ Done! Your certificate issued by %s and its private key have been stored\n\n", cert.Issuer.CommonName)
+	return nil
+}
+
+// acmeSolver completes the ACME challenges, either serving the http-01 tokens itself or
+// calling a hook script that publishes them
+type acmeSolver struct {
+	client *acme.Client
+	hook   string
+	srv    *http.Server
+	tokens sync.Map
+}
+
+func (s *acmeSolver) solve(ctx context.Context, authzURL string, challengeType string) error {
+	authz, err := s.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeType {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("the ACME CA doesn't offer a %s challenge for %s", challengeType, authz.Identifier.Value)
+	}
+
+	var value string
+	switch challengeType {
+	case "http-01":
+		value, err = s.client.HTTP01ChallengeResponse(chal.Token)
+	case "dns-01":
+		value, err = s.client.DNS01ChallengeRecord(chal.Token)
+	}
+	if err != nil {
+		return err
+	}
+
+	domainName := authz.Identifier.Value
+	log.Printf("... publishing %s challenge for %s", challengeType, domainName)
+	if s.hook != "" {
+		if err := s.runHook(ctx, "present", challengeType, domainName, chal.Token, value); err != nil {
+			return err
+		}
+		defer func() {
+			if err := s.runHook(context.Background(), "cleanup", challengeType, domainName, chal.Token, value); err != nil {
+				log.Printf("[WARN]: the hook could not clean up the challenge for %s, reason: %v", domainName, err)
+			}
+		}()
+	} else {
+		s.tokens.Store(chal.Token, value)
+		defer s.tokens.Delete(chal.Token)
+	}
+
+	if _, err := s.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("could not accept the %s challenge, reason: %v", challengeType, err)
+	}
+
+	if _, err := s.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("could not validate %s, reason: %v", domainName, err)
+	}
+	log.Printf("... %s has been validated", domainName)
+	return nil
+}
+
+// runHook calls the hook script as: hook <present|cleanup> <challenge> <domain> <token> <value>
+func (s *acmeSolver) runHook(ctx context.Context, action string, challengeType string, domainName string, token string, value string) error {
+	cmd := exec.CommandContext(ctx, s.hook, action, challengeType, domainName, token, value)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (s *acmeSolver) startHTTPServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/acme-challenge/{token}", func(w http.ResponseWriter, r *http.Request) {
+		value, ok := s.tokens.Load(r.PathValue("token"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := w.Write([]byte(value.(string))); err != nil {
+			log.Printf("[ERROR]: could not write challenge response, reason: %v", err)
+		}
+	})
+
+	s.srv = &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	errCh := make(chan error, 1)
+	go func() {
+		if err := s.srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("could not start the http-01 challenge server, reason: %v", err)
+	case <-time.After(500 * time.Millisecond):
+		log.Printf("... serving http-01 challenges on %s", addr)
+		return nil
+	}
+}
+
+func (s *acmeSolver) stopHTTPServer() {
+	if err := s.srv.Close(); err != nil {
+		log.Printf("[ERROR]: could not stop the http-01 challenge server, reason: %v", err)
+	}
+}
+
+func readOrCreateAccountKey(path string) (*rsa.PrivateKey, error) {
+	if _, err := os.Stat(path); err == nil {
+		return utils.ReadPEMPrivateKey(path)
+	}
+
+	log.Printf("... generating a new ACME account key in %s", path)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.SavePrivateKey(key, path); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// acmeHTTPClient trusts an additional CA for the ACME directory, e.g Pebble's test CA
+func acmeHTTPClient(caPath string) (*http.Client, error) {
+	if caPath == "" {
+		return http.DefaultClient, nil
+	}
+
+	caBytes, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("could not read any certificate from %s", caPath)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		Timeout:   30 * time.Second,
+	}, nil
+}
+
+func generateACMECertFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "acme-directory",
+			Usage:    "the ACME directory URL of the CA, e.g https://acme-v02.api.letsencrypt.org/directory",
+			EnvVars:  []string{"ACME_DIRECTORY"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "directory-ca",
+			Usage: "an optional CA certificate in PEM format trusted to connect to the ACME directory, e.g Pebble's CA",
+		},
+		&cli.StringFlag{
+			Name:    "email",
+			Usage:   "the contact email for the ACME account",
+			EnvVars: []string{"ACME_EMAIL"},
+		},
+		&cli.BoolFlag{
+			Name:  "agree-tos",
+			Usage: "agree to the terms of service of the ACME CA",
+		},
+		&cli.StringFlag{
+			Name:  "account-key",
+			Value: "certificates/acme-account.key",
+			Usage: "the path to the ACME account private key, it's generated if it doesn't exist",
+		},
+		&cli.StringFlag{
+			Name:  "challenge",
+			Value: "http-01",
+			Usage: "the challenge used to prove you control the DNS names, one of 'http-01' or 'dns-01'",
+		},
+		&cli.StringFlag{
+			Name:  "hook",
+			Usage: "a script called as 'hook <present|cleanup> <challenge> <domain> <token> <value>' to publish the challenges, required for dns-01",
+		},
+		&cli.StringFlag{
+			Name:  "http-listen",
+			Value: ":80",
+			Usage: "the address where http-01 challenges are served if no hook is set",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Value: 5 * time.Minute,
+			Usage: "how long to wait for the ACME CA to issue the certificate",
+		},
+		&cli.StringFlag{
+			Name:     "dns-names",
+			Usage:    "comma-separated string containing the DNS names associated with this server e.g example.com,test.example.com (Subject Alternative Name)",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "filename",
+			Value: "proxy",
+			Usage: "the name to be used for the certificate and private key files",
+		},
+		&cli.StringFlag{
+			Name:  "dst",
+			Usage: "the folder where the certificates will be stored",
+		},
+		&cli.StringFlag{
+			Name:  "pass",
+			Usage: "the password of the PFX file if the format is pfx (default: a random password)",
+		},
+		&cli.StringFlag{
+			Name:  "type",
+			Value: "proxy",
+			Usage: "OpenUEM type assigned to this certificate (one of 'console', 'proxy', 'ocsp' or 'nats')",
+		},
+		&cli.StringFlag{
+			Name:  "description",
+			Value: "",
+			Usage: "an optional description for this certificate",
+		},
+		dbURLFlag(),
+	}, outputFlags(OutputFormatPEM, true)...)
+}
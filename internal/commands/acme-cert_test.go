@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// TestACMECertPebble gets a certificate from Pebble, run it with scripts/pebble-test.sh
+func TestACMECertPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY is not set, run scripts/pebble-test.sh")
+	}
+
+	dir := t.TempDir()
+	dbURL := "sqlite://" + filepath.Join(dir, "pki.db")
+	app := &cli.App{Commands: []*cli.Command{CreateACMECertificate()}}
+	err := app.Run([]string{"openuem-cert-manager", "acme-cert",
+		"--acme-directory", directory,
+		"--directory-ca", os.Getenv("PEBBLE_CA"),
+		"--agree-tos",
+		"--email", "admin@example.com",
+		"--account-key", filepath.Join(dir, "acme-account.key"),
+		"--dns-names", "proxy.example.com",
+		"--http-listen", "127.0.0.1:5002",
+		"--dst", dir,
+		"--dburl", dbURL,
+	})
+	if err != nil {
+		t.Fatalf("acme-cert failed: %v", err)
+	}
+
+	cert, err := utils.ReadPEMCertificate(filepath.Join(dir, "proxy.cer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model, err := models.New(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer model.Close()
+
+	external, err := model.GetExternalCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(external) != 1 || external[0].Serial != hex.EncodeToString(cert.SerialNumber.Bytes()) || external[0].Issuer != cert.Issuer.String() {
+		t.Fatalf("the certificate was not saved as an external certificate: %+v", external)
+	}
+
+	// Public CA certificates must not be mixed with the certificates of the OpenUEM CA
+	n, err := model.Client.Certificate.Query().Count(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("the certificate of %s was saved in the certificates table", cert.Issuer)
+	}
+}
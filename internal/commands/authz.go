@@ -0,0 +1,144 @@
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/authz"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/urfave/cli/v2"
+)
+
+func Authz() *cli.Command {
+	return &cli.Command{
+		Name:  "authz",
+		Usage: "Manage the authorization policy that controls who may issue, renew, revoke or read each certificate type",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "check",
+				Usage:  "Evaluate a policy file for an identity, an action and a certificate type",
+				Action: checkAuthzPolicy,
+				Flags:  checkAuthzPolicyFlags(),
+			},
+			{
+				Name:   "token",
+				Usage:  "Generate an API token and the entry to be added to the tokens of a policy file",
+				Action: createAuthzToken,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Usage:    "the name of the token, rules refer to it as token:<name>",
+						Required: true,
+					},
+				},
+			},
+			{
+				Name:   "denials",
+				Usage:  "List the operations denied by the authorization policy",
+				Action: listAuthzDenials,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "since",
+						Value: 7 * 24 * time.Hour,
+						Usage: "show the denials that happened in this period, e.g 24h",
+					},
+					dbURLFlag(),
+				},
+			},
+		},
+	}
+}
+
+func checkAuthzPolicy(cCtx *cli.Context) error {
+	policy, err := authz.Load(cCtx.String("policy"))
+	if err != nil {
+		return err
+	}
+
+	identity, action, certType := cCtx.String("identity"), cCtx.String("action"), cCtx.String("type")
+	if !policy.Allowed(identity, action, certType) {
+		return fmt.Errorf("%s is not allowed to %s %s certificates", identity, action, certType)
+	}
+
+	log.Printf("✅ Done! %s is allowed to %s %s certificates\n\n", identity, action, certType)
+	return nil
+}
+
+func createAuthzToken(cCtx *cli.Context) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	entry, err := json.Marshal(authz.Token{Name: cCtx.String("name"), Hash: authz.HashToken(token)})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("✅ Done! Add this entry to the tokens of your policy file, the token won't be shown again\n\n")
+	fmt.Println(string(entry))
+	fmt.Println(token)
+	return nil
+}
+
+func listAuthzDenials(cCtx *cli.Context) error {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	denials, err := model.GetAuthzDenials(time.Now().Add(-cCtx.Duration("since")))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tIDENTITY\tACTION\tTYPE\tRESOURCE")
+	for _, d := range denials {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Created.Format(time.RFC3339), d.Identity, d.Action, d.CertType, d.Resource)
+	}
+	return w.Flush()
+}
+
+// policyFlag is shared by the servers that issue certificates
+func policyFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "policy",
+		Usage:   "the path to an authorization policy file in JSON format, if not set every authenticated client is allowed",
+		EnvVars: []string{"AUTHZ_POLICY"},
+	}
+}
+
+func checkAuthzPolicyFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "policy",
+			Usage:    "the path to the authorization policy file in JSON format",
+			EnvVars:  []string{"AUTHZ_POLICY"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "identity",
+			Usage:    "the identity to check e.g cert:CN=console or token:ci",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "action",
+			Usage:    "one of 'issue', 'renew', 'revoke' or 'read'",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "type",
+			Usage:    "the certificate type e.g user, proxy or code-signing",
+			Required: true,
+		},
+	}
+}
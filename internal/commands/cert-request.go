@@ -0,0 +1,449 @@
+package commands
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ent "github.com/open-uem/ent"
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// DefaultApprovalTypes are the certificate types that must be approved before they're issued if no
+// other types have been saved with pki-config
+var DefaultApprovalTypes = []string{"console", "worker", "nats", KindCodeSigning}
+
+// noApprovalTypes is saved with pki-config when no certificate type needs approval
+const noApprovalTypes = "none"
+
+func CertRequest() *cli.Command {
+	return &cli.Command{
+		Name:  "cert-request",
+		Usage: "Manage certificate requests that must be approved before the certificate is issued",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "request",
+				Usage:       "Request a certificate, it will be issued once it's approved",
+				Subcommands: requestCertSubcommands(),
+			},
+			{
+				Name:   "approve",
+				Usage:  "Approve a pending request, the request is approved once it has the number of approvers required",
+				Action: approveCertRequest,
+				Flags:  certRequestApproverFlags(),
+			},
+			{
+				Name:   "reject",
+				Usage:  "Reject a pending request",
+				Action: rejectCertRequest,
+				Flags: append(certRequestApproverFlags(), &cli.StringFlag{
+					Name:  "reason",
+					Usage: "why the request has been rejected",
+				}),
+			},
+			{
+				Name:   "list-pending",
+				Usage:  "List the requests waiting for approval",
+				Action: listPendingCertRequests,
+				Flags:  []cli.Flag{dbURLFlag()},
+			},
+			{
+				Name:   "issue",
+				Usage:  "Issue the certificate of an approved request and save it as the command of its kind does",
+				Action: issueCertRequest,
+				Flags:  issueCertRequestFlags(),
+			},
+		},
+	}
+}
+
+// requestCertSubcommands has a subcommand for each kind of certificate with the same flags as the
+// command that issues it, except those only needed to sign it
+func requestCertSubcommands() []*cli.Command {
+	commands := []*cli.Command{}
+	for _, kind := range []string{KindServer, KindClient, KindUser, KindCodeSigning} {
+		kindFlags, _ := IssueFlags(kind)
+		flags := []cli.Flag{}
+		for _, flag := range kindFlags {
+			if !slices.Contains(localFlags, flag.Names()[0]) {
+				flags = append(flags, flag)
+			}
+		}
+		flags = append(flags,
+			&cli.IntFlag{
+				Name:  "approvals",
+				Value: 1,
+				Usage: "the number of distinct approvers required",
+			},
+			dbURLFlag(),
+		)
+
+		commands = append(commands, &cli.Command{
+			Name:   kind + "-cert",
+			Usage:  fmt.Sprintf("Request a %s certificate", kind),
+			Action: func(cCtx *cli.Context) error { return requestCert(cCtx, kind, kindFlags) },
+			Flags:  flags,
+		})
+	}
+	return commands
+}
+
+func requestCert(cCtx *cli.Context, kind string, flags []cli.Flag) (err error) {
+	if cCtx.Int("approvals") < 1 {
+		return fmt.Errorf("at least one approval is required")
+	}
+
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	params := cliParameters(cCtx)
+	defer func() { recordAudit(model, cliActor(), cCtx.Command.FullName(), params, 0, err) }()
+
+	values := settingsFromContext(cCtx, flags)
+	v := &flagValues{values: values, flags: flags}
+	if err := ValidateSettings(kind, v); err != nil {
+		return err
+	}
+
+	r := &models.CertRequest{
+		Kind:              kind,
+		CertType:          PolicyType(kind, v),
+		Values:            values,
+		Requester:         cliActor(),
+		RequiredApprovals: cCtx.Int("approvals"),
+	}
+
+	log.Printf("... saving certificate request")
+	if err := model.CreateCertRequest(r); err != nil {
+		return fmt.Errorf("could not save the certificate request, reason: %s", err.Error())
+	}
+	params["request_id"] = r.ID
+
+	log.Printf("✅ Done! Your certificate request %s is waiting for approval\n\n", r.ID)
+	return nil
+}
+
+func approveCertRequest(cCtx *cli.Context) (err error) {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+	defer func() { recordCLIAudit(cCtx, model, 0, err) }()
+
+	// The approver is the account running the command so one person can't approve a request
+	// several times with different names
+	r, err := approveRequest(model, cCtx.String("id"), cliActor())
+	if err != nil {
+		return err
+	}
+
+	if r.Status == models.CertRequestApproved {
+		log.Printf("✅ Done! The certificate request %s has been approved and can be issued\n\n", r.ID)
+	} else {
+		log.Printf("✅ Done! The certificate request %s has %d of %d approvals\n\n", r.ID, len(r.Approvers), r.RequiredApprovals)
+	}
+	return nil
+}
+
+// approveRequest adds an approval to a request, the requester can't approve its own request
+func approveRequest(model *models.Model, id string, approver string) (*models.CertRequest, error) {
+	r, err := model.GetCertRequest(id)
+	if err != nil {
+		return nil, err
+	}
+	if r.Requester == approver {
+		return nil, fmt.Errorf("the requester can't approve its own request")
+	}
+
+	r, err = model.ApproveCertRequest(id, approver)
+	if err != nil {
+		return nil, fmt.Errorf("could not approve the certificate request, reason: %s", err.Error())
+	}
+	return r, nil
+}
+
+func rejectCertRequest(cCtx *cli.Context) (err error) {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+	defer func() { recordCLIAudit(cCtx, model, 0, err) }()
+
+	if err := model.RejectCertRequest(cCtx.String("id"), cliActor(), cCtx.String("reason")); err != nil {
+		return fmt.Errorf("could not reject the certificate request, reason: %s", err.Error())
+	}
+
+	log.Printf("✅ Done! The certificate request %s has been rejected\n\n", cCtx.String("id"))
+	return nil
+}
+
+func listPendingCertRequests(cCtx *cli.Context) error {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	requests, err := model.GetCertRequests(models.CertRequestPending)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tTYPE\tNAME\tREQUESTER\tAPPROVALS\tCREATED")
+	for _, r := range requests {
+		v := &flagValues{values: r.Values}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d/%d (%s)\t%s\n", r.ID, r.Kind, r.CertType, CommonName(r.Kind, v), r.Requester,
+			len(r.Approvers), r.RequiredApprovals, strings.Join(r.Approvers, ", "), r.Created.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func issueCertRequest(cCtx *cli.Context) (err error) {
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	serial := int64(0)
+	defer func() { recordCLIAudit(cCtx, model, serial, err) }()
+
+	log.Printf("... reading your CA cert PEM file")
+	caCerts, err := readCertificateFile(cCtx.String("cacert"))
+	if err != nil {
+		return err
+	}
+	caCert := caCerts[0]
+
+	log.Printf("... reading your CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
+	if err != nil {
+		return err
+	}
+
+	policy, err := certpolicy.LoadOptional(cCtx.String("cert-policy"))
+	if err != nil {
+		return err
+	}
+
+	if err := loadPKIConfig(cCtx, model); err != nil {
+		return err
+	}
+
+	// The format is checked before the request is issued, a request can only be issued once
+	r, err := model.GetCertRequest(cCtx.String("id"))
+	if err != nil {
+		return err
+	}
+	out, err := newCertificateOutput(cCtx, DefaultOutputFormat(r.Kind))
+	if err != nil {
+		return err
+	}
+
+	path := cCtx.String("dst")
+	if path == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(cwd, "certificates")
+	}
+
+	// The files are written before the request is issued, so it can be issued again if they can't be saved
+	keyFilename := ""
+	write := func(r *models.CertRequest, issued *IssuedCertificate) error {
+		log.Printf("... saving the certificate and its private key in %s format", out.format)
+		var err error
+		keyFilename, err = WriteIssuedCertificate(r.Kind, &flagValues{values: r.Values}, issued, caCerts, out, path)
+		return err
+	}
+
+	log.Printf("... generating the certificate and its private key")
+	r, issued, err := issueApprovedRequest(model, cCtx.String("id"), cliActor(), caCert, caPrivKey, policy, cCtx, write)
+	if err != nil {
+		return err
+	}
+	serial = issued.Cert.SerialNumber.Int64()
+	recordKeyExport(model, cliActor(), serial, keyFilename)
+
+	log.Printf("✅ Done! The certificate of request %s has been issued and stored in the certificates folder\n\n", r.ID)
+	return nil
+}
+
+// issueApprovedRequest signs the certificate of an approved request with the template of its kind,
+// a request can only be issued once. write, if not nil, saves the certificate and its private key
+// before the request is issued, if it fails the request stays approved. If the request renews a
+// certificate, that one is revoked as superseded on behalf of actor
+func issueApprovedRequest(model *models.Model, id string, actor string, caCert *x509.Certificate, caPrivKey *rsa.PrivateKey, policy *certpolicy.Policy, config Values, write func(*models.CertRequest, *IssuedCertificate) error) (*models.CertRequest, *IssuedCertificate, error) {
+	r, err := model.GetCertRequest(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.Status != models.CertRequestApproved {
+		return nil, nil, fmt.Errorf("the certificate request is %s", r.Status)
+	}
+
+	flags, err := IssueFlags(r.Kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	v := &flagValues{values: r.Values, flags: flags}
+
+	var renewed *ent.Certificate
+	if r.Renews != 0 {
+		if renewed, err = model.GetCertificate(r.Renews); err != nil {
+			return nil, nil, fmt.Errorf("could not find the certificate renewed by the request, reason: %s", err.Error())
+		}
+		if revoked, err := model.IsRevoked(r.Renews); err != nil {
+			return nil, nil, err
+		} else if revoked {
+			return nil, nil, fmt.Errorf("the certificate renewed by the request has been revoked")
+		}
+	}
+
+	if err := model.ClaimCertRequest(r.ID); err != nil {
+		if errors.Is(err, models.ErrCertRequestState) {
+			return nil, nil, fmt.Errorf("the certificate request has already been issued")
+		}
+		return nil, nil, err
+	}
+
+	issued, err := IssueCertificate(r.Kind, withPKIConfig(v, config), caCert, caPrivKey, policy)
+	if err == nil && write != nil {
+		err = write(r, issued)
+	}
+	if err == nil {
+		if renewed != nil {
+			err = SaveRenewedCertificate(model, v, issued.Cert, renewed)
+		} else {
+			err = SaveIssuedCertificate(model, r.Kind, v, issued.Cert)
+		}
+	}
+	if err != nil {
+		if err := model.ReleaseCertRequest(r.ID); err != nil {
+			log.Printf("[ERROR]: could not release certificate request %s, reason: %v", r.ID, err)
+		}
+		return nil, nil, err
+	}
+
+	serial := issued.Cert.SerialNumber.Int64()
+	if err := model.SetCertRequestSerial(r.ID, serial); err != nil {
+		log.Printf("[ERROR]: could not save the serial of certificate request %s, reason: %v", r.ID, err)
+	}
+
+	if renewed != nil {
+		// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-5.3.1 4 - Superseded
+		info := "renewed by " + strconv.FormatInt(serial, 16)
+		err := model.AddRevocation(renewed.ID, 4, info)
+		recordAudit(model, actor, "cert-request revoke", map[string]any{"reason": 4, "info": info, "request_id": r.ID}, renewed.ID, err)
+		if err != nil {
+			log.Printf("[ERROR]: could not revoke renewed certificate %x, reason: %v", renewed.ID, err)
+		}
+	}
+	return r, issued, nil
+}
+
+// ApprovalTypes returns the certificate types that must be approved before they're issued, model
+// may be nil for commands where the database is optional
+func ApprovalTypes(model *models.Model) ([]string, error) {
+	value := ""
+	if model != nil {
+		var err error
+		if value, err = model.GetConfig(models.ConfigApprovalTypes); err != nil {
+			return nil, fmt.Errorf("could not read the approval types from database, reason: %s", err.Error())
+		}
+	}
+	return parseApprovalTypes(value), nil
+}
+
+func parseApprovalTypes(value string) []string {
+	if value == "" {
+		return DefaultApprovalTypes
+	}
+
+	types := []string{}
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.TrimSpace(t); t != "" && t != noApprovalTypes {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// checkApproval refuses to issue at once the certificates of the types that must be approved, they
+// are requested and issued with the cert-request command instead
+func checkApproval(model *models.Model, kind string, v Values) error {
+	types, err := ApprovalTypes(model)
+	if err != nil {
+		return err
+	}
+	if certType := PolicyType(kind, v); slices.Contains(types, certType) {
+		return fmt.Errorf("%s certificates must be approved before they're issued, request it with cert-request request %s-cert", certType, kind)
+	}
+	return nil
+}
+
+func certRequestApproverFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "id",
+			Usage:    "the request id as shown by the list-pending command",
+			Required: true,
+		},
+		dbURLFlag(),
+	}
+}
+
+func issueCertRequestFlags() []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:     "id",
+			Usage:    "the id of the approved request",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cacert",
+			Usage:    "the path to your CA certificate file in PEM format",
+			EnvVars:  []string{"CA_CRT_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cakey",
+			Usage:    "the path to your CA private key file in PEM format",
+			EnvVars:  []string{"CA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "dst",
+			Usage: "the folder where the certificates will be stored",
+		},
+		&cli.StringFlag{
+			Name:  "pass",
+			Usage: "the password used to protect the PFX file (default: a random password)",
+		},
+		certPolicyFlag(),
+		dbURLFlag(),
+	}
+	flags = append(flags, outputFlags("", false)...)
+	return append(flags, pkiConfigFlags()...)
+}
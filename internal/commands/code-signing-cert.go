@@ -1,19 +1,16 @@
 package commands
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
 	"github.com/open-uem/utils"
 	"github.com/urfave/cli/v2"
-	"software.sslmate.com/src/go-pkcs12"
 )
 
 func CreateCodeSigningCertificate() *cli.Command {
@@ -25,53 +22,55 @@ func CreateCodeSigningCertificate() *cli.Command {
 	}
 }
 
-func generateCodeSigningCert(cCtx *cli.Context) error {
-	log.Printf("... reading CA cert PEM file")
-	caCert, err := utils.ReadPEMCertificate(cCtx.String("cacert"))
+func generateCodeSigningCert(cCtx *cli.Context) (err error) {
+	model, err := openAuditModel(cCtx)
 	if err != nil {
 		return err
 	}
+	if model != nil {
+		defer model.Close()
+	}
 
-	log.Printf("... reading CA private key PEM file")
-	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
-	if err != nil {
+	serial := int64(0)
+	defer func() { recordCLIAudit(cCtx, model, serial, err) }()
+
+	if err := checkApproval(model, KindCodeSigning, cCtx); err != nil {
 		return err
 	}
 
-	log.Printf("... generating private key")
-	certPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	log.Printf("... reading CA cert PEM file")
+	caCerts, err := readCertificateFile(cCtx.String("cacert"))
 	if err != nil {
 		return err
 	}
+	caCert := caCerts[0]
 
-	log.Printf("... generating certificate's template")
-	cert, err := NewX509CodeSigningCertificate(cCtx, caCert)
+	out, err := newCertificateOutput(cCtx, OutputFormatPFX)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("... creating certificate")
-	certBytes, err := x509.CreateCertificate(rand.Reader, cert, caCert, &certPrivKey.PublicKey, caPrivKey)
+	log.Printf("... reading CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
 	if err != nil {
 		return err
 	}
 
-	log.Printf("... parsing certificate")
-	cert, err = x509.ParseCertificate(certBytes)
+	policy, err := certpolicy.LoadOptional(cCtx.String("cert-policy"))
 	if err != nil {
 		return err
 	}
 
-	log.Printf("... creating your PKCS12 file")
-
-	pass := cCtx.String("pass")
-	if pass == "" {
-		pass = pkcs12.DefaultPassword
+	if err := loadPKIConfig(cCtx, model); err != nil {
+		return err
 	}
-	pfxBytes, err := pkcs12.Modern.Encode(certPrivKey, cert, []*x509.Certificate{caCert}, pass)
+
+	log.Printf("... generating certificate and private key")
+	issued, err := IssueCertificate(KindCodeSigning, cCtx, caCert, caPrivKey, policy)
 	if err != nil {
 		return err
 	}
+	serial = issued.Cert.SerialNumber.Int64()
 
 	path := cCtx.String("dst")
 	if path == "" {
@@ -82,49 +81,49 @@ func generateCodeSigningCert(cCtx *cli.Context) error {
 		path = filepath.Join(cwd, "certificates")
 	}
 
-	err = utils.SavePFX(pfxBytes, filepath.Join(path, cCtx.String("filename")+".pfx"))
+	log.Printf("... saving your code signing certificate and its private key in %s format", out.format)
+	keyFilename, err := out.Write(path, cCtx.String("filename"), issued.Cert, caCerts, issued.PrivKey)
 	if err != nil {
 		return err
 	}
+	recordKeyExport(model, cliActor(), serial, keyFilename)
 
-	log.Println("✅ Done! Your code signing certificate as a PFX file has been generated")
+	log.Printf("✅ Done! Your code signing certificate and its private key have been stored in %s format inside the certificates folder\n\n", out.format)
 	return nil
 }
 
-func NewX509CodeSigningCertificate(cCtx *cli.Context, serverCert *x509.Certificate) (*x509.Certificate, error) {
+func NewX509CodeSigningCertificate(cCtx Values, serverCert *x509.Certificate) (*x509.Certificate, error) {
 	serialNumber, err := utils.GenerateSerialNumber()
 	if err != nil {
 		return nil, err
 	}
 
-	ocspServers := []string{}
-	for _, ocsp := range strings.Split(cCtx.String("ocsp"), ",") {
-		ocspServers = append(ocspServers, strings.TrimSpace(ocsp))
-	}
-
+	urls := pkiURLs(cCtx)
 	return &x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			CommonName:         cCtx.String("name"),
-			OrganizationalUnit: []string{cCtx.String("type")},
-			Organization:       []string{cCtx.String("org")},
-			Country:            []string{cCtx.String("country")},
-			Province:           []string{cCtx.String("province")},
-			Locality:           []string{cCtx.String("locality")},
-			StreetAddress:      []string{cCtx.String("address")},
-			PostalCode:         []string{cCtx.String("postal-code")},
-		},
-		Issuer:      serverCert.Subject,
-		NotBefore:   time.Now().Add(-5 * time.Minute).UTC(),
-		NotAfter:    time.Now().AddDate(cCtx.Int("years-valid"), cCtx.Int("months-valid"), cCtx.Int("days-valid")),
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
-		KeyUsage:    x509.KeyUsageDigitalSignature,
-		OCSPServer:  ocspServers,
+			OrganizationalUnit: rdnValues(cCtx.String("type")),
+			Organization:       rdnValues(cCtx.String("org")),
+			Country:            rdnValues(cCtx.String("country")),
+			Province:           rdnValues(cCtx.String("province")),
+			Locality:           rdnValues(cCtx.String("locality")),
+			StreetAddress:      rdnValues(cCtx.String("address")),
+			PostalCode:         rdnValues(cCtx.String("postal-code")),
+		},
+		Issuer:                serverCert.Subject,
+		NotBefore:             time.Now().Add(-5 * time.Minute).UTC(),
+		NotAfter:              time.Now().AddDate(cCtx.Int("years-valid"), cCtx.Int("months-valid"), cCtx.Int("days-valid")),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		OCSPServer:            splitOCSPServers(cCtx.String("ocsp")),
+		CRLDistributionPoints: urls.CRL,
+		IssuingCertificateURL: urls.CAIssuers,
 	}, nil
 }
 
 func generateCodeSigningCertFlags() []cli.Flag {
-	return []cli.Flag{
+	flags := []cli.Flag{
 		&cli.StringFlag{
 			Name:     "name",
 			Usage:    "the common name for this certificate",
@@ -209,7 +208,11 @@ func generateCodeSigningCertFlags() []cli.Flag {
 		},
 		&cli.StringFlag{
 			Name:  "pass",
-			Usage: "the password that will be asked when the certificates is imported (default: changeit)",
+			Usage: "the password that will be asked when the certificates is imported (default: a random password)",
 		},
+		auditDBURLFlag(),
+		certPolicyFlag(),
 	}
+	flags = append(flags, outputFlags(OutputFormatPFX, false)...)
+	return append(flags, pkiConfigFlags()...)
 }
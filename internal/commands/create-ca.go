@@ -23,13 +23,22 @@ func CreateCA() *cli.Command {
 	}
 }
 
-func generateCA(cCtx *cli.Context) error {
+func generateCA(cCtx *cli.Context) (err error) {
+	model, err := openAuditModel(cCtx)
+	if err != nil {
+		return err
+	}
+	if model != nil {
+		defer model.Close()
+	}
+
 	log.Printf("... generating your CA certificate and private keys")
 
 	ca, err := NewCAX509Certificate(cCtx)
 	if err != nil {
 		return err
 	}
+	defer func() { recordCLIAudit(cCtx, model, ca.SerialNumber.Int64(), err) }()
 
 	caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
@@ -42,6 +51,16 @@ func generateCA(cCtx *cli.Context) error {
 		return err
 	}
 
+	caCert, err := x509.ParseCertificate(caBytes)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... linting your CA certificate")
+	if err := lintCertificate(caCert); err != nil {
+		return err
+	}
+
 	path := cCtx.String("dst")
 	if path == "" {
 		cwd, err := os.Getwd()
@@ -61,6 +80,7 @@ func generateCA(cCtx *cli.Context) error {
 	if err := utils.SavePrivateKey(caPrivKey, filepath.Join(path, "ca.key")); err != nil {
 		return err
 	}
+	recordKeyExport(model, cliActor(), ca.SerialNumber.Int64(), filepath.Join(path, "ca.key"))
 
 	log.Printf("✅ Done! Your CA certificate and private key has been stored in the certificates folder. Create a backup of these files and store them in a safe and secure place\n\n")
 	return nil
@@ -75,17 +95,17 @@ func NewCAX509Certificate(cCtx *cli.Context) (*x509.Certificate, error) {
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			CommonName:    cCtx.String("name"),
-			Organization:  []string{cCtx.String("org")},
-			Country:       []string{cCtx.String("country")},
-			Province:      []string{cCtx.String("province")},
-			Locality:      []string{cCtx.String("locality")},
-			StreetAddress: []string{cCtx.String("address")},
-			PostalCode:    []string{cCtx.String("postal-code")},
+			Organization:  rdnValues(cCtx.String("org")),
+			Country:       rdnValues(cCtx.String("country")),
+			Province:      rdnValues(cCtx.String("province")),
+			Locality:      rdnValues(cCtx.String("locality")),
+			StreetAddress: rdnValues(cCtx.String("address")),
+			PostalCode:    rdnValues(cCtx.String("postal-code")),
 		},
 		NotBefore:             time.Now().Add(-5 * time.Minute).UTC(),
 		NotAfter:              time.Now().AddDate(cCtx.Int("years-valid"), cCtx.Int("months-valid"), cCtx.Int("days-valid")),
 		IsCA:                  true,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 	}, nil
 }
@@ -137,5 +157,6 @@ func createCAFlags() []cli.Flag {
 			Name:  "dst",
 			Usage: "the folder where the certificates will be stored",
 		},
+		auditDBURLFlag(),
 	}
 }
@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+func CreateSSHCA() *cli.Command {
+	return &cli.Command{
+		Name:   "create-ssh-ca",
+		Usage:  "Create the key pair of your SSH Certificate Authority, used to sign OpenSSH user and host certificates",
+		Action: generateSSHCA,
+		Flags:  createSSHCAFlags(),
+	}
+}
+
+func generateSSHCA(cCtx *cli.Context) (err error) {
+	model, err := openAuditModel(cCtx)
+	if err != nil {
+		return err
+	}
+	if model != nil {
+		defer model.Close()
+	}
+	defer func() { recordCLIAudit(cCtx, model, 0, err) }()
+
+	log.Printf("... generating your SSH CA private key")
+	privKey, err := generateSSHKey(cCtx.String("key-type"))
+	if err != nil {
+		return err
+	}
+
+	signer, err := ssh.NewSignerFromKey(privKey)
+	if err != nil {
+		return err
+	}
+
+	block, err := ssh.MarshalPrivateKey(privKey, cCtx.String("name"))
+	if err != nil {
+		return fmt.Errorf("could not encode the SSH CA private key, reason: %s", err.Error())
+	}
+
+	path := cCtx.String("dst")
+	if path == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(cwd, "certificates")
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+
+	log.Printf("... saving your SSH CA private key to %s", filepath.Join(path, "ssh_ca"))
+	if err := os.WriteFile(filepath.Join(path, "ssh_ca"), pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("could not save the SSH CA private key, reason: %s", err.Error())
+	}
+	recordKeyExport(model, cliActor(), 0, filepath.Join(path, "ssh_ca"))
+
+	log.Printf("... saving your SSH CA public key to %s", filepath.Join(path, "ssh_ca.pub"))
+	if err := os.WriteFile(filepath.Join(path, "ssh_ca.pub"), marshalSSHPublicKey(signer.PublicKey(), cCtx.String("name")), 0644); err != nil {
+		return fmt.Errorf("could not save the SSH CA public key, reason: %s", err.Error())
+	}
+
+	log.Printf("✅ Done! Your SSH CA key pair has been stored in the certificates folder (%s). Add ssh_ca.pub to the TrustedUserCAKeys option of sshd and as a @cert-authority line in known_hosts. Create a backup of ssh_ca and store it in a safe and secure place\n\n", ssh.FingerprintSHA256(signer.PublicKey()))
+	return nil
+}
+
+// generateSSHKey generates a private key of one of the types supported by OpenSSH certificates
+func generateSSHKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, fmt.Errorf("key type is not one of 'ed25519', 'ecdsa' or 'rsa'")
+	}
+}
+
+// marshalSSHPublicKey encodes a public key or certificate in the authorized_keys format with a comment
+func marshalSSHPublicKey(key ssh.PublicKey, comment string) []byte {
+	line := ssh.MarshalAuthorizedKey(key)
+	if comment == "" {
+		return line
+	}
+	return append(append(line[:len(line)-1], ' '), []byte(comment+"\n")...)
+}
+
+func createSSHCAFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Usage:    "the name of your SSH CA, stored as the comment of its keys",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "key-type",
+			Value: "ed25519",
+			Usage: "the type of the SSH CA key (one of 'ed25519', 'ecdsa' or 'rsa')",
+		},
+		&cli.StringFlag{
+			Name:  "dst",
+			Usage: "the folder where the SSH CA keys will be stored",
+		},
+		auditDBURLFlag(),
+	}
+}
@@ -0,0 +1,235 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/open-uem/openuem-cert-manager/internal/tsa"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// tsaPolicyType is the type of the TSA certificates in the certificate policy
+const tsaPolicyType = "time-stamping"
+
+func CreateTSACertificate() *cli.Command {
+	return &cli.Command{
+		Name:   "create-tsa-cert",
+		Usage:  "Generate a certificate file and a private key file both in PEM format for the RFC 3161 time-stamping authority (serve-tsa)",
+		Action: generateTSACert,
+		Flags:  generateTSACertFlags(),
+	}
+}
+
+func generateTSACert(cCtx *cli.Context) (err error) {
+	model, err := openAuditModel(cCtx)
+	if err != nil {
+		return err
+	}
+	if model != nil {
+		defer model.Close()
+	}
+
+	serial := int64(0)
+	defer func() { recordCLIAudit(cCtx, model, serial, err) }()
+
+	log.Printf("... reading CA cert PEM file")
+	caCerts, err := readCertificateFile(cCtx.String("cacert"))
+	if err != nil {
+		return err
+	}
+	caCert := caCerts[0]
+
+	out, err := newCertificateOutput(cCtx, OutputFormatPEM)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
+	if err != nil {
+		return err
+	}
+
+	policy, err := certpolicy.LoadOptional(cCtx.String("cert-policy"))
+	if err != nil {
+		return err
+	}
+
+	if err := loadPKIConfig(cCtx, model); err != nil {
+		return err
+	}
+
+	log.Printf("... generating certificate and private key")
+	template, err := NewX509TimeStampingCertificate(cCtx, caCert)
+	if err != nil {
+		return err
+	}
+
+	certPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return err
+	}
+
+	if err := policy.Enforce(tsaPolicyType, template, &certPrivKey.PublicKey, caCert); err != nil {
+		return err
+	}
+
+	_, cert, err := signCertificate(template, &certPrivKey.PublicKey, caCert, caPrivKey)
+	if err != nil {
+		return err
+	}
+	serial = cert.SerialNumber.Int64()
+
+	if err := tsa.CheckCertificate(cert); err != nil {
+		return err
+	}
+
+	path := cCtx.String("dst")
+	if path == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(cwd, "certificates")
+	}
+
+	log.Printf("... saving your TSA certificate and its private key in %s format", out.format)
+	keyFilename, err := out.Write(path, cCtx.String("filename"), cert, caCerts, certPrivKey)
+	if err != nil {
+		return err
+	}
+	recordKeyExport(model, cliActor(), serial, keyFilename)
+
+	log.Printf("✅ Done! Your TSA certificate and private key have been stored in the certificates folder, use them with serve-tsa\n\n")
+	return nil
+}
+
+// NewX509TimeStampingCertificate returns the template of a TSA certificate, Go never marks the
+// extended key usage as critical so the extension is added as an extra extension that replaces it
+// Ref: https://datatracker.ietf.org/doc/html/rfc3161#section-2.3
+func NewX509TimeStampingCertificate(cCtx Values, caCert *x509.Certificate) (*x509.Certificate, error) {
+	serialNumber, err := utils.GenerateSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	ekuValue, err := asn1.Marshal([]asn1.ObjectIdentifier{{1, 3, 6, 1, 5, 5, 7, 3, 8}})
+	if err != nil {
+		return nil, err
+	}
+
+	urls := pkiURLs(cCtx)
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:    cCtx.String("name"),
+			Organization:  rdnValues(cCtx.String("org")),
+			Country:       rdnValues(cCtx.String("country")),
+			Province:      rdnValues(cCtx.String("province")),
+			Locality:      rdnValues(cCtx.String("locality")),
+			StreetAddress: rdnValues(cCtx.String("address")),
+			PostalCode:    rdnValues(cCtx.String("postal-code")),
+		},
+		Issuer:      caCert.Subject,
+		NotBefore:   time.Now().Add(-5 * time.Minute).UTC(),
+		NotAfter:    time.Now().AddDate(cCtx.Int("years-valid"), cCtx.Int("months-valid"), cCtx.Int("days-valid")),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{2, 5, 29, 37}, Critical: true, Value: ekuValue},
+		},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		OCSPServer:            splitOCSPServers(cCtx.String("ocsp")),
+		CRLDistributionPoints: urls.CRL,
+		IssuingCertificateURL: urls.CAIssuers,
+	}, nil
+}
+
+func generateTSACertFlags() []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:     "name",
+			Usage:    "the common name for this certificate e.g OpenUEM Time-Stamping Authority",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cacert",
+			Usage:    "the path to your CA certificate file in PEM format",
+			EnvVars:  []string{"CA_CRT_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cakey",
+			Usage:    "the path to your CA private key file in PEM format",
+			EnvVars:  []string{"CA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "filename",
+			Value: "tsa",
+			Usage: "filename to be used for certificate and private key files",
+		},
+		&cli.StringFlag{
+			Name:  "org",
+			Usage: "organization name associated with this certificate",
+		},
+		&cli.StringFlag{
+			Name:  "country",
+			Usage: "two-letter ISO_3166 country code",
+		},
+		&cli.StringFlag{
+			Name:  "province",
+			Usage: "the province your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "locality",
+			Usage: "the locality your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "the address your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "postal-code",
+			Usage: "the postal code associated with your organization's address",
+		},
+		&cli.IntFlag{
+			Name:  "years-valid",
+			Value: 1,
+			Usage: "the number of years for which the certificate will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "months-valid",
+			Usage: "the number of months for which the certificate will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "days-valid",
+			Usage: "the number of days for which the certificate will be valid",
+		},
+		&cli.StringFlag{
+			Name:    "ocsp",
+			Usage:   "the url of the OCSP responder, e.g https://ocsp.example.com",
+			EnvVars: []string{"OCSP"},
+		},
+		&cli.StringFlag{
+			Name:  "dst",
+			Usage: "the folder where the certificates will be stored",
+		},
+		&cli.StringFlag{
+			Name:  "pass",
+			Usage: "the password of the PFX file if the format is pfx (default: a random password)",
+		},
+		auditDBURLFlag(),
+		certPolicyFlag(),
+	}
+	flags = append(flags, outputFlags(OutputFormatPEM, false)...)
+	return append(flags, pkiConfigFlags()...)
+}
@@ -0,0 +1,158 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+)
+
+// crlCheckInterval is how often the revocations are checked to sign a new CRL when they change, it's
+// also how long clients may cache the CRL so a revocation is published within two intervals
+const crlCheckInterval = time.Minute
+
+// crlSigner keeps the latest CRL served by a server, it's signed again when the revocations change or
+// once half of its validity has passed so clients always find a CRL before the nextUpdate of the one
+// they have. Only the signing uses the CA key and is audited, not every download
+type crlSigner struct {
+	model     *models.Model
+	caCert    *x509.Certificate
+	caPrivKey *rsa.PrivateKey
+	validity  time.Duration
+	// command is recorded in the audit log when a CRL is signed
+	command string
+
+	mu  sync.RWMutex
+	crl *signedCRL
+}
+
+type signedCRL struct {
+	der        []byte
+	thisUpdate time.Time
+	// revocations is the digest of the revocations in database when the CRL was signed
+	revocations string
+}
+
+func newCRLSigner(model *models.Model, caCert *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, command string) *crlSigner {
+	return &crlSigner{model: model, caCert: caCert, caPrivKey: caPrivKey, validity: validity, command: command}
+}
+
+// latest returns the last CRL signed, refresh must have been called once
+func (c *crlSigner) latest() *signedCRL {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.crl
+}
+
+// run signs a new CRL when the revocations change or once half of the validity of the current one
+// has passed, until done is closed
+func (c *crlSigner) run(done chan struct{}) {
+	ticker := time.NewTicker(crlCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			crl := c.latest()
+
+			revocations, err := revocationsDigest(c.model)
+			if err != nil {
+				log.Printf("[ERROR]: could not check the revocations, it will be tried again in a minute, reason: %v", err)
+				continue
+			}
+			if revocations == crl.revocations && time.Now().Before(crl.thisUpdate.Add(c.validity/2)) {
+				continue
+			}
+			if err := c.refresh(); err != nil {
+				log.Printf("[ERROR]: could not sign a new CRL, it will be tried again in a minute, reason: %v", err)
+			}
+		}
+	}
+}
+
+// refresh signs a new CRL with the revocations stored in database
+func (c *crlSigner) refresh() error {
+	// The digest is taken first so a revocation added while the CRL is signed triggers a new one
+	revocations, err := revocationsDigest(c.model)
+	if err != nil {
+		return fmt.Errorf("could not get revocations from database, reason: %s", err.Error())
+	}
+
+	der, err := createCRL(c.model, c.caCert, c.caPrivKey, c.validity)
+	recordAudit(c.model, cliActor(), c.command, map[string]any{"validity": c.validity.String()}, 0, err)
+	if err != nil {
+		return fmt.Errorf("could not create CRL, reason: %s", err.Error())
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.crl = &signedCRL{der: der, thisUpdate: crl.ThisUpdate, revocations: revocations}
+	c.mu.Unlock()
+
+	log.Printf("... CRL signed with %d revoked certificates, next update at %s", len(crl.RevokedCertificateEntries), crl.NextUpdate.Format(time.RFC3339))
+	return nil
+}
+
+// revocationsDigest returns a hash of the revocations stored in database to find out if they've changed
+func revocationsDigest(model *models.Model) (string, error) {
+	revocations, err := model.GetRevocations()
+	if err != nil {
+		return "", err
+	}
+
+	entries := []string{}
+	for _, r := range revocations {
+		entries = append(entries, fmt.Sprintf("%d:%d:%d", r.ID, r.Reason, r.Revoked.UnixNano()))
+	}
+	slices.Sort(entries)
+
+	sum := sha256.Sum256([]byte(strings.Join(entries, ",")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// createCRL returns a DER encoded CRL signed by the CA with all the revocations stored in database
+func createCRL(model *models.Model, caCert *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration) ([]byte, error) {
+	if caCert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, fmt.Errorf("the CA certificate is not allowed to sign CRLs")
+	}
+
+	revocations, err := model.GetRevocations()
+	if err != nil {
+		return nil, fmt.Errorf("could not get revocations from database, reason: %s", err.Error())
+	}
+
+	entries := []x509.RevocationListEntry{}
+	for _, r := range revocations {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(r.ID),
+			RevocationTime: r.Revoked,
+			ReasonCode:     r.Reason,
+		})
+	}
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
+	}
+
+	return x509.CreateRevocationList(rand.Reader, template, caCert, caPrivKey)
+}
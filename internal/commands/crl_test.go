@@ -0,0 +1,65 @@
+package commands
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+)
+
+func TestAPIServesCachedCRL(t *testing.T) {
+	model := newTestModel(t)
+	caCert, caKey := newTestCA(t)
+
+	s := &apiServer{model: model, caCert: caCert, caPrivKey: caKey, crl: newCRLSigner(model, caCert, caKey, time.Hour, "serve-api crl")}
+	if err := s.crl.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	var der []byte
+	for range 3 {
+		w := httptest.NewRecorder()
+		s.getCRL(w, httptest.NewRequest(http.MethodGet, apiPathPrefix+"/crl", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d", w.Code)
+		}
+		if der != nil && string(der) != w.Body.String() {
+			t.Fatal("a new CRL was signed for a request")
+		}
+		der = w.Body.Bytes()
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the signing is audited
+	entries := 0
+	if err := model.WalkAuditLog(func(e *models.AuditEntry) error {
+		entries++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if entries != 1 {
+		t.Fatalf("expected the signing in the audit log, got %d entries", entries)
+	}
+
+	// The CRL signed after a revocation lists it
+	if err := model.AddRevocation(42, 1, "key compromise"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.crl.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if crl, err = x509.ParseRevocationList(s.crl.latest().der); err != nil || len(crl.RevokedCertificateEntries) != 1 {
+		t.Fatalf("the revocation is not in the new CRL, %v", err)
+	}
+}
@@ -0,0 +1,325 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// oidExtKeyUsageEAPOverLAN marks the certificates used by EAP over LAN (802.1X)
+// Ref: https://datatracker.ietf.org/doc/html/rfc4334#section-2
+var oidExtKeyUsageEAPOverLAN = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 14}
+
+// deviceIdentity is the identity of a device in 802.1X, its hostname or the MAC address of its
+// network interface
+type deviceIdentity struct {
+	name string
+	mac  net.HardwareAddr
+}
+
+func CreateDeviceCertificate() *cli.Command {
+	return &cli.Command{
+		Name:   "device-cert",
+		Usage:  "Generate a PKCS12 file in PFX format for every device with its 802.1X (EAP-TLS) certificate, private key and the CA certificate",
+		Action: generateDeviceCerts,
+		Flags:  generateDeviceCertFlags(),
+	}
+}
+
+func generateDeviceCerts(cCtx *cli.Context) (err error) {
+	identities := []deviceIdentity{}
+	for _, device := range cCtx.StringSlice("device") {
+		identity, err := parseDeviceIdentity(device)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, identity)
+	}
+
+	if len(identities) > 1 && cCtx.String("k8s-secret-name") != "" {
+		return fmt.Errorf("the name of the Kubernetes Secret can't be set for several devices")
+	}
+
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	serial := int64(0)
+	defer func() { recordCLIAudit(cCtx, model, serial, err) }()
+
+	log.Printf("... reading CA cert PEM file")
+	caCerts, err := readCertificateFile(cCtx.String("cacert"))
+	if err != nil {
+		return err
+	}
+	caCert := caCerts[0]
+
+	out, err := newCertificateOutput(cCtx, OutputFormatPFX)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
+	if err != nil {
+		return err
+	}
+
+	policy, err := certpolicy.LoadOptional(cCtx.String("cert-policy"))
+	if err != nil {
+		return err
+	}
+
+	if err := loadPKIConfig(cCtx, model); err != nil {
+		return err
+	}
+
+	path := cCtx.String("dst")
+	if path == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(cwd, "certificates")
+	}
+
+	for _, identity := range identities {
+		log.Printf("... generating the certificate and private key of %s", identity.name)
+		template, err := NewX509DeviceCertificate(cCtx, identity, caCert)
+		if err != nil {
+			return err
+		}
+
+		// Many supplicants, e.g printers or phones, can't use keys bigger than 2048 bits
+		certPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+
+		if err := policy.Enforce(string(models.CertificateTypeDevice), template, &certPrivKey.PublicKey, caCert); err != nil {
+			return err
+		}
+
+		_, cert, err := signCertificate(template, &certPrivKey.PublicKey, caCert, caPrivKey)
+		if err != nil {
+			return err
+		}
+		serial = cert.SerialNumber.Int64()
+
+		if err := model.SaveCertificate(serial, models.CertificateTypeDevice, cCtx.String("description"), cert.NotAfter, false, ""); err != nil {
+			return err
+		}
+
+		// MAC addresses are written with dashes, colons can't be used in Windows filenames
+		log.Printf("... saving the certificate of %s in %s format", identity.name, out.format)
+		keyFilename, err := out.Write(path, strings.ReplaceAll(identity.name, ":", "-"), cert, caCerts, certPrivKey)
+		if err != nil {
+			if err := model.DeleteCertificate(serial); err != nil {
+				log.Printf("... could not delete certificate from database %d", serial)
+			}
+			return err
+		}
+		recordKeyExport(model, cliActor(), serial, keyFilename)
+	}
+
+	log.Printf("✅ Done! %d device certificates have been stored inside the certificates folder\n\n", len(identities))
+	return nil
+}
+
+// parseDeviceIdentity returns the identity of a device given its hostname or a MAC address, MAC
+// addresses are written in lowercase with colons e.g 00:1a:2b:3c:4d:5e
+func parseDeviceIdentity(device string) (deviceIdentity, error) {
+	device = strings.TrimSpace(device)
+	if mac, err := net.ParseMAC(device); err == nil {
+		if len(mac) != 6 {
+			return deviceIdentity{}, fmt.Errorf("the MAC address %q must be a 48-bit address", device)
+		}
+		return deviceIdentity{name: mac.String(), mac: mac}, nil
+	}
+
+	if err := validateDNSName(device); err != nil {
+		return deviceIdentity{}, fmt.Errorf("the device %q is neither a MAC address nor a valid hostname", device)
+	}
+	if strings.Contains(device, "*") {
+		return deviceIdentity{}, fmt.Errorf("the hostname of the device %q can't contain wildcards", device)
+	}
+	return deviceIdentity{name: strings.ToLower(device)}, nil
+}
+
+// NewX509DeviceCertificate returns the template of an 802.1X client certificate, the identity is
+// the common name so it matches the EAP identity of the supplicant. Hostnames are a DNS SAN too
+func NewX509DeviceCertificate(cCtx Values, identity deviceIdentity, caCert *x509.Certificate) (*x509.Certificate, error) {
+	serialNumber, err := utils.GenerateSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames := []string{}
+	if identity.mac == nil {
+		dnsNames = append(dnsNames, identity.name)
+	}
+
+	urls := pkiURLs(cCtx)
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:    identity.name,
+			Organization:  rdnValues(cCtx.String("org")),
+			Country:       rdnValues(cCtx.String("country")),
+			Province:      rdnValues(cCtx.String("province")),
+			Locality:      rdnValues(cCtx.String("locality")),
+			StreetAddress: rdnValues(cCtx.String("address")),
+			PostalCode:    rdnValues(cCtx.String("postal-code")),
+		},
+		Issuer:                caCert.Subject,
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-5 * time.Minute).UTC(),
+		NotAfter:              time.Now().AddDate(cCtx.Int("years-valid"), cCtx.Int("months-valid"), cCtx.Int("days-valid")),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{oidExtKeyUsageEAPOverLAN},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		OCSPServer:            splitOCSPServers(cCtx.String("ocsp")),
+		CRLDistributionPoints: urls.CRL,
+		IssuingCertificateURL: urls.CAIssuers,
+	}, nil
+}
+
+// freeRADIUSEAP is the eap module of FreeRADIUS 3 for EAP-TLS, it accepts the device certificates
+// issued by the CA
+// Ref: https://github.com/FreeRADIUS/freeradius-server/blob/v3.2.x/raddb/mods-available/eap
+const freeRADIUSEAP = `# EAP-TLS configuration generated by openuem-cert-manager, copy it to mods-available/eap
+eap {
+	default_eap_type = tls
+	timer_expire = 60
+	ignore_unknown_eap_types = no
+	max_sessions = ${max_requests}
+
+	tls-config tls-common {
+		certificate_file = %s
+		private_key_file = %s
+		ca_file = %s
+		ca_path = ${cadir}
+		cipher_list = "HIGH"
+		tls_min_version = "1.2"
+	}
+
+	tls {
+		tls = tls-common
+	}
+}
+`
+
+// writeFreeRADIUSEAP saves the eap module configuration of FreeRADIUS with the RADIUS server certificate
+// and the CA that issued the device certificates
+func writeFreeRADIUSEAP(filename, certFile, keyFile, caFile string) error {
+	paths := []string{}
+	for _, p := range []string{certFile, keyFile, caFile} {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, abs)
+	}
+
+	if err := os.WriteFile(filename, []byte(fmt.Sprintf(freeRADIUSEAP, paths[0], paths[1], paths[2])), 0644); err != nil {
+		return fmt.Errorf("could not save the FreeRADIUS eap module configuration, reason: %s", err.Error())
+	}
+	return nil
+}
+
+func generateDeviceCertFlags() []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:     "device",
+			Usage:    "the hostname or the MAC address of a device e.g laptop01.example.com or 00:1a:2b:3c:4d:5e, it can be repeated to create the certificates of several devices",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "cacert",
+			Value:   "certificates/ca.cer",
+			Usage:   "the path to your CA certificate file in PEM format",
+			EnvVars: []string{"CA_CRT_FILENAME"},
+		},
+		&cli.StringFlag{
+			Name:    "cakey",
+			Value:   "certificates/ca.key",
+			Usage:   "the path to your CA private key file in PEM format",
+			EnvVars: []string{"CA_KEY_FILENAME"},
+		},
+		&cli.StringFlag{
+			Name:  "org",
+			Usage: "organization name associated with this certificate",
+		},
+		&cli.StringFlag{
+			Name:  "country",
+			Usage: "two-letter ISO_3166 country code",
+		},
+		&cli.StringFlag{
+			Name:  "province",
+			Usage: "the province your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "locality",
+			Usage: "the locality your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "the address your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "postal-code",
+			Usage: "the postal code associated with your organization's address",
+		},
+		&cli.IntFlag{
+			Name:  "years-valid",
+			Value: 1,
+			Usage: "the number of years for which the certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "months-valid",
+			Usage: "the number of months for which the certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "days-valid",
+			Usage: "the number of days for which the certificates will be valid",
+		},
+		&cli.StringFlag{
+			Name:    "ocsp",
+			Usage:   "the url of the OCSP responder, e.g https://ocsp.example.com",
+			EnvVars: []string{"OCSP"},
+		},
+		&cli.StringFlag{
+			Name:  "description",
+			Usage: "an optional description for these certificates",
+		},
+		&cli.StringFlag{
+			Name:  "dst",
+			Usage: "the folder where the certificates will be stored",
+		},
+		&cli.StringFlag{
+			Name:  "pass",
+			Usage: "the password that will be asked when the certificates are imported (default: a random password)",
+		},
+		dbURLFlag(),
+		certPolicyFlag(),
+	}
+	flags = append(flags, outputFlags(OutputFormatPFX, false)...)
+	return append(flags, pkiConfigFlags()...)
+}
@@ -0,0 +1,420 @@
+package commands
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	ent "github.com/open-uem/ent"
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/nats"
+	"github.com/open-uem/openuem-cert-manager/internal/certlint"
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/urfave/cli/v2"
+)
+
+// Kinds of certificates that can be issued, each one has its own template
+const (
+	KindServer      = "server"
+	KindClient      = "client"
+	KindUser        = "user"
+	KindCodeSigning = "code-signing"
+)
+
+// localFlags are the flags that only make sense on the machine that issues a certificate, they're
+// not part of the settings of a certificate sent to a server or stored in a request
+var localFlags = []string{"dburl", "cacert", "cakey", "dst", "pass", "pass-file", "pass-stdin", "pass-out", "pfx-encoding", "format", "chain", "output", "k8s-namespace", "k8s-secret-name", "secret-owner", "cert-policy", "crl-url", "ca-issuers-url", "freeradius-eap"}
+
+// Values gives access to the settings of a certificate by flag name. *cli.Context implements it
+// so the command-line and the API share the same templates
+type Values interface {
+	String(name string) string
+	Int(name string) int
+	Bool(name string) bool
+}
+
+type IssuedCertificate struct {
+	Cert      *x509.Certificate
+	CertBytes []byte
+	PrivKey   *rsa.PrivateKey
+}
+
+// IssueFlags returns the flags of the command that issues a kind of certificate
+func IssueFlags(kind string) ([]cli.Flag, error) {
+	switch kind {
+	case KindServer:
+		return generateServerCertFlags(), nil
+	case KindClient:
+		return generateClientCertFlags(), nil
+	case KindUser:
+		return generateUserCertFlags(), nil
+	case KindCodeSigning:
+		return generateCodeSigningCertFlags(), nil
+	default:
+		return nil, fmt.Errorf("kind is not one of '%s', '%s', '%s' or '%s'", KindServer, KindClient, KindUser, KindCodeSigning)
+	}
+}
+
+// CertificateType returns the OpenUEM type stored in database for a certificate, code signing
+// certificates are not stored
+func CertificateType(kind string, v Values) certificate.Type {
+	switch kind {
+	case KindUser:
+		return certificate.TypeUser
+	case KindCodeSigning:
+		return ""
+	default:
+		return certificate.Type(v.String("type"))
+	}
+}
+
+// PolicyType returns the certificate type used by authorization and certificate policies, code
+// signing certificates have no OpenUEM type so the kind is used instead
+func PolicyType(kind string, v Values) string {
+	if kind == KindCodeSigning {
+		return KindCodeSigning
+	}
+	return string(CertificateType(kind, v))
+}
+
+// CommonName returns the subject common name requested for a certificate
+func CommonName(kind string, v Values) string {
+	if kind == KindUser {
+		return v.String("username")
+	}
+	return v.String("name")
+}
+
+// ValidateSettings checks the settings of a certificate before it's issued or requested
+func ValidateSettings(kind string, v Values) error {
+	switch kind {
+	case KindServer:
+		if certType := certificate.Type(v.String("type")); certType != models.CertificateTypeRADIUS {
+			if err := certificate.TypeValidator(certType); err != nil {
+				return err
+			}
+		}
+		if _, err := validateDNSNames(v.String("dns-names")); err != nil {
+			return err
+		}
+		_, err := subjectAltNames(v)
+		return err
+	case KindClient:
+		if !isValidCertificateType(v.String("type")) {
+			return fmt.Errorf("type is not one of 'console', 'worker', 'sftp' or 'agent'")
+		}
+		_, err := subjectAltNames(v)
+		return err
+	case KindUser:
+		if err := validateUserProfile(v); err != nil {
+			return err
+		}
+		_, err := subjectAltNames(v)
+		return err
+	case KindCodeSigning:
+		return nil
+	default:
+		_, err := IssueFlags(kind)
+		return err
+	}
+}
+
+// IssueCertificate generates a private key and a certificate of the given kind signed by the CA, the
+// certificate must comply with the certificate policy of its type
+func IssueCertificate(kind string, v Values, caCert *x509.Certificate, caPrivKey *rsa.PrivateKey, policy *certpolicy.Policy) (*IssuedCertificate, error) {
+	if err := ValidateSettings(kind, v); err != nil {
+		return nil, err
+	}
+
+	var cert *x509.Certificate
+	var err error
+
+	switch kind {
+	case KindServer:
+		dnsNames, err := validateDNSNames(v.String("dns-names"))
+		if err != nil {
+			return nil, err
+		}
+		cert, err = NewX509Certificate(v, dnsNames, caCert)
+		if err != nil {
+			return nil, err
+		}
+	case KindClient:
+		cert, err = NewX509ClientCertificate(v, caCert)
+	case KindUser:
+		cert, err = NewX509UserCertificate(userCertificateRequest(v), caCert, pkiURLs(v))
+	case KindCodeSigning:
+		cert, err = NewX509CodeSigningCertificate(v, caCert)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if kind != KindCodeSigning {
+		sans, err := subjectAltNames(v)
+		if err != nil {
+			return nil, err
+		}
+		sans.apply(cert)
+	}
+
+	keyBits := 4096
+	if kind == KindUser {
+		if err := applyUserProfile(cert, v); err != nil {
+			return nil, err
+		}
+		keyBits = userKeyBits(v)
+	}
+
+	certPrivKey, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := policy.Enforce(PolicyType(kind, v), cert, &certPrivKey.PublicKey, caCert); err != nil {
+		return nil, err
+	}
+
+	certBytes, cert, err := signCertificate(cert, &certPrivKey.PublicKey, caCert, caPrivKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IssuedCertificate{Cert: cert, CertBytes: certBytes, PrivKey: certPrivKey}, nil
+}
+
+// signCertificate signs a certificate template with the CA and lints the certificate, a certificate
+// that fails the lint checks is not returned
+func signCertificate(template *x509.Certificate, pub crypto.PublicKey, caCert *x509.Certificate, caPrivKey *rsa.PrivateKey) ([]byte, *x509.Certificate, error) {
+	if len(template.SubjectKeyId) == 0 {
+		ski, err := subjectKeyID(pub)
+		if err != nil {
+			return nil, nil, err
+		}
+		template.SubjectKeyId = ski
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, caCert, pub, caPrivKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := lintCertificate(cert); err != nil {
+		return nil, nil, err
+	}
+	return certBytes, cert, nil
+}
+
+// lintCertificate logs the warnings of the linter and returns an error if the certificate has errors
+func lintCertificate(cert *x509.Certificate) error {
+	findings, err := certlint.Check(cert)
+	for _, f := range findings {
+		if f.Severity == certlint.SeverityWarning {
+			log.Printf("[WARN]: certificate %s, %s", cert.Subject.CommonName, f.Message)
+		}
+	}
+	return err
+}
+
+// subjectKeyID is the SHA-1 hash of the subject public key as RFC 5280 suggests, it's what Go
+// does for CA certificates
+// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-4.2.1.2
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	spki := struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}{}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+
+	ski := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return ski[:], nil
+}
+
+// rdnValues returns the value of a subject attribute, empty values are left out so the subject
+// has no empty RDNs
+func rdnValues(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return []string{strings.TrimSpace(value)}
+}
+
+// SaveIssuedCertificate stores the certificate info in database, code signing certificates are not stored
+func SaveIssuedCertificate(model *models.Model, kind string, v Values, cert *x509.Certificate) error {
+	certType := CertificateType(kind, v)
+	if certType == "" {
+		return nil
+	}
+	return model.SaveCertificate(cert.SerialNumber.Int64(), certType, v.String("description"), cert.NotAfter, kind == KindUser, v.String("username"))
+}
+
+// SaveRenewedCertificate stores a certificate that renews another one, the user of the renewed
+// certificate already exists so the new certificate is only linked to it
+func SaveRenewedCertificate(model *models.Model, v Values, cert *x509.Certificate, renewed *ent.Certificate) error {
+	serial := cert.SerialNumber.Int64()
+	if err := model.SaveCertificate(serial, renewed.Type, v.String("description"), cert.NotAfter, false, ""); err != nil {
+		return fmt.Errorf("could not save certificate info to database, reason: %s", err.Error())
+	}
+
+	if renewed.UID != "" {
+		if err := model.SetCertificateUser(serial, renewed.UID); err != nil {
+			return fmt.Errorf("could not save certificate user to database, reason: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// CheckRenewal checks that a certificate with these settings can replace the current one, it must
+// have the same type and belong to the same user
+func CheckRenewal(kind string, v Values, current *ent.Certificate) error {
+	if CertificateType(kind, v) != current.Type {
+		return fmt.Errorf("the new certificate must have the same type as the current one (%s)", current.Type)
+	}
+	if kind == KindUser && current.UID != "" && v.String("username") != current.UID {
+		return fmt.Errorf("the new certificate must have the same username as the current one (%s)", current.UID)
+	}
+	return nil
+}
+
+// checkCertificateType checks that a client certificate presented to a server was issued with the type
+// the server issues, so a certificate can't be renewed or exchanged for one of another type
+func checkCertificateType(model *models.Model, cert *x509.Certificate, certType string) error {
+	current, err := model.GetCertificate(cert.SerialNumber.Int64())
+	if err != nil {
+		return fmt.Errorf("could not find the certificate %x, reason: %s", cert.SerialNumber.Bytes(), err.Error())
+	}
+	if string(current.Type) != certType {
+		return fmt.Errorf("the certificate %x is a %s certificate, only %s certificates are accepted", cert.SerialNumber.Bytes(), current.Type, certType)
+	}
+	return nil
+}
+
+// WriteIssuedCertificate saves the certificate and its private key with the filename the command of
+// its kind uses, it returns the file that holds the private key
+func WriteIssuedCertificate(kind string, v Values, issued *IssuedCertificate, chain []*x509.Certificate, out *certificateOutput, path string) (string, error) {
+	filename := v.String("filename")
+	if kind == KindUser {
+		filename = v.String("username")
+	}
+	return out.Write(path, filename, issued.Cert, chain, issued.PrivKey)
+}
+
+// certPolicyFlag is shared by the commands and servers that issue certificates
+func certPolicyFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "cert-policy",
+		Usage:   "the path to a certificate policy file in JSON format that constrains the certificates issued for each type",
+		EnvVars: []string{"CERT_POLICY"},
+	}
+}
+
+// settingsFromContext returns the settings of a certificate set in the command-line
+func settingsFromContext(cCtx *cli.Context, flags []cli.Flag) map[string]any {
+	values := map[string]any{}
+	for _, flag := range flags {
+		name := flag.Names()[0]
+		if slices.Contains(localFlags, name) {
+			continue
+		}
+		values[name] = cCtx.Value(name)
+	}
+	return values
+}
+
+func userCertificateRequest(v Values) nats.CertificateRequest {
+	return nats.CertificateRequest{
+		Username:       v.String("username"),
+		Organization:   v.String("org"),
+		Country:        v.String("country"),
+		Province:       v.String("province"),
+		Locality:       v.String("locality"),
+		Address:        v.String("address"),
+		PostalCode:     v.String("postal-code"),
+		YearsValid:     v.Int("years-valid"),
+		MonthsValid:    v.Int("months-valid"),
+		DaysValid:      v.Int("days-valid"),
+		OCSPResponders: splitOCSPServers(v.String("ocsp")),
+	}
+}
+
+func splitOCSPServers(ocsp string) []string {
+	ocspServers := []string{}
+	for _, s := range strings.Split(ocsp, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ocspServers = append(ocspServers, s)
+		}
+	}
+	return ocspServers
+}
+
+// flagValues implements Values with a map of flag names to values, flags not in the map take
+// the default value of the command-line flag
+type flagValues struct {
+	values map[string]any
+	flags  []cli.Flag
+}
+
+func (f *flagValues) lookup(name string) (any, cli.Flag) {
+	idx := slices.IndexFunc(f.flags, func(flag cli.Flag) bool { return slices.Contains(flag.Names(), name) })
+	if idx == -1 {
+		return f.values[name], nil
+	}
+	return f.values[name], f.flags[idx]
+}
+
+func (f *flagValues) String(name string) string {
+	v, flag := f.lookup(name)
+	if s, ok := v.(string); ok {
+		return s
+	}
+	if sf, ok := flag.(*cli.StringFlag); ok {
+		return sf.Value
+	}
+	return ""
+}
+
+func (f *flagValues) Int(name string) int {
+	v, flag := f.lookup(name)
+	switch n := v.(type) {
+	case int:
+		return n
+	case float64:
+		return int(n)
+	}
+	if nf, ok := flag.(*cli.IntFlag); ok {
+		return nf.Value
+	}
+	return 0
+}
+
+func (f *flagValues) Bool(name string) bool {
+	v, flag := f.lookup(name)
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	if bf, ok := flag.(*cli.BoolFlag); ok {
+		return bf.Value
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package commands
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/open-uem/openuem-cert-manager/internal/certlint"
+	"github.com/urfave/cli/v2"
+)
+
+func Lint() *cli.Command {
+	return &cli.Command{
+		Name:      "lint",
+		Usage:     "Check certificate files in PEM or DER format against RFC 5280 and CA/Browser Forum rules",
+		ArgsUsage: "<file> [<file>...]",
+		Action:    lintFiles,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "strict",
+				Usage: "fail if a certificate has warnings too",
+			},
+		},
+	}
+}
+
+func lintFiles(cCtx *cli.Context) error {
+	if cCtx.NArg() == 0 {
+		return fmt.Errorf("at least one certificate file is required")
+	}
+
+	errors, warnings, total := 0, 0, 0
+	for _, filename := range cCtx.Args().Slice() {
+		certs, err := readCertificateFile(filename)
+		if err != nil {
+			return err
+		}
+
+		for _, cert := range certs {
+			total++
+			for _, f := range certlint.Lint(cert) {
+				fmt.Printf("%s: %s: %s\n", filename, cert.Subject.String(), f)
+				if f.Severity == certlint.SeverityError {
+					errors++
+				} else {
+					warnings++
+				}
+			}
+		}
+	}
+
+	if errors > 0 || (cCtx.Bool("strict") && warnings > 0) {
+		return fmt.Errorf("%d certificates checked, %d errors and %d warnings found", total, errors, warnings)
+	}
+
+	log.Printf("✅ Done! %d certificates checked, %d warnings found\n\n", total, warnings)
+	return nil
+}
+
+// readCertificateFile reads every certificate in a PEM file or the certificate in a DER file
+func readCertificateFile(filename string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s, reason: %s", filename, err.Error())
+	}
+
+	certs := []*x509.Certificate{}
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse a certificate in %s, reason: %s", filename, err.Error())
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s has no certificate in PEM or DER format", filename)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
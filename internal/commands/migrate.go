@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/urfave/cli/v2"
+)
+
+func Migrate() *cli.Command {
+	return &cli.Command{
+		Name:   "migrate",
+		Usage:  "Create the database tables owned by the cert-manager, they're only created automatically when ENV is not prod",
+		Action: migrate,
+		Flags:  []cli.Flag{dbURLFlag()},
+	}
+}
+
+func migrate(cCtx *cli.Context) error {
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	log.Printf("... creating the cert-manager tables")
+	if err := model.CreateTables(context.Background()); err != nil {
+		return err
+	}
+
+	log.Printf("✅ Done! The cert-manager tables are up to date\n\n")
+	return nil
+}
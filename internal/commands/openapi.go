@@ -0,0 +1,221 @@
+package commands
+
+// openAPIDocument describes the API served by serve-api
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "OpenUEM Certificate Manager API",
+    "version": "1.0.0",
+    "description": "Clients must authenticate with an OpenUEM console certificate (mutual TLS) or with an API token of the authorization policy (Authorization: Bearer <token>). Operations not allowed by the policy return 403"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "paths": {
+    "/ca": {
+      "get": {
+        "summary": "Download the CA certificate",
+        "responses": {"200": {"description": "CA certificate", "content": {"application/x-pem-file": {}}}}
+      }
+    },
+    "/crl": {
+      "get": {
+        "summary": "Download a CRL with the revoked certificates",
+        "responses": {"200": {"description": "DER encoded CRL", "content": {"application/pkix-crl": {}}}}
+      }
+    },
+    "/certificates": {
+      "get": {
+        "summary": "List certificates",
+        "responses": {"200": {"description": "Certificates", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Certificate"}}}}}}
+      },
+      "post": {
+        "summary": "Issue a certificate, types that require approval are requested instead",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssueRequest"}}}},
+        "responses": {
+          "201": {"description": "Issued certificate", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssueResponse"}}}},
+          "202": {"description": "Certificate request waiting for approval", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CertRequest"}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/certificates/{serial}": {
+      "parameters": [{"$ref": "#/components/parameters/Serial"}],
+      "get": {
+        "summary": "Inspect a certificate",
+        "responses": {
+          "200": {"description": "Certificate", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Certificate"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/certificates/{serial}/renew": {
+      "parameters": [{"$ref": "#/components/parameters/Serial"}],
+      "post": {
+        "summary": "Issue a new certificate of the same type and revoke this one as superseded, the caller must be allowed to renew this certificate and to issue the new one",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssueRequest"}}}},
+        "responses": {
+          "201": {"description": "Issued certificate", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssueResponse"}}}},
+          "202": {"description": "Certificate request waiting for approval, this certificate is revoked when the request is issued", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CertRequest"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/certificates/{serial}/revoke": {
+      "parameters": [{"$ref": "#/components/parameters/Serial"}],
+      "post": {
+        "summary": "Revoke a certificate",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RevokeRequest"}}}},
+        "responses": {
+          "200": {"description": "Revoked certificate", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Certificate"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/requests": {
+      "get": {
+        "summary": "List certificate requests",
+        "parameters": [{"name": "status", "in": "query", "description": "pending by default, use all to get every request", "schema": {"type": "string", "enum": ["pending", "approved", "rejected", "issued", "all"]}}],
+        "responses": {"200": {"description": "Certificate requests", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/CertRequest"}}}}}}
+      },
+      "post": {
+        "summary": "Request a certificate that will be issued once approved",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssueRequest"}}}},
+        "responses": {
+          "202": {"description": "Certificate request waiting for approval", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CertRequest"}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/requests/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/RequestID"}],
+      "get": {
+        "summary": "Inspect a certificate request",
+        "responses": {
+          "200": {"description": "Certificate request", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CertRequest"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/requests/{id}/approve": {
+      "parameters": [{"$ref": "#/components/parameters/RequestID"}],
+      "post": {
+        "summary": "Approve a pending request, it's approved once it has the number of distinct approvers required",
+        "responses": {
+          "200": {"description": "Certificate request", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CertRequest"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/requests/{id}/reject": {
+      "parameters": [{"$ref": "#/components/parameters/RequestID"}],
+      "post": {
+        "summary": "Reject a pending request",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "properties": {"reason": {"type": "string"}}}}}},
+        "responses": {
+          "200": {"description": "Certificate request", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CertRequest"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/requests/{id}/issue": {
+      "parameters": [{"$ref": "#/components/parameters/RequestID"}],
+      "post": {
+        "summary": "Issue the certificate of an approved request, only the requester may issue it",
+        "responses": {
+          "201": {"description": "Issued certificate", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IssueResponse"}}}},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {"200": {"description": "OpenAPI document", "content": {"application/json": {}}}}
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "Serial": {"name": "serial", "in": "path", "required": true, "description": "the certificate serial number in hexadecimal format", "schema": {"type": "string"}},
+      "RequestID": {"name": "id", "in": "path", "required": true, "description": "the certificate request id", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "IssueRequest": {
+        "type": "object",
+        "required": ["kind"],
+        "properties": {
+          "kind": {"type": "string", "enum": ["server", "client", "user", "code-signing"]},
+          "values": {"type": "object", "description": "the flags of the server-cert, client-cert, user-cert or code-signing-cert command by name, e.g {\"name\": \"example.com\", \"days-valid\": 90}", "additionalProperties": true}
+        }
+      },
+      "IssueResponse": {
+        "type": "object",
+        "properties": {
+          "serial": {"type": "string"},
+          "certificate": {"type": "string", "description": "PEM encoded certificate"},
+          "private_key": {"type": "string", "description": "PEM encoded private key"},
+          "ca": {"type": "string", "description": "PEM encoded CA certificate"}
+        }
+      },
+      "RevokeRequest": {
+        "type": "object",
+        "properties": {
+          "reason": {"type": "integer", "enum": [0, 1, 2, 3, 4, 5, 6, 8, 9, 10]},
+          "info": {"type": "string"}
+        }
+      },
+      "Certificate": {
+        "type": "object",
+        "properties": {
+          "serial": {"type": "string"},
+          "type": {"type": "string"},
+          "description": {"type": "string"},
+          "expiry": {"type": "string", "format": "date-time"},
+          "user": {"type": "string"},
+          "revocation": {"$ref": "#/components/schemas/Revocation"}
+        }
+      },
+      "CertRequest": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "kind": {"type": "string"},
+          "type": {"type": "string"},
+          "values": {"type": "object", "additionalProperties": true},
+          "requester": {"type": "string"},
+          "required_approvals": {"type": "integer"},
+          "approvers": {"type": "array", "items": {"type": "string"}},
+          "status": {"type": "string", "enum": ["pending", "approved", "rejected", "issued"]},
+          "reason": {"type": "string"},
+          "serial": {"type": "string"},
+          "renews": {"type": "string", "description": "the serial of the certificate revoked as superseded when the request is issued"},
+          "created": {"type": "string", "format": "date-time"},
+          "updated": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Revocation": {
+        "type": "object",
+        "properties": {
+          "reason": {"type": "integer"},
+          "info": {"type": "string"},
+          "revoked": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,431 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Formats in which the issuing commands save a certificate and its private key
+const (
+	OutputFormatPEM    = "pem"
+	OutputFormatDER    = "der"
+	OutputFormatPFX    = "pfx"
+	OutputFormatBundle = "bundle"
+)
+
+var outputFormats = []string{OutputFormatPEM, OutputFormatDER, OutputFormatPFX, OutputFormatBundle}
+
+// Targets where the issuing commands save a certificate and its private key
+const (
+	OutputTargetFiles        = "files"
+	OutputTargetK8sSecret    = "k8s-secret"
+	OutputTargetDockerSecret = "docker-secret"
+)
+
+var outputTargets = []string{OutputTargetFiles, OutputTargetK8sSecret, OutputTargetDockerSecret}
+
+// certificateOutput saves the certificates issued by a command in the format set with --format,
+// the CA certificates are added to the files if withChain is set
+type certificateOutput struct {
+	format     string
+	withChain  bool
+	encoder    *pkcs12.Encoder
+	pass       string
+	passOut    string
+	generated  bool
+	revealed   bool
+	target     string
+	namespace  string
+	secretName string
+	owner      *secretOwner
+}
+
+// secretOwner is the owner of the files written for Docker secrets, the user the service of the
+// container runs as
+type secretOwner struct {
+	uid int
+	gid int
+}
+
+// outputFile is a file written by an issuing command, private files hold the private key
+type outputFile struct {
+	filename string
+	data     []byte
+	perm     os.FileMode
+	private  bool
+}
+
+// newCertificateOutput reads the flags of outputFlags and pfxFlags, the chain is added by default to
+// the formats that are imported as a whole (pfx and bundle). The password of PFX files is random if
+// it's not set, it's shown once after the first file is written
+func newCertificateOutput(cCtx *cli.Context, defaultFormat string) (*certificateOutput, error) {
+	format := cCtx.String("format")
+	if format == "" {
+		format = defaultFormat
+	}
+	if !slices.Contains(outputFormats, format) {
+		return nil, fmt.Errorf("the format %q is not valid, use one of: %s", format, strings.Join(outputFormats, ", "))
+	}
+
+	// The environment variables only apply to the targets they're meant for, so they can be set for
+	// every command without breaking the ones that write files
+	target := cCtx.String("output")
+	if !cCtx.IsSet("output") && os.Getenv("CERT_OUTPUT") != "" {
+		target = os.Getenv("CERT_OUTPUT")
+	}
+	if target == "" {
+		target = OutputTargetFiles
+	}
+	if !slices.Contains(outputTargets, target) {
+		return nil, fmt.Errorf("the output %q is not valid, use one of: %s", target, strings.Join(outputTargets, ", "))
+	}
+
+	// A kubernetes.io/tls Secret holds the certificate and the key in PEM format
+	if target == OutputTargetK8sSecret {
+		if cCtx.IsSet("format") && format != OutputFormatPEM {
+			return nil, fmt.Errorf("the %s output only supports the pem format", OutputTargetK8sSecret)
+		}
+		format = OutputFormatPEM
+	}
+
+	namespace := cCtx.String("k8s-namespace")
+	if namespace != "" && target != OutputTargetK8sSecret {
+		return nil, fmt.Errorf("the Kubernetes namespace can only be set for the %s output", OutputTargetK8sSecret)
+	}
+	if namespace == "" && target == OutputTargetK8sSecret {
+		namespace = os.Getenv("K8S_NAMESPACE")
+	}
+	if namespace != "" && !isDNSLabel(namespace) {
+		return nil, fmt.Errorf("the Kubernetes namespace %q is not a valid DNS label", namespace)
+	}
+
+	secretName := cCtx.String("k8s-secret-name")
+	if secretName != "" && kubernetesName(secretName) != secretName {
+		return nil, fmt.Errorf("the Kubernetes Secret name %q must be a lowercase DNS subdomain", secretName)
+	}
+
+	encoder, err := pfxEncoder(cCtx.String("pfx-encoding"))
+	if err != nil {
+		return nil, err
+	}
+
+	pass, err := readPassword(cCtx, "pass")
+	if err != nil {
+		return nil, err
+	}
+
+	out := &certificateOutput{
+		format:     format,
+		withChain:  cCtx.Bool("chain") || (!cCtx.IsSet("chain") && (format == OutputFormatPFX || format == OutputFormatBundle)),
+		encoder:    encoder,
+		pass:       pass,
+		passOut:    cCtx.String("pass-out"),
+		target:     target,
+		namespace:  namespace,
+		secretName: secretName,
+	}
+	if format == OutputFormatPFX && out.pass == "" {
+		out.pass, out.generated = rand.Text(), true
+	}
+	if format == OutputFormatPFX && out.passOut != "" && !out.generated {
+		return nil, fmt.Errorf("the password is only written to %s when it's generated", out.passOut)
+	}
+
+	owner := cCtx.String("secret-owner")
+	if owner != "" && target != OutputTargetDockerSecret {
+		return nil, fmt.Errorf("the owner of the files can only be set for the %s output", OutputTargetDockerSecret)
+	}
+	if owner == "" && target == OutputTargetDockerSecret {
+		owner = os.Getenv("SECRET_OWNER")
+	}
+	if owner != "" {
+		o, err := parseSecretOwner(owner)
+		if err != nil {
+			return nil, err
+		}
+		out.owner = o
+	}
+	return out, nil
+}
+
+// parseSecretOwner parses an owner in uid:gid format, the group is the uid if it's not set
+func parseSecretOwner(owner string) (*secretOwner, error) {
+	uid, gid, hasGroup := strings.Cut(owner, ":")
+	if !hasGroup {
+		gid = uid
+	}
+
+	o := &secretOwner{}
+	var err error
+	if o.uid, err = strconv.Atoi(uid); err != nil || o.uid < 0 {
+		return nil, fmt.Errorf("the owner %q must be a numeric uid:gid e.g 1000:1000", owner)
+	}
+	if o.gid, err = strconv.Atoi(gid); err != nil || o.gid < 0 {
+		return nil, fmt.Errorf("the owner %q must be a numeric uid:gid e.g 1000:1000", owner)
+	}
+	return o, nil
+}
+
+// DefaultOutputFormat returns the format used by the command of a kind when --format is not set
+func DefaultOutputFormat(kind string) string {
+	switch kind {
+	case KindServer, KindClient:
+		return OutputFormatPEM
+	default:
+		return OutputFormatPFX
+	}
+}
+
+// Write saves the certificate and its private key with the name, chain are the certificates of the
+// issuer starting with the CA. It returns the file that holds the private key
+//
+//	pem     <name>.cer with the certificate and the chain, <name>.key with the PKCS#1 private key
+//	der     <name>.crt with the certificate, <name>.pk8 with the PKCS#8 private key and <name>.p7b with the chain
+//	pfx     <name>.pfx with the certificate, the chain and the private key
+//	bundle  <name>.pem with the certificate, the chain and the private key
+//
+// The k8s-secret output writes a <name>.yaml Secret manifest instead and the docker-secret output
+// makes the files read-only for their owner, the certificates can be read by anyone
+func (o *certificateOutput) Write(path, name string, cert *x509.Certificate, chain []*x509.Certificate, key *rsa.PrivateKey) (string, error) {
+	files, err := o.encode(path, name, cert, chain, key)
+	if err != nil {
+		return "", err
+	}
+
+	reveal := o.generated && !o.revealed
+	if reveal && o.passOut != "" {
+		files = append(files, outputFile{filename: o.passOut, data: []byte(o.pass + "\n"), perm: 0600, private: true})
+	}
+
+	keyFilename := ""
+	for _, f := range files {
+		if f.private && keyFilename == "" {
+			keyFilename = f.filename
+		}
+
+		switch o.target {
+		case OutputTargetDockerSecret:
+			err = o.writeSecretFile(f)
+		default:
+			err = writeOutputFile(f.filename, f.data, f.perm)
+			// os.WriteFile keeps the permissions of a file that already exists
+			if err == nil && f.private {
+				if err = os.Chmod(f.filename, f.perm); err != nil {
+					err = fmt.Errorf("could not set the permissions of %s, reason: %s", f.filename, err.Error())
+				}
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Several certificates written by the same command share the generated password
+	if reveal {
+		o.revealed = true
+		if o.passOut == "" {
+			if err := revealPassword(o.pass, ""); err != nil {
+				return "", err
+			}
+		}
+	}
+	return keyFilename, nil
+}
+
+func (o *certificateOutput) encode(path, name string, cert *x509.Certificate, chain []*x509.Certificate, key *rsa.PrivateKey) ([]outputFile, error) {
+	caCerts := chain
+	if !o.withChain {
+		chain = nil
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	if o.target == OutputTargetK8sSecret {
+		secretName := o.secretName
+		if secretName == "" {
+			secretName = kubernetesName(name)
+		}
+		manifest := kubernetesTLSSecret(secretName, o.namespace, encodeCertificates(append([]*x509.Certificate{cert}, chain...)...), keyPEM, encodeCertificates(caCerts...))
+		return []outputFile{{filename: filepath.Join(path, name+".yaml"), data: manifest, perm: 0600, private: true}}, nil
+	}
+
+	switch o.format {
+	case OutputFormatDER:
+		files := []outputFile{{filename: filepath.Join(path, name+".crt"), data: cert.Raw, perm: 0644}}
+		if len(chain) > 0 {
+			p7b, err := degeneratePKCS7(append([]*x509.Certificate{cert}, chain...), nil)
+			if err != nil {
+				return nil, fmt.Errorf("could not encode the certificate chain, reason: %s", err.Error())
+			}
+			files = append(files, outputFile{filename: filepath.Join(path, name+".p7b"), data: p7b, perm: 0644})
+		}
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode the private key, reason: %s", err.Error())
+		}
+		return append(files, outputFile{filename: filepath.Join(path, name+".pk8"), data: keyBytes, perm: 0600, private: true}), nil
+	case OutputFormatPFX:
+		pfxBytes, err := o.encoder.Encode(key, cert, chain, o.pass)
+		if err != nil {
+			return nil, err
+		}
+		return []outputFile{{filename: filepath.Join(path, name+".pfx"), data: pfxBytes, perm: 0600, private: true}}, nil
+	case OutputFormatBundle:
+		data := append(encodeCertificates(append([]*x509.Certificate{cert}, chain...)...), keyPEM...)
+		return []outputFile{{filename: filepath.Join(path, name+".pem"), data: data, perm: 0600, private: true}}, nil
+	default:
+		certFilename, keyFilename := o.PEMFiles(path, name)
+		return []outputFile{
+			{filename: certFilename, data: encodeCertificates(append([]*x509.Certificate{cert}, chain...)...), perm: 0644},
+			{filename: keyFilename, data: keyPEM, perm: 0600, private: true},
+		}, nil
+	}
+}
+
+// writeSecretFile writes a file for Docker secrets, files with a private key can only be read by
+// their owner. The file is removed first as a read-only file can't be opened for writing
+func (o *certificateOutput) writeSecretFile(f outputFile) error {
+	perm := os.FileMode(0444)
+	if f.private {
+		perm = 0400
+	}
+
+	if err := os.Remove(f.filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not replace %s, reason: %s", f.filename, err.Error())
+	}
+	if err := writeOutputFile(f.filename, f.data, perm); err != nil {
+		return err
+	}
+	// The umask doesn't apply to chmod so the permissions are always the same
+	if err := os.Chmod(f.filename, perm); err != nil {
+		return fmt.Errorf("could not set the permissions of %s, reason: %s", f.filename, err.Error())
+	}
+	if o.owner != nil {
+		if err := os.Chown(f.filename, o.owner.uid, o.owner.gid); err != nil {
+			return fmt.Errorf("could not set the owner of %s, reason: %s", f.filename, err.Error())
+		}
+	}
+	return nil
+}
+
+// kubernetesTLSSecret returns the manifest of a kubernetes.io/tls Secret
+// Ref: https://kubernetes.io/docs/concepts/configuration/secret/#tls-secrets
+func kubernetesTLSSecret(name, namespace string, certPEM, keyPEM, caPEM []byte) []byte {
+	var b strings.Builder
+	b.WriteString("apiVersion: v1\nkind: Secret\nmetadata:\n")
+	fmt.Fprintf(&b, "  name: %s\n", name)
+	if namespace != "" {
+		fmt.Fprintf(&b, "  namespace: %s\n", namespace)
+	}
+	b.WriteString("  labels:\n    app.kubernetes.io/managed-by: openuem-cert-manager\n")
+	b.WriteString("type: kubernetes.io/tls\ndata:\n")
+	fmt.Fprintf(&b, "  tls.crt: %s\n", base64.StdEncoding.EncodeToString(certPEM))
+	fmt.Fprintf(&b, "  tls.key: %s\n", base64.StdEncoding.EncodeToString(keyPEM))
+	fmt.Fprintf(&b, "  ca.crt: %s\n", base64.StdEncoding.EncodeToString(caPEM))
+	return []byte(b.String())
+}
+
+// kubernetesName returns a valid object name (DNS subdomain) from the name of the files
+func kubernetesName(name string) string {
+	n := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		default:
+			return '-'
+		}
+	}, name)
+
+	n = strings.Trim(n, "-.")
+	if len(n) > 253 {
+		n = strings.TrimRight(n[:253], "-.")
+	}
+	if n == "" {
+		n = "certificate"
+	}
+	return n
+}
+
+// isDNSLabel reports if s is a lowercase RFC 1123 label, as Kubernetes namespaces must be
+func isDNSLabel(s string) bool {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// PEMFiles returns the certificate and private key files written in the pem format
+func (o *certificateOutput) PEMFiles(path, name string) (string, string) {
+	return filepath.Join(path, name+".cer"), filepath.Join(path, name+".key")
+}
+
+func writeOutputFile(filename string, data []byte, perm os.FileMode) error {
+	if err := os.WriteFile(filename, data, perm); err != nil {
+		return fmt.Errorf("could not save %s, reason: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// outputFlags are shared by the commands that issue certificates, chainByDefault adds the chain
+// whatever the format is
+func outputFlags(defaultFormat string, chainByDefault bool) []cli.Flag {
+	formatDefault, chainDefault := defaultFormat, "true for pfx and bundle, false for pem and der"
+	if defaultFormat == "" {
+		formatDefault = "pem for server and client certificates, pfx for user and code signing certificates"
+	}
+	if chainByDefault {
+		chainDefault = "true"
+	}
+
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:        "format",
+			Value:       defaultFormat,
+			Usage:       "the format of the certificate and its private key: pem (.cer and .key files), der (.crt and .pk8 files), pfx (a PKCS#12 file) or bundle (a .pem file with the certificate, the chain and the private key)",
+			DefaultText: formatDefault,
+		},
+		&cli.BoolFlag{
+			Name:        "chain",
+			Value:       chainByDefault,
+			Usage:       "add the CA certificate, and the certificates that follow it in the CA certificate file, to the certificate file",
+			DefaultText: chainDefault,
+		},
+		&cli.StringFlag{
+			Name:        "output",
+			Usage:       "where the certificate is saved: files, k8s-secret (a kubernetes.io/tls Secret manifest with ca.crt) or docker-secret (files only readable by their owner for Docker or Compose secrets), the CERT_OUTPUT environment variable is used if it's not set",
+			DefaultText: OutputTargetFiles,
+		},
+		&cli.StringFlag{
+			Name:  "k8s-namespace",
+			Usage: "the namespace of the Kubernetes Secret, the K8S_NAMESPACE environment variable is used for the k8s-secret output if it's not set",
+		},
+		&cli.StringFlag{
+			Name:  "k8s-secret-name",
+			Usage: "the name of the Kubernetes Secret (default: the name of the files)",
+		},
+		&cli.StringFlag{
+			Name:  "secret-owner",
+			Usage: "the numeric uid:gid that will own the files of the docker-secret output, the user the container runs as. The SECRET_OWNER environment variable is used for the docker-secret output if it's not set",
+		},
+	}, pfxFlags()...)
+}
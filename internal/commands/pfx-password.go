@@ -0,0 +1,258 @@
+package commands
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Encodings of the PKCS#12 files, the legacy ones are read by Windows before Windows 10 1709 and
+// Windows Server 2016, OpenSSL 1.0 and old Java versions
+const (
+	PFXEncodingModern    = "modern"
+	PFXEncodingLegacy    = "legacy"
+	PFXEncodingLegacyRC2 = "legacy-rc2"
+)
+
+var pfxEncodings = []string{PFXEncodingModern, PFXEncodingLegacy, PFXEncodingLegacyRC2}
+
+func PFXPassword() *cli.Command {
+	return &cli.Command{
+		Name:   "pfx-password",
+		Usage:  "Change the password of a PKCS12 file in PFX format, a random password is generated if no new password is set",
+		Action: changePFXPassword,
+		Flags:  changePFXPasswordFlags(),
+	}
+}
+
+func changePFXPassword(cCtx *cli.Context) (err error) {
+	model, err := openAuditModel(cCtx)
+	if err != nil {
+		return err
+	}
+	if model != nil {
+		defer model.Close()
+	}
+
+	serial := int64(0)
+	defer func() { recordCLIAudit(cCtx, model, serial, err) }()
+
+	encoder, err := pfxEncoder(cCtx.String("pfx-encoding"))
+	if err != nil {
+		return err
+	}
+
+	if cCtx.Bool("pass-stdin") && cCtx.Bool("new-pass-stdin") {
+		return fmt.Errorf("the current and the new password can't both be read from the standard input")
+	}
+
+	pass, err := readPassword(cCtx, "pass")
+	if err != nil {
+		return err
+	}
+	if pass == "" {
+		pass = pkcs12.DefaultPassword
+	}
+
+	newPass, err := readPassword(cCtx, "new-pass")
+	if err != nil {
+		return err
+	}
+	generated := newPass == ""
+	if generated {
+		newPass = rand.Text()
+	} else if cCtx.String("pass-out") != "" {
+		return fmt.Errorf("the password is only written to %s when it's generated", cCtx.String("pass-out"))
+	}
+
+	in := cCtx.String("in")
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return fmt.Errorf("could not read %s, reason: %s", in, err.Error())
+	}
+
+	log.Printf("... decoding %s", in)
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, pass)
+	if err != nil {
+		return fmt.Errorf("could not decode %s, reason: %s", in, err.Error())
+	}
+	serial = cert.SerialNumber.Int64()
+
+	log.Printf("... encoding the PFX file with the new password")
+	pfxBytes, err := encoder.Encode(key, cert, caCerts, newPass)
+	if err != nil {
+		return fmt.Errorf("could not encode the PFX file, reason: %s", err.Error())
+	}
+
+	out := cCtx.String("out")
+	if out == "" {
+		out = in
+	}
+	log.Printf("... saving the PFX file to %s", out)
+	if err := replaceFile(out, pfxBytes); err != nil {
+		return err
+	}
+	recordKeyExport(model, cliActor(), serial, out)
+
+	if generated {
+		if err := revealPassword(newPass, cCtx.String("pass-out")); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("✅ Done! The password of %s has been changed\n\n", out)
+	return nil
+}
+
+// pfxEncoder returns the PKCS#12 encoder of an encoding
+func pfxEncoder(encoding string) (*pkcs12.Encoder, error) {
+	switch encoding {
+	case "", PFXEncodingModern:
+		return pkcs12.Modern, nil
+	case PFXEncodingLegacy:
+		return pkcs12.Legacy, nil
+	case PFXEncodingLegacyRC2:
+		return pkcs12.LegacyRC2, nil
+	default:
+		return nil, fmt.Errorf("the PFX encoding %q is not valid, use one of: %s", encoding, strings.Join(pfxEncodings, ", "))
+	}
+}
+
+// readPassword returns the password set with --<name>, --<name>-file or --<name>-stdin, the file
+// and the standard input keep it out of the command line and the shell history. It returns an
+// empty string if none is set
+func readPassword(cCtx *cli.Context, name string) (string, error) {
+	set := slices.DeleteFunc([]string{name, name + "-file", name + "-stdin"}, func(flag string) bool { return !cCtx.IsSet(flag) })
+	if len(set) > 1 {
+		return "", fmt.Errorf("only one of --%s, --%s-file and --%s-stdin can be set", name, name, name)
+	}
+
+	switch {
+	case cCtx.String(name+"-file") != "":
+		data, err := os.ReadFile(cCtx.String(name + "-file"))
+		if err != nil {
+			return "", fmt.Errorf("could not read the password file, reason: %s", err.Error())
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case cCtx.Bool(name + "-stdin"):
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("could not read the password from the standard input, reason: %s", err.Error())
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	default:
+		return cCtx.String(name), nil
+	}
+}
+
+// revealPassword writes a generated password to the file or prints it on the standard output,
+// it's never logged so it's shown only once
+func revealPassword(password, filename string) error {
+	if filename != "" {
+		log.Printf("... saving the generated password to %s", filename)
+		if err := writeOutputFile(filename, []byte(password+"\n"), 0600); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	log.Printf("... the generated password is printed on the standard output, it won't be shown again")
+	fmt.Println(password)
+	return nil
+}
+
+// replaceFile writes the file to a temporary file in the same folder and renames it, so the file
+// is never left half written. An existing file keeps its permissions, a new one is only readable by
+// its owner as it holds a private key
+func replaceFile(filename string, data []byte) error {
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("could not save %s, reason: %s", filename, err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save %s, reason: %s", filename, err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save %s, reason: %s", filename, err.Error())
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("could not save %s, reason: %s", filename, err.Error())
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("could not save %s, reason: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// passwordFlags are the flags to read the password of the --<name> flag from a file or the
+// standard input
+func passwordFlags(name string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  name + "-file",
+			Usage: fmt.Sprintf("the path to a file with the password of --%s in its first line", name),
+		},
+		&cli.BoolFlag{
+			Name:  name + "-stdin",
+			Usage: fmt.Sprintf("read the password of --%s from the first line of the standard input", name),
+		},
+	}
+}
+
+// pfxFlags are the flags of the PFX files written by the issuing commands
+func pfxFlags() []cli.Flag {
+	return append(passwordFlags("pass"),
+		&cli.StringFlag{
+			Name:  "pass-out",
+			Usage: "the path to a file where the generated password of the PFX file is saved instead of printing it",
+		},
+		&cli.StringFlag{
+			Name:  "pfx-encoding",
+			Value: PFXEncodingModern,
+			Usage: "the encryption of the PFX file: modern (AES-256 and SHA-256), legacy (3DES and SHA-1) or legacy-rc2 (RC2-40 and 3DES) for old Windows, OpenSSL and Java versions",
+		},
+	)
+}
+
+func changePFXPasswordFlags() []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:     "in",
+			Usage:    "the path to the PFX file",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "the path where the PFX file with the new password will be stored (default: the PFX file is replaced)",
+		},
+		&cli.StringFlag{
+			Name:  "pass",
+			Usage: "the current password of the PFX file (default: changeit)",
+		},
+		&cli.StringFlag{
+			Name:  "new-pass",
+			Usage: "the new password of the PFX file (default: a random password)",
+		},
+	}
+	flags = append(flags, pfxFlags()...)
+	flags = append(flags, passwordFlags("new-pass")...)
+	return append(flags, auditDBURLFlag())
+}
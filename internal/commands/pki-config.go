@@ -0,0 +1,186 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/urfave/cli/v2"
+)
+
+// pkiConfigSettings maps the flags of the PKI settings to their names in database
+var pkiConfigSettings = map[string]string{
+	"crl-url":        models.ConfigCRLURL,
+	"ca-issuers-url": models.ConfigCAIssuersURL,
+}
+
+func PKIConfig() *cli.Command {
+	return &cli.Command{
+		Name:  "pki-config",
+		Usage: "Manage the settings shared by every command that issues certificates",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "set",
+				Usage:  "Store the CRL and CA issuers URLs added to the certificates and the types that must be approved, an empty value removes a setting",
+				Action: setPKIConfig,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "crl-url",
+						Usage: "comma-separated string containing the URLs where the CRL can be downloaded, e.g http://pki.example.com/crl/ca.crl (CRL Distribution Points)",
+					},
+					&cli.StringFlag{
+						Name:  "ca-issuers-url",
+						Usage: "comma-separated string containing the URLs where the CA certificate can be downloaded, e.g http://pki.example.com/ca.cer (Authority Information Access)",
+					},
+					&cli.StringFlag{
+						Name:  "approval-types",
+						Usage: fmt.Sprintf("comma-separated list of the certificate types that must be approved before they're issued or %s, if not set %s", noApprovalTypes, strings.Join(DefaultApprovalTypes, ",")),
+					},
+					dbURLFlag(),
+				},
+			},
+			{
+				Name:   "show",
+				Usage:  "Show the stored settings",
+				Action: showPKIConfig,
+				Flags:  []cli.Flag{dbURLFlag()},
+			},
+		},
+	}
+}
+
+func setPKIConfig(cCtx *cli.Context) (err error) {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+	defer func() { recordCLIAudit(cCtx, model, 0, err) }()
+
+	for flag, name := range pkiConfigSettings {
+		if !cCtx.IsSet(flag) {
+			continue
+		}
+		if err := validatePKIURLs(cCtx.String(flag)); err != nil {
+			return err
+		}
+		if err := model.SetConfig(name, cCtx.String(flag)); err != nil {
+			return fmt.Errorf("could not save %s, reason: %s", flag, err.Error())
+		}
+	}
+
+	if cCtx.IsSet("approval-types") {
+		if err := model.SetConfig(models.ConfigApprovalTypes, cCtx.String("approval-types")); err != nil {
+			return fmt.Errorf("could not save approval-types, reason: %s", err.Error())
+		}
+	}
+
+	log.Printf("✅ Done! The PKI settings have been saved\n\n")
+	return nil
+}
+
+func showPKIConfig(cCtx *cli.Context) error {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	for _, flag := range []string{"crl-url", "ca-issuers-url"} {
+		value, err := model.GetConfig(pkiConfigSettings[flag])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", flag, value)
+	}
+
+	approvalTypes, err := ApprovalTypes(model)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("approval-types: %s\n", strings.Join(approvalTypes, ","))
+	return nil
+}
+
+// loadPKIConfig sets the PKI settings stored in database for the flags that haven't been set in
+// the command-line, model may be nil for commands where the database is optional
+func loadPKIConfig(cCtx *cli.Context, model *models.Model) error {
+	for flag, name := range pkiConfigSettings {
+		if cCtx.IsSet(flag) || model == nil {
+			continue
+		}
+
+		value, err := model.GetConfig(name)
+		if err != nil {
+			return fmt.Errorf("could not read %s from database, reason: %s", flag, err.Error())
+		}
+		if value != "" {
+			if err := cCtx.Set(flag, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	for flag := range pkiConfigSettings {
+		if err := validatePKIURLs(cCtx.String(flag)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validatePKIURLs(urls string) error {
+	for _, s := range splitSANs(urls) {
+		u, err := url.Parse(s)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("%q is not a valid absolute URL", s)
+		}
+	}
+	return nil
+}
+
+// PKIURLs are added to the certificates so clients can download the CRL and the certificate of the issuer
+type PKIURLs struct {
+	CRL       []string
+	CAIssuers []string
+}
+
+func pkiURLs(v Values) PKIURLs {
+	return PKIURLs{CRL: splitSANs(v.String("crl-url")), CAIssuers: splitSANs(v.String("ca-issuers-url"))}
+}
+
+// pkiConfigValues takes the PKI settings of a certificate from the issuer, e.g. so an API client
+// can't choose the URLs of the CRL
+type pkiConfigValues struct {
+	Values
+	config Values
+}
+
+func withPKIConfig(v Values, config Values) Values {
+	return &pkiConfigValues{Values: v, config: config}
+}
+
+func (p *pkiConfigValues) String(name string) string {
+	if _, ok := pkiConfigSettings[name]; ok {
+		return p.config.String(name)
+	}
+	return p.Values.String(name)
+}
+
+// pkiConfigFlags are shared by the commands and servers that issue certificates
+func pkiConfigFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "crl-url",
+			Usage:   "comma-separated string containing the URLs where the CRL can be downloaded (CRL Distribution Points), if not set the URL saved with pki-config is used",
+			EnvVars: []string{"CRL_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "ca-issuers-url",
+			Usage:   "comma-separated string containing the URLs where the CA certificate can be downloaded (Authority Information Access), if not set the URL saved with pki-config is used",
+			EnvVars: []string{"CA_ISSUERS_URL"},
+		},
+	}
+}
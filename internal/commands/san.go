@@ -0,0 +1,263 @@
+package commands
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/chmike/domain"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	// oidUPN is the Microsoft user principal name otherName
+	oidUPN = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+// SubjectAltNames are the IP addresses, URIs and email addresses of a certificate, DNS names are
+// set by the server certificate template
+type SubjectAltNames struct {
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	EmailAddresses []string
+}
+
+// subjectAltNames validates the SANs set in the ip-sans, uri-sans and email-sans flags
+func subjectAltNames(v Values) (*SubjectAltNames, error) {
+	ips, err := validateIPSANs(v.String("ip-sans"))
+	if err != nil {
+		return nil, err
+	}
+
+	uris, err := validateURISANs(v.String("uri-sans"))
+	if err != nil {
+		return nil, err
+	}
+
+	emails, err := validateEmailSANs(v.String("email-sans"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SubjectAltNames{IPAddresses: ips, URIs: uris, EmailAddresses: emails}, nil
+}
+
+func (s *SubjectAltNames) apply(cert *x509.Certificate) {
+	cert.IPAddresses = append(cert.IPAddresses, s.IPAddresses...)
+	cert.URIs = append(cert.URIs, s.URIs...)
+	cert.EmailAddresses = append(cert.EmailAddresses, s.EmailAddresses...)
+}
+
+// validateDNSNames validates a comma-separated list of DNS names, a name may be given as a URL or
+// host:port and only its host is kept
+func validateDNSNames(dnsNames string) ([]string, error) {
+	names := []string{}
+	for _, name := range splitSANs(dnsNames) {
+		host := name
+		if net.ParseIP(name) == nil {
+			if strings.Contains(name, "://") {
+				u, err := url.Parse(name)
+				if err != nil {
+					return nil, fmt.Errorf("the DNS name %q is not a valid URL, reason: %v", name, err)
+				}
+				host = u.Hostname()
+			} else if h, _, err := net.SplitHostPort(name); err == nil {
+				host = h
+			}
+		}
+
+		if err := validateDNSName(host); err != nil {
+			return nil, err
+		}
+		names = append(names, host)
+	}
+	return names, nil
+}
+
+// validateDNSName checks a DNS name, a wildcard must be the whole left-most label and can't
+// cover a top-level domain
+// Ref: https://datatracker.ietf.org/doc/html/rfc6125#section-6.4.3
+func validateDNSName(name string) error {
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("the DNS name %q is an IP address, use --ip-sans instead", name)
+	}
+
+	base := name
+	if strings.Contains(name, "*") {
+		base = strings.TrimPrefix(name, "*.")
+		if strings.Contains(base, "*") {
+			return fmt.Errorf("the DNS name %q is not valid, a wildcard must be the whole left-most label e.g *.example.com", name)
+		}
+		if !strings.Contains(base, ".") {
+			return fmt.Errorf("the DNS name %q is not valid, a wildcard can't cover a top-level domain", name)
+		}
+	}
+
+	if err := domain.Check(base); err != nil {
+		return fmt.Errorf("the DNS name %q is not valid, reason: %v", name, err)
+	}
+	return nil
+}
+
+func validateIPSANs(ipSANs string) ([]net.IP, error) {
+	ips := []net.IP{}
+	for _, s := range splitSANs(ipSANs) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("the IP SAN %q is not a valid IPv4 or IPv6 address", s)
+		}
+		if ip.IsUnspecified() {
+			return nil, fmt.Errorf("the IP SAN %q is the unspecified address", s)
+		}
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// validateURISANs checks that every URI is absolute and has no wildcards, e.g urn:openuem:agent:<id>
+// or spiffe://example.com/agent
+// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-4.2.1.6
+func validateURISANs(uriSANs string) ([]*url.URL, error) {
+	uris := []*url.URL{}
+	for _, s := range splitSANs(uriSANs) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("the URI SAN %q is not valid, reason: %v", s, err)
+		}
+		if u.Scheme == "" {
+			return nil, fmt.Errorf("the URI SAN %q has no scheme", s)
+		}
+		if u.Opaque == "" && u.Host == "" {
+			return nil, fmt.Errorf("the URI SAN %q has no host", s)
+		}
+		if strings.Contains(s, "*") {
+			return nil, fmt.Errorf("the URI SAN %q can't contain wildcards", s)
+		}
+		if u.Host != "" && net.ParseIP(u.Hostname()) == nil {
+			if err := domain.Check(u.Hostname()); err != nil {
+				return nil, fmt.Errorf("the host of the URI SAN %q is not valid, reason: %v", s, err)
+			}
+		}
+		uris = append(uris, u)
+	}
+	return uris, nil
+}
+
+// validateEmailSANs checks that every address is a bare mailbox, e.g user@example.com
+// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-4.2.1.6
+func validateEmailSANs(emailSANs string) ([]string, error) {
+	emails := []string{}
+	for _, s := range splitSANs(emailSANs) {
+		addr, err := mail.ParseAddress(s)
+		if err != nil || addr.Address != s || addr.Name != "" {
+			return nil, fmt.Errorf("the email SAN %q is not a valid email address, e.g user@example.com", s)
+		}
+		if strings.Contains(s, "*") {
+			return nil, fmt.Errorf("the email SAN %q can't contain wildcards", s)
+		}
+
+		_, host, _ := strings.Cut(s, "@")
+		if err := domain.Check(host); err != nil {
+			return nil, fmt.Errorf("the domain of the email SAN %q is not valid, reason: %v", s, err)
+		}
+		emails = append(emails, s)
+	}
+	return emails, nil
+}
+
+// validateUPN checks a Windows user principal name, e.g user@example.com. The suffix is the DNS name
+// of the domain or a UPN suffix added to the forest
+// Ref: https://learn.microsoft.com/en-us/windows/win32/ad/naming-properties#userprincipalname
+func validateUPN(upn string) error {
+	user, suffix, ok := strings.Cut(upn, "@")
+	if !ok || user == "" || strings.Contains(suffix, "@") {
+		return fmt.Errorf("the UPN %q is not valid, e.g user@example.com", upn)
+	}
+	if strings.ContainsAny(user, " \"/\\[]:;|=,+*?<>") {
+		return fmt.Errorf("the UPN %q contains characters not allowed in a user name", upn)
+	}
+	if err := domain.Check(suffix); err != nil {
+		return fmt.Errorf("the suffix of the UPN %q is not valid, reason: %v", upn, err)
+	}
+	return nil
+}
+
+// subjectAltNameExtension encodes the SANs of a certificate and a UPN otherName, Go can't encode
+// otherName so the extension replaces the one it would create
+// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-4.2.1.6
+func subjectAltNameExtension(cert *x509.Certificate, upn string) (pkix.Extension, error) {
+	utf8UPN, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(upn)})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	otherName, err := asn1.MarshalWithParams(struct {
+		TypeID asn1.ObjectIdentifier
+		Value  asn1.RawValue
+	}{
+		TypeID: oidUPN,
+		Value:  asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: utf8UPN},
+	}, "tag:0")
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+
+	names := []asn1.RawValue{{FullBytes: otherName}}
+	for _, email := range cert.EmailAddresses {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: []byte(email)})
+	}
+	for _, dnsName := range cert.DNSNames {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte(dnsName)})
+	}
+	for _, u := range cert.URIs {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(u.String())})
+	}
+	for _, ip := range cert.IPAddresses {
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 7, Bytes: ip})
+	}
+
+	value, err := asn1.Marshal(names)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidSubjectAltName, Value: value}, nil
+}
+
+func splitSANs(sans string) []string {
+	values := []string{}
+	for _, s := range strings.Split(sans, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// sanFlags are shared by the commands that issue server, client and user certificates
+func sanFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "ip-sans",
+			Usage: "comma-separated string containing the IP addresses associated with this certificate e.g 192.168.1.10,fd00::10 (Subject Alternative Name)",
+		},
+		&cli.StringFlag{
+			Name:  "uri-sans",
+			Usage: "comma-separated string containing the URIs associated with this certificate e.g urn:openuem:agent:1234 (Subject Alternative Name)",
+		},
+		&cli.StringFlag{
+			Name:  "email-sans",
+			Usage: "comma-separated string containing the email addresses associated with this certificate e.g user@example.com (Subject Alternative Name)",
+		},
+	}
+}
@@ -0,0 +1,353 @@
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/openuem-cert-manager/internal/acme"
+	"github.com/open-uem/openuem-cert-manager/internal/authz"
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func ServeACME() *cli.Command {
+	return &cli.Command{
+		Name:   "serve-acme",
+		Usage:  "Start an ACME (RFC 8555) server so internal services can get and renew their server certificates automatically",
+		Action: serveACME,
+		Flags:  serveACMEFlags(),
+	}
+}
+
+func ACMEApproval() *cli.Command {
+	return &cli.Command{
+		Name:  "acme-approval",
+		Usage: "Manage the ACME authorizations waiting for an operator approval (" + acme.ChallengeApproval + " challenge)",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the authorizations waiting for approval",
+				Action: listACMEApprovals,
+				Flags:  []cli.Flag{dbURLFlag()},
+			},
+			{
+				Name:   "approve",
+				Usage:  "Approve an authorization so the ACME client can finalize its order",
+				Action: func(cCtx *cli.Context) error { return resolveACMEApproval(cCtx, true) },
+				Flags:  acmeApprovalFlags(),
+			},
+			{
+				Name:   "reject",
+				Usage:  "Reject an authorization",
+				Action: func(cCtx *cli.Context) error { return resolveACMEApproval(cCtx, false) },
+				Flags:  acmeApprovalFlags(),
+			},
+		},
+	}
+}
+
+func serveACME(cCtx *cli.Context) error {
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	log.Printf("... reading CA cert PEM file")
+	caCert, err := utils.ReadPEMCertificate(cCtx.String("cacert"))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
+	if err != nil {
+		return err
+	}
+
+	certType := certificate.Type(cCtx.String("type"))
+	if err := certificate.TypeValidator(certType); err != nil {
+		return err
+	}
+
+	authorizer, err := authz.NewAuthorizer(cCtx.String("policy"), model)
+	if err != nil {
+		return err
+	}
+
+	certPolicy, err := certpolicy.LoadOptional(cCtx.String("cert-policy"))
+	if err != nil {
+		return err
+	}
+
+	if err := loadPKIConfig(cCtx, model); err != nil {
+		return err
+	}
+
+	issue := func(accountID string, csr *x509.CertificateRequest, names []string) ([]byte, int64, error) {
+		cert, err := NewX509Certificate(cCtx, names, caCert)
+		if err != nil {
+			return nil, 0, err
+		}
+		cert.Subject.CommonName = names[0]
+
+		if err := certPolicy.Enforce(string(certType), cert, csr.PublicKey, caCert); err != nil {
+			return nil, 0, err
+		}
+
+		certBytes, cert, err := signCertificate(cert, csr.PublicKey, caCert, caPrivKey)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		description := cCtx.String("description")
+		if description == "" {
+			description = fmt.Sprintf("ACME %s", names[0])
+		}
+		err = model.SaveCertificate(cert.SerialNumber.Int64(), certType, description, cert.NotAfter, false, "")
+		recordAudit(model, authz.ACMEIdentity(accountID), "serve-acme finalize", map[string]any{"type": string(certType), "names": names}, cert.SerialNumber.Int64(), err)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+		return chain, cert.SerialNumber.Int64(), nil
+	}
+
+	revoke := func(accountID string, serial int64, reason int) error {
+		// A request signed with the certificate key proves possession of the key, it needs no account
+		identity := "acme:certificate-key"
+		info := "revoked with the certificate key"
+		if accountID != "" {
+			identity = authz.ACMEIdentity(accountID)
+			info = "revoked by ACME account " + accountID
+			if err := authorizer.Authorize(identity, authz.ActionRevoke, string(certType), fmt.Sprintf("%x", serial)); err != nil {
+				return err
+			}
+		}
+
+		err := model.AddRevocation(serial, reason, info)
+		recordAudit(model, identity, "serve-acme revoke", map[string]any{"reason": reason}, serial, err)
+		return err
+	}
+
+	s := &acme.Server{
+		BaseURL:  cCtx.String("external-url"),
+		Store:    model,
+		Issue:    issue,
+		Revoke:   revoke,
+		CertType: string(certType),
+		HTTPPort: cCtx.String("http-port"),
+		Authorize: func(accountID string, names []string) error {
+			return authorizer.Authorize(authz.ACMEIdentity(accountID), authz.ActionIssue, string(certType), strings.Join(names, ","))
+		},
+	}
+
+	srv := &http.Server{
+		Addr:      cCtx.String("listen"),
+		Handler:   s.Handler(),
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+
+	log.Printf("... listening for ACME requests on %s, directory at %s/acme/directory", srv.Addr, cCtx.String("external-url"))
+	return runHTTPServer(srv, cCtx.String("tls-cert"), cCtx.String("tls-key"))
+}
+
+func listACMEApprovals(cCtx *cli.Context) error {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	authzs, err := model.GetACMEAuthorizationsByChallenge(acme.ChallengeApproval, acme.StatusProcessing)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tIDENTIFIER\tTYPE\tACCOUNT\tEXPIRES")
+	for _, a := range authzs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", a.ID, a.Identifier.Value, a.CertType, a.AccountID, a.Expires.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func resolveACMEApproval(cCtx *cli.Context, approve bool) (err error) {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	command := "acme-approval reject"
+	if approve {
+		command = "acme-approval approve"
+	}
+	params := cliParameters(cCtx)
+	defer func() { recordAudit(model, cliActor(), command, params, 0, err) }()
+
+	authorizer, err := authz.NewAuthorizer(cCtx.String("policy"), model)
+	if err != nil {
+		return err
+	}
+
+	a, err := model.GetACMEAuthorization(cCtx.String("id"))
+	if err != nil {
+		return fmt.Errorf("could not find the authorization, reason: %s", err.Error())
+	}
+	params["identifier"] = a.Identifier.Value
+	params["account"] = a.AccountID
+
+	if a.ChallengeType != acme.ChallengeApproval || a.ChallengeStatus != acme.StatusProcessing {
+		return fmt.Errorf("the authorization is not waiting for an approval")
+	}
+
+	// The type is the one of the ACME server that created the authorization, not one the approver chooses
+	if a.CertType == "" {
+		return fmt.Errorf("the authorization has no certificate type, the ACME client must create a new order")
+	}
+	params["type"] = a.CertType
+	if err := authorizer.Authorize(cliActor(), authz.ActionApprove, a.CertType, a.Identifier.Value); err != nil {
+		return err
+	}
+
+	if approve {
+		now := time.Now()
+		a.Status = acme.StatusValid
+		a.ChallengeStatus = acme.StatusValid
+		a.Validated = &now
+	} else {
+		a.Status = acme.StatusInvalid
+		a.ChallengeStatus = acme.StatusInvalid
+		a.Error = "rejected by " + cliActor()
+	}
+
+	if err := model.UpdateACMEAuthorization(a); err != nil {
+		return err
+	}
+
+	log.Printf("✅ Done! The authorization for %s is now %s\n\n", a.Identifier.Value, a.Status)
+	return nil
+}
+
+func acmeApprovalFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "id",
+			Usage:    "the authorization id as shown by the list command",
+			Required: true,
+		},
+		policyFlag(),
+		dbURLFlag(),
+	}
+}
+
+func serveACMEFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "cacert",
+			Usage:    "the path to your CA certificate file in PEM format",
+			EnvVars:  []string{"CA_CRT_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cakey",
+			Usage:    "the path to your CA private key file in PEM format",
+			EnvVars:  []string{"CA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: ":8448",
+			Usage: "the address where the ACME server listens",
+		},
+		&cli.StringFlag{
+			Name:     "external-url",
+			Usage:    "the URL ACME clients use to reach this server, e.g https://acme.example.com:8448",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "the path to the ACME server certificate in PEM format",
+		},
+		&cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "the path to the ACME server private key in PEM format",
+		},
+		&cli.StringFlag{
+			Name:  "http-port",
+			Value: "80",
+			Usage: "the port used to fetch http-01 challenges",
+		},
+		&cli.StringFlag{
+			Name:  "type",
+			Value: "proxy",
+			Usage: "OpenUEM type assigned to the certificates issued (one of 'console', 'proxy', 'ocsp' or 'nats')",
+		},
+		&cli.StringFlag{
+			Name:  "description",
+			Value: "",
+			Usage: "an optional description for the certificates issued, the first DNS name is used by default",
+		},
+		&cli.StringFlag{
+			Name:  "org",
+			Usage: "organization name associated with this CA",
+		},
+		&cli.StringFlag{
+			Name:  "country",
+			Usage: "two-letter ISO_3166 country code",
+		},
+		&cli.StringFlag{
+			Name:  "province",
+			Usage: "the province your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "locality",
+			Usage: "the locality your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "the address your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "postal-code",
+			Usage: "the postal code associated with your organization's address",
+		},
+		&cli.IntFlag{
+			Name:  "years-valid",
+			Usage: "the number of years for which the certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "months-valid",
+			Usage: "the number of months for which the certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "days-valid",
+			Value: 90,
+			Usage: "the number of days for which the certificates will be valid",
+		},
+		&cli.StringFlag{
+			Name:     "ocsp",
+			Usage:    "comma-separated string containing the OCSP responders used to validate certificates, e.g http://ocsp1.example.com,http://ocsp2.example.com",
+			EnvVars:  []string{"OCSP"},
+			Required: true,
+		},
+		policyFlag(),
+		certPolicyFlag(),
+		dbURLFlag(),
+	}, pkiConfigFlags()...)
+}
@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/acme"
+	"github.com/open-uem/openuem-cert-manager/internal/authz"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/urfave/cli/v2"
+)
+
+func TestACMEApprovalUsesStoredType(t *testing.T) {
+	dir := t.TempDir()
+	dbURL := models.SQLiteScheme + filepath.Join(dir, "pki.db")
+	model, err := models.New(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer model.Close()
+
+	// The operator may only approve proxy certificates
+	policy := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(policy, []byte(`{"rules": [{"identities": ["`+cliActor()+`"], "actions": ["approve"], "types": ["proxy"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	for _, certType := range []string{"console", "proxy"} {
+		order := &models.ACMEOrder{ID: certType, AccountID: "account", Status: acme.StatusPending, Expires: expires, Created: time.Now()}
+		a := &models.ACMEAuthorization{ID: certType, AccountID: "account", Identifier: models.ACMEIdentifier{Type: "dns", Value: certType + ".example.com"},
+			CertType: certType, Token: "token", Status: acme.StatusPending, ChallengeStatus: acme.StatusPending, Expires: expires}
+		if err := model.CreateACMEOrder(order, []*models.ACMEAuthorization{a}); err != nil {
+			t.Fatal(err)
+		}
+		a.ChallengeType, a.ChallengeStatus = acme.ChallengeApproval, acme.StatusProcessing
+		if err := model.UpdateACMEAuthorization(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	approve := func(id string) error {
+		app := &cli.App{Commands: []*cli.Command{ACMEApproval()}}
+		return app.Run([]string{"openuem-cert-manager", "acme-approval", "approve", "--id", id, "--policy", policy, "--dburl", dbURL})
+	}
+
+	if err := approve("console"); !errors.Is(err, authz.ErrDenied) {
+		t.Fatalf("a console authorization was approved by a proxy approver, %v", err)
+	}
+	if err := approve("proxy"); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, status := range map[string]string{"console": acme.StatusPending, "proxy": acme.StatusValid} {
+		a, err := model.GetACMEAuthorization(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Status != status {
+			t.Fatalf("the %s authorization is %s", id, a.Status)
+		}
+	}
+}
@@ -0,0 +1,887 @@
+package commands
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	ent "github.com/open-uem/ent"
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/openuem-cert-manager/internal/authz"
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+)
+
+const apiPathPrefix = "/api/v1"
+
+type apiIdentityKey struct{}
+
+type apiServer struct {
+	model      *models.Model
+	caCert     *x509.Certificate
+	caPrivKey  *rsa.PrivateKey
+	crl        *crlSigner
+	authz      *authz.Authorizer
+	certPolicy *certpolicy.Policy
+	// pkiConfig has the CRL and CA issuers URLs of the server, they can't be set by clients
+	pkiConfig Values
+	// approvalTypes are the certificate types that are requested instead of issued at once
+	approvalTypes []string
+	approvals     int
+}
+
+// APIIssueRequest has the kind of certificate and the values of the flags used by the
+// command that issues that kind of certificate, e.g {"kind": "server", "values": {"name": "example.com"}}
+type APIIssueRequest struct {
+	Kind   string         `json:"kind"`
+	Values map[string]any `json:"values"`
+}
+
+type APIRevokeRequest struct {
+	Reason int    `json:"reason"`
+	Info   string `json:"info"`
+}
+
+type APIIssueResponse struct {
+	Serial      string `json:"serial"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key"`
+	CA          string `json:"ca"`
+}
+
+type APICertificate struct {
+	Serial      string         `json:"serial"`
+	Type        string         `json:"type"`
+	Description string         `json:"description"`
+	Expiry      time.Time      `json:"expiry"`
+	User        string         `json:"user,omitempty"`
+	Revocation  *APIRevocation `json:"revocation,omitempty"`
+}
+
+type APIRevocation struct {
+	Reason  int       `json:"reason"`
+	Info    string    `json:"info"`
+	Revoked time.Time `json:"revoked"`
+}
+
+type APICertRequest struct {
+	ID                string         `json:"id"`
+	Kind              string         `json:"kind"`
+	Type              string         `json:"type"`
+	Values            map[string]any `json:"values"`
+	Requester         string         `json:"requester"`
+	RequiredApprovals int            `json:"required_approvals"`
+	Approvers         []string       `json:"approvers"`
+	Status            string         `json:"status"`
+	Reason            string         `json:"reason,omitempty"`
+	Serial            string         `json:"serial,omitempty"`
+	Renews            string         `json:"renews,omitempty"`
+	Created           time.Time      `json:"created"`
+	Updated           time.Time      `json:"updated"`
+}
+
+type APIRejectRequest struct {
+	Reason string `json:"reason"`
+}
+
+type APIError struct {
+	Error string `json:"error"`
+}
+
+func ServeAPI() *cli.Command {
+	return &cli.Command{
+		Name:   "serve-api",
+		Usage:  "Start a JSON REST API server to issue, renew, revoke and inspect certificates, authenticated with the OpenUEM console certificate or a policy token",
+		Action: serveAPI,
+		Flags:  serveAPIFlags(),
+	}
+}
+
+func serveAPI(cCtx *cli.Context) error {
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	log.Printf("... reading CA cert PEM file")
+	caCert, err := utils.ReadPEMCertificate(cCtx.String("cacert"))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := authz.NewAuthorizer(cCtx.String("policy"), model)
+	if err != nil {
+		return err
+	}
+
+	certPolicy, err := certpolicy.LoadOptional(cCtx.String("cert-policy"))
+	if err != nil {
+		return err
+	}
+
+	if err := loadPKIConfig(cCtx, model); err != nil {
+		return err
+	}
+
+	if cCtx.Int("crl-validity") < 1 {
+		return fmt.Errorf("the CRL must be valid for at least one hour")
+	}
+
+	if cCtx.Int("approvals") < 1 {
+		return fmt.Errorf("at least one approval is required")
+	}
+
+	approvalTypes, err := ApprovalTypes(model)
+	if err != nil {
+		return err
+	}
+	if cCtx.IsSet("approval-types") {
+		approvalTypes = parseApprovalTypes(cCtx.String("approval-types"))
+	}
+
+	s := &apiServer{
+		model:         model,
+		caCert:        caCert,
+		caPrivKey:     caPrivKey,
+		crl:           newCRLSigner(model, caCert, caPrivKey, time.Duration(cCtx.Int("crl-validity"))*time.Hour, "serve-api crl"),
+		authz:         authorizer,
+		certPolicy:    certPolicy,
+		pkiConfig:     cCtx,
+		approvalTypes: approvalTypes,
+		approvals:     cCtx.Int("approvals"),
+	}
+
+	log.Printf("... signing the CRL")
+	if err := s.crl.refresh(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.crl.run(done)
+
+	// Without a policy there are no API tokens, so a client certificate is always required
+	clientAuth := tls.RequireAndVerifyClientCert
+	if authorizer.Policy != nil && len(authorizer.Policy.Tokens) > 0 {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	srv := &http.Server{
+		Addr:    cCtx.String("listen"),
+		Handler: s.Handler(),
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientAuth: clientAuth,
+			ClientCAs:  s.clientCAs(),
+		},
+	}
+
+	log.Printf("... listening for API requests on %s%s", srv.Addr, apiPathPrefix)
+	return runHTTPServer(srv, cCtx.String("tls-cert"), cCtx.String("tls-key"))
+}
+
+func (s *apiServer) clientCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.caCert)
+	return pool
+}
+
+func (s *apiServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+apiPathPrefix+"/openapi.json", s.openAPI)
+	mux.HandleFunc("GET "+apiPathPrefix+"/ca", s.getCA)
+	mux.HandleFunc("GET "+apiPathPrefix+"/crl", s.getCRL)
+	mux.HandleFunc("GET "+apiPathPrefix+"/certificates", s.listCertificates)
+	mux.HandleFunc("POST "+apiPathPrefix+"/certificates", s.issueCertificate)
+	mux.HandleFunc("GET "+apiPathPrefix+"/certificates/{serial}", s.getCertificate)
+	mux.HandleFunc("POST "+apiPathPrefix+"/certificates/{serial}/renew", s.renewCertificate)
+	mux.HandleFunc("POST "+apiPathPrefix+"/certificates/{serial}/revoke", s.revokeCertificate)
+	mux.HandleFunc("GET "+apiPathPrefix+"/requests", s.listCertRequests)
+	mux.HandleFunc("POST "+apiPathPrefix+"/requests", s.createCertRequest)
+	mux.HandleFunc("GET "+apiPathPrefix+"/requests/{id}", s.getCertRequest)
+	mux.HandleFunc("POST "+apiPathPrefix+"/requests/{id}/approve", s.approveCertRequest)
+	mux.HandleFunc("POST "+apiPathPrefix+"/requests/{id}/reject", s.rejectCertRequest)
+	mux.HandleFunc("POST "+apiPathPrefix+"/requests/{id}/issue", s.issueCertRequest)
+	return s.authenticate(mux)
+}
+
+// authenticate only lets in clients that present a valid console certificate issued by our CA or
+// an API token listed in the authorization policy, the identity is stored in the request context
+func (s *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := ""
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && s.authz.Policy != nil {
+			if identity, ok = s.authz.Policy.LookupToken(token); !ok {
+				writeAPIError(w, http.StatusUnauthorized, "the API token is not valid")
+				return
+			}
+		} else {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				writeAPIError(w, http.StatusUnauthorized, "a valid client certificate is required")
+				return
+			}
+
+			clientCert := r.TLS.VerifiedChains[0][0]
+			serial := clientCert.SerialNumber.Int64()
+			cert, err := s.model.GetCertificate(serial)
+			if err != nil || cert.Type != certificate.TypeConsole {
+				writeAPIError(w, http.StatusForbidden, "the client certificate is not an OpenUEM console certificate")
+				return
+			}
+
+			revoked, err := s.model.IsRevoked(serial)
+			if err != nil {
+				log.Printf("[ERROR]: could not check if certificate %x is revoked, reason: %v", serial, err)
+				writeAPIError(w, http.StatusInternalServerError, "could not check the client certificate")
+				return
+			}
+			if revoked {
+				writeAPIError(w, http.StatusForbidden, "the client certificate has been revoked")
+				return
+			}
+			identity = authz.CertificateIdentity(clientCert)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiIdentityKey{}, identity)))
+	})
+}
+
+// authorize checks the policy for the identity of the request, writing an error if it's denied
+func (s *apiServer) authorize(w http.ResponseWriter, r *http.Request, action string, certType string, resource string) bool {
+	identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+	if err := s.authz.Authorize(identity, action, certType, resource); err != nil {
+		writeAPIError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *apiServer) openAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write([]byte(openAPIDocument)); err != nil {
+		log.Printf("[ERROR]: could not write API response, reason: %v", err)
+	}
+}
+
+func (s *apiServer) getCA(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw}); err != nil {
+		log.Printf("[ERROR]: could not write API response, reason: %v", err)
+	}
+}
+
+func (s *apiServer) getCRL(w http.ResponseWriter, r *http.Request) {
+	// The CRL is signed when the revocations change, not for every request
+	crl := s.crl.latest()
+	serveRepoFile(w, r, "application/pkix-crl", crl.der, crl.thisUpdate, crlCheckInterval)
+}
+
+func (s *apiServer) listCertificates(w http.ResponseWriter, r *http.Request) {
+	certs, err := s.model.GetCertificates()
+	if err != nil {
+		log.Printf("[ERROR]: could not get certificates, reason: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "could not get certificates")
+		return
+	}
+
+	revocations, err := s.model.GetRevocations()
+	if err != nil {
+		log.Printf("[ERROR]: could not get revocations, reason: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "could not get revocations")
+		return
+	}
+
+	revoked := map[int64]*ent.Revocation{}
+	for _, rev := range revocations {
+		revoked[rev.ID] = rev
+	}
+
+	identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+	resp := []APICertificate{}
+	for _, c := range certs {
+		if !s.authz.Allowed(identity, authz.ActionRead, string(c.Type)) {
+			continue
+		}
+		resp = append(resp, newAPICertificate(c, revoked[c.ID]))
+	}
+	writeAPIResponse(w, http.StatusOK, resp)
+}
+
+func (s *apiServer) getCertificate(w http.ResponseWriter, r *http.Request) {
+	cert, ok := s.lookupCertificate(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, r, authz.ActionRead, string(cert.Type), strconv.FormatInt(cert.ID, 16)) {
+		return
+	}
+
+	rev, err := s.model.GetRevocation(cert.ID)
+	if err != nil && !ent.IsNotFound(err) {
+		log.Printf("[ERROR]: could not get revocation for %x, reason: %v", cert.ID, err)
+		writeAPIError(w, http.StatusInternalServerError, "could not get revocation")
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, newAPICertificate(cert, rev))
+}
+
+func (s *apiServer) issueCertificate(w http.ResponseWriter, r *http.Request) {
+	req, v, ok := readAPIIssueRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, r, authz.ActionIssue, PolicyType(req.Kind, v), CommonName(req.Kind, v)) {
+		return
+	}
+
+	// Sensitive types wait for approval
+	if slices.Contains(s.approvalTypes, PolicyType(req.Kind, v)) {
+		s.saveCertRequest(w, r, req, v, 0)
+		return
+	}
+
+	resp, err := s.issue(req.Kind, v, nil)
+	s.auditIssue(r, "issue", issueAuditParameters(req), resp, err)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAPIResponse(w, http.StatusCreated, resp)
+}
+
+// renewCertificate issues a new certificate with the values sent and revokes the current one
+// as superseded. The values choose the subject and names of the new certificate so the caller
+// must also be allowed to issue it, and types that need approval are requested instead
+func (s *apiServer) renewCertificate(w http.ResponseWriter, r *http.Request) {
+	current, ok := s.lookupCertificate(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, r, authz.ActionRenew, string(current.Type), strconv.FormatInt(current.ID, 16)) {
+		return
+	}
+
+	revoked, err := s.model.IsRevoked(current.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not check if the certificate is revoked")
+		return
+	}
+	if revoked {
+		writeAPIError(w, http.StatusConflict, "the certificate has been revoked")
+		return
+	}
+
+	req, v, ok := readAPIIssueRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := CheckRenewal(req.Kind, v, current); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !s.authorize(w, r, authz.ActionIssue, PolicyType(req.Kind, v), CommonName(req.Kind, v)) {
+		return
+	}
+
+	// The current certificate is revoked when the approved request is issued
+	if slices.Contains(s.approvalTypes, PolicyType(req.Kind, v)) {
+		s.saveCertRequest(w, r, req, v, current.ID)
+		return
+	}
+
+	params := issueAuditParameters(req)
+	params["renewed"] = strconv.FormatInt(current.ID, 16)
+
+	resp, err := s.issue(req.Kind, v, current)
+	if err != nil {
+		s.auditIssue(r, "renew", params, nil, err)
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-5.3.1 4 - Superseded
+	err = s.model.AddRevocation(current.ID, 4, "renewed by "+resp.Serial)
+	s.audit(r, "revoke", map[string]any{"reason": 4, "info": "renewed by " + resp.Serial}, current.ID, err)
+	if err != nil {
+		s.auditIssue(r, "renew", params, nil, err)
+		log.Printf("[ERROR]: could not revoke renewed certificate %x, reason: %v", current.ID, err)
+		writeAPIError(w, http.StatusInternalServerError, "the certificate was renewed but the old one could not be revoked")
+		return
+	}
+
+	s.auditIssue(r, "renew", params, resp, nil)
+	log.Printf("... certificate %x renewed by %s", current.ID, resp.Serial)
+	writeAPIResponse(w, http.StatusCreated, resp)
+}
+
+func (s *apiServer) revokeCertificate(w http.ResponseWriter, r *http.Request) {
+	cert, ok := s.lookupCertificate(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, r, authz.ActionRevoke, string(cert.Type), strconv.FormatInt(cert.ID, 16)) {
+		return
+	}
+
+	req := APIRevokeRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "could not decode request")
+		return
+	}
+
+	if req.Reason < 0 || req.Reason == 7 || req.Reason > 10 {
+		writeAPIError(w, http.StatusBadRequest, "invalid reason")
+		return
+	}
+
+	err := s.model.AddRevocation(cert.ID, req.Reason, req.Info)
+	s.audit(r, "revoke", map[string]any{"reason": req.Reason, "info": req.Info}, cert.ID, err)
+	if err != nil {
+		log.Printf("[ERROR]: could not revoke certificate %x, reason: %v", cert.ID, err)
+		writeAPIError(w, http.StatusConflict, "could not save the revoked certificate, it may have been revoked already")
+		return
+	}
+
+	log.Printf("... certificate %x revoked", cert.ID)
+	rev, err := s.model.GetRevocation(cert.ID)
+	if err != nil {
+		rev = nil
+	}
+	writeAPIResponse(w, http.StatusOK, newAPICertificate(cert, rev))
+}
+
+func (s *apiServer) listCertRequests(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = models.CertRequestPending
+	} else if status == "all" {
+		status = ""
+	}
+
+	requests, err := s.model.GetCertRequests(status)
+	if err != nil {
+		log.Printf("[ERROR]: could not get certificate requests, reason: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "could not get certificate requests")
+		return
+	}
+
+	identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+	resp := []APICertRequest{}
+	for _, req := range requests {
+		if req.Requester != identity && !s.authz.Allowed(identity, authz.ActionApprove, req.CertType) && !s.authz.Allowed(identity, authz.ActionRead, req.CertType) {
+			continue
+		}
+		resp = append(resp, newAPICertRequest(req))
+	}
+	writeAPIResponse(w, http.StatusOK, resp)
+}
+
+// createCertRequest requests a certificate of any type, it will be issued once approved
+func (s *apiServer) createCertRequest(w http.ResponseWriter, r *http.Request) {
+	req, v, ok := readAPIIssueRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, r, authz.ActionIssue, PolicyType(req.Kind, v), CommonName(req.Kind, v)) {
+		return
+	}
+
+	s.saveCertRequest(w, r, req, v, 0)
+}
+
+func (s *apiServer) saveCertRequest(w http.ResponseWriter, r *http.Request, req *APIIssueRequest, v Values, renews int64) {
+	if err := ValidateSettings(req.Kind, v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+	certReq := &models.CertRequest{
+		Kind:              req.Kind,
+		CertType:          PolicyType(req.Kind, v),
+		Values:            req.Values,
+		Requester:         identity,
+		RequiredApprovals: s.approvals,
+		Renews:            renews,
+	}
+	err := s.model.CreateCertRequest(certReq)
+	params := issueAuditParameters(req)
+	params["request_id"] = certReq.ID
+	if renews != 0 {
+		params["renews"] = strconv.FormatInt(renews, 16)
+	}
+	s.audit(r, "request", params, 0, err)
+	if err != nil {
+		log.Printf("[ERROR]: could not save certificate request, reason: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "could not save the certificate request")
+		return
+	}
+
+	log.Printf("... %s certificate request %s created by %s", certReq.CertType, certReq.ID, identity)
+	w.Header().Set("Location", apiPathPrefix+"/requests/"+certReq.ID)
+	writeAPIResponse(w, http.StatusAccepted, newAPICertRequest(certReq))
+}
+
+func (s *apiServer) getCertRequest(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.lookupCertRequest(w, r)
+	if !ok {
+		return
+	}
+
+	identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+	if req.Requester != identity && !s.authz.Allowed(identity, authz.ActionApprove, req.CertType) &&
+		!s.authorize(w, r, authz.ActionRead, req.CertType, req.ID) {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, newAPICertRequest(req))
+}
+
+func (s *apiServer) approveCertRequest(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.lookupCertRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, r, authz.ActionApprove, req.CertType, req.ID) {
+		return
+	}
+
+	identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+	id := req.ID
+	req, err := approveRequest(s.model, id, identity)
+	s.audit(r, "approve", map[string]any{"request_id": id}, 0, err)
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	log.Printf("... certificate request %s approved by %s", req.ID, identity)
+	writeAPIResponse(w, http.StatusOK, newAPICertRequest(req))
+}
+
+func (s *apiServer) rejectCertRequest(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.lookupCertRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, r, authz.ActionApprove, req.CertType, req.ID) {
+		return
+	}
+
+	reject := APIRejectRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&reject); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "could not decode request")
+		return
+	}
+
+	identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+	err := s.model.RejectCertRequest(req.ID, identity, reject.Reason)
+	s.audit(r, "reject", map[string]any{"request_id": req.ID, "reason": reject.Reason}, 0, err)
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("could not reject the certificate request, reason: %s", err.Error()))
+		return
+	}
+
+	log.Printf("... certificate request %s rejected by %s", req.ID, identity)
+	req, err = s.model.GetCertRequest(req.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not get the certificate request")
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, newAPICertRequest(req))
+}
+
+// issueCertRequest signs an approved request, only the requester gets the private key
+func (s *apiServer) issueCertRequest(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.lookupCertRequest(w, r)
+	if !ok {
+		return
+	}
+
+	identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+	if req.Requester != identity {
+		writeAPIError(w, http.StatusForbidden, "only the requester can issue the certificate")
+		return
+	}
+
+	_, issued, err := issueApprovedRequest(s.model, req.ID, identity, s.caCert, s.caPrivKey, s.certPolicy, s.pkiConfig, nil)
+	if err != nil {
+		s.auditIssue(r, "issue-request", map[string]any{"request_id": req.ID}, nil, err)
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	s.auditIssue(r, "issue-request", map[string]any{"request_id": req.ID}, s.issueResponse(issued), nil)
+
+	log.Printf("... certificate %x of request %s issued", issued.Cert.SerialNumber.Int64(), req.ID)
+	writeAPIResponse(w, http.StatusCreated, s.issueResponse(issued))
+}
+
+func (s *apiServer) lookupCertRequest(w http.ResponseWriter, r *http.Request) (*models.CertRequest, bool) {
+	req, err := s.model.GetCertRequest(r.PathValue("id"))
+	if err != nil {
+		if errors.Is(err, models.ErrCertRequestNotFound) {
+			writeAPIError(w, http.StatusNotFound, err.Error())
+		} else {
+			log.Printf("[ERROR]: could not get certificate request, reason: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "could not get certificate request")
+		}
+		return nil, false
+	}
+	return req, true
+}
+
+// issue creates a certificate with the same code used by the command-line and stores it, if the
+// certificate renews another one the user of the renewed certificate is kept
+func (s *apiServer) issue(kind string, v Values, renewed *ent.Certificate) (*APIIssueResponse, error) {
+	issued, err := IssueCertificate(kind, withPKIConfig(v, s.pkiConfig), s.caCert, s.caPrivKey, s.certPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	serial := issued.Cert.SerialNumber.Int64()
+	if renewed == nil {
+		if err := SaveIssuedCertificate(s.model, kind, v, issued.Cert); err != nil {
+			return nil, fmt.Errorf("could not save certificate info to database, reason: %s", err.Error())
+		}
+	} else if err := SaveRenewedCertificate(s.model, v, issued.Cert, renewed); err != nil {
+		return nil, err
+	}
+
+	log.Printf("... %s certificate %x issued to %s", kind, serial, issued.Cert.Subject.CommonName)
+	return s.issueResponse(issued), nil
+}
+
+// audit records an operation done through the API by the authenticated identity
+func (s *apiServer) audit(r *http.Request, operation string, params map[string]any, serial int64, err error) {
+	identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+	recordAudit(s.model, identity, "serve-api "+operation, params, serial, err)
+}
+
+// auditIssue records an issued certificate and that its private key has been sent in the response
+func (s *apiServer) auditIssue(r *http.Request, operation string, params map[string]any, resp *APIIssueResponse, err error) {
+	serial := int64(0)
+	if resp != nil {
+		serial, _ = parseAPISerial(resp.Serial)
+	}
+
+	s.audit(r, operation, params, serial, err)
+	if err == nil && resp != nil {
+		identity, _ := r.Context().Value(apiIdentityKey{}).(string)
+		recordKeyExport(s.model, identity, serial, "api response")
+	}
+}
+
+func issueAuditParameters(req *APIIssueRequest) map[string]any {
+	params := auditParameters(req.Values)
+	params["kind"] = req.Kind
+	return params
+}
+
+func (s *apiServer) issueResponse(issued *IssuedCertificate) *APIIssueResponse {
+	return &APIIssueResponse{
+		Serial:      strconv.FormatInt(issued.Cert.SerialNumber.Int64(), 16),
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issued.CertBytes})),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(issued.PrivKey)})),
+		CA:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})),
+	}
+}
+
+// lookupCertificate finds the certificate whose serial is in the path, writing an error if there's none
+func (s *apiServer) lookupCertificate(w http.ResponseWriter, r *http.Request) (*ent.Certificate, bool) {
+	serial, err := parseAPISerial(r.PathValue("serial"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	cert, err := s.model.GetCertificate(serial)
+	if err != nil {
+		if ent.IsNotFound(err) {
+			writeAPIError(w, http.StatusNotFound, "certificate not found")
+		} else {
+			log.Printf("[ERROR]: could not get certificate %x, reason: %v", serial, err)
+			writeAPIError(w, http.StatusInternalServerError, "could not get certificate")
+		}
+		return nil, false
+	}
+	return cert, true
+}
+
+func readAPIIssueRequest(w http.ResponseWriter, r *http.Request) (*APIIssueRequest, Values, bool) {
+	req := APIIssueRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "could not decode request")
+		return nil, nil, false
+	}
+
+	flags, err := IssueFlags(req.Kind)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+
+	v := &flagValues{values: req.Values, flags: flags}
+	if err := checkRequiredValues(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+	return &req, v, true
+}
+
+// checkRequiredValues reports the required flags that are missing, the CA, the database and the
+// files are managed by the server so they're not required
+func checkRequiredValues(v *flagValues) error {
+	for _, flag := range v.flags {
+		rf, ok := flag.(cli.RequiredFlag)
+		if !ok || !rf.IsRequired() {
+			continue
+		}
+
+		name := flag.Names()[0]
+		if name == "filename" || slices.Contains(localFlags, name) {
+			continue
+		}
+		if _, ok := v.values[name]; !ok {
+			return fmt.Errorf("the value %q is required", name)
+		}
+	}
+	return nil
+}
+
+func newAPICertificate(c *ent.Certificate, rev *ent.Revocation) APICertificate {
+	cert := APICertificate{
+		Serial:      strconv.FormatInt(c.ID, 16),
+		Type:        string(c.Type),
+		Description: c.Description,
+		Expiry:      c.Expiry,
+		User:        c.UID,
+	}
+	if rev != nil {
+		cert.Revocation = &APIRevocation{Reason: rev.Reason, Info: rev.Info, Revoked: rev.Revoked}
+	}
+	return cert
+}
+
+func newAPICertRequest(r *models.CertRequest) APICertRequest {
+	req := APICertRequest{
+		ID:                r.ID,
+		Kind:              r.Kind,
+		Type:              r.CertType,
+		Values:            r.Values,
+		Requester:         r.Requester,
+		RequiredApprovals: r.RequiredApprovals,
+		Approvers:         r.Approvers,
+		Status:            r.Status,
+		Reason:            r.Reason,
+		Created:           r.Created,
+		Updated:           r.Updated,
+	}
+	if req.Approvers == nil {
+		req.Approvers = []string{}
+	}
+	if r.Serial != 0 {
+		req.Serial = strconv.FormatInt(r.Serial, 16)
+	}
+	if r.Renews != 0 {
+		req.Renews = strconv.FormatInt(r.Renews, 16)
+	}
+	return req
+}
+
+func parseAPISerial(serial string) (int64, error) {
+	n, err := strconv.ParseInt(serial, 16, 64)
+	if err != nil {
+		return 0, errors.New("the serial number must be an hexadecimal string")
+	}
+	return n, nil
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, resp any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("[ERROR]: could not write API response, reason: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIResponse(w, status, APIError{Error: message})
+}
+
+func serveAPIFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "cacert",
+			Usage:    "the path to your CA certificate file in PEM format",
+			EnvVars:  []string{"CA_CRT_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cakey",
+			Usage:    "the path to your CA private key file in PEM format",
+			EnvVars:  []string{"CA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: ":8449",
+			Usage: "the address where the API server listens",
+		},
+		&cli.StringFlag{
+			Name:     "tls-cert",
+			Usage:    "the path to the API server certificate in PEM format",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "tls-key",
+			Usage:    "the path to the API server private key in PEM format",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "crl-validity",
+			Value: 24,
+			Usage: "the number of hours until the next update of the CRL returned by the API, a new CRL is signed when a certificate is revoked or once half of this time has passed",
+		},
+		&cli.StringFlag{
+			Name:  "approval-types",
+			Usage: "comma-separated list of the certificate types that must be approved before they're issued or none, if not set the types saved with pki-config are used",
+		},
+		&cli.IntFlag{
+			Name:  "approvals",
+			Value: 1,
+			Usage: "the number of distinct approvers required by a certificate request",
+		},
+		policyFlag(),
+		certPolicyFlag(),
+		dbURLFlag(),
+	}, pkiConfigFlags()...)
+}
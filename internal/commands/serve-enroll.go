@@ -0,0 +1,432 @@
+package commands
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/nats"
+	"github.com/open-uem/openuem-cert-manager/internal/authz"
+	"github.com/open-uem/openuem-cert-manager/internal/certlint"
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// EnrollmentSubject is the NATS subject where agents send their enrollment requests
+const EnrollmentSubject = "certificates.enroll"
+
+var validAgentID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+type EnrollmentRequest struct {
+	Token   string `json:"token"`
+	AgentID string `json:"agent_id"`
+	CSR     string `json:"csr"`
+}
+
+type EnrollmentResponse struct {
+	Certificate string `json:"certificate,omitempty"`
+	CA          string `json:"ca,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type enroller struct {
+	authz       *authz.Authorizer
+	policy      *certpolicy.Policy
+	urls        PKIURLs
+	model       *models.Model
+	caCert      *x509.Certificate
+	caPrivKey   *rsa.PrivateKey
+	certRequest nats.CertificateRequest
+}
+
+func ServeEnrollment() *cli.Command {
+	return &cli.Command{
+		Name:   "serve-enroll",
+		Usage:  "Start a server that issues a unique certificate to every agent presenting a valid enrollment token and a CSR",
+		Action: serveEnrollment,
+		Flags:  serveEnrollmentFlags(),
+	}
+}
+
+func serveEnrollment(cCtx *cli.Context) error {
+	if cCtx.String("listen") == "" && cCtx.String("nats-servers") == "" {
+		return fmt.Errorf("at least one of listen or nats-servers must be set")
+	}
+
+	// Enrollment tokens are bearer secrets, they must not travel in cleartext
+	if cCtx.String("listen") != "" && (cCtx.String("tls-cert") == "" || cCtx.String("tls-key") == "") {
+		return fmt.Errorf("the HTTPS enrollment endpoint requires tls-cert and tls-key")
+	}
+
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	log.Printf("... reading CA cert PEM file")
+	caCert, err := utils.ReadPEMCertificate(cCtx.String("cacert"))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := authz.NewAuthorizer(cCtx.String("policy"), model)
+	if err != nil {
+		return err
+	}
+
+	certPolicy, err := certpolicy.LoadOptional(cCtx.String("cert-policy"))
+	if err != nil {
+		return err
+	}
+
+	if err := loadPKIConfig(cCtx, model); err != nil {
+		return err
+	}
+
+	e := &enroller{
+		authz:     authorizer,
+		policy:    certPolicy,
+		urls:      pkiURLs(cCtx),
+		model:     model,
+		caCert:    caCert,
+		caPrivKey: caPrivKey,
+		certRequest: nats.CertificateRequest{
+			Organization:   cCtx.String("org"),
+			Country:        cCtx.String("country"),
+			Province:       cCtx.String("province"),
+			Locality:       cCtx.String("locality"),
+			Address:        cCtx.String("address"),
+			PostalCode:     cCtx.String("postal-code"),
+			YearsValid:     cCtx.Int("years-valid"),
+			MonthsValid:    cCtx.Int("months-valid"),
+			DaysValid:      cCtx.Int("days-valid"),
+			OCSPResponders: splitOCSPServers(cCtx.String("ocsp")),
+		},
+	}
+
+	if servers := cCtx.String("nats-servers"); servers != "" {
+		log.Printf("... connecting to NATS servers")
+		nc, err := nats.ConnectWithNATS(servers, cCtx.String("nats-cert"), cCtx.String("nats-key"), cCtx.String("cacert"), "")
+		if err != nil {
+			return fmt.Errorf("could not connect to NATS, reason: %s", err.Error())
+		}
+		defer nc.Close()
+
+		if _, err := nc.QueueSubscribe(EnrollmentSubject, "openuem-cert-manager", e.natsHandler); err != nil {
+			return err
+		}
+		log.Printf("... listening for enrollment requests on NATS subject %s", EnrollmentSubject)
+	}
+
+	if cCtx.String("listen") == "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		<-ctx.Done()
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/enroll", e.httpHandler)
+
+	srv := &http.Server{
+		Addr:    cCtx.String("listen"),
+		Handler: mux,
+	}
+
+	log.Printf("... listening for enrollment requests on %s", srv.Addr)
+	return runHTTPServer(srv, cCtx.String("tls-cert"), cCtx.String("tls-key"))
+}
+
+func (e *enroller) httpHandler(w http.ResponseWriter, r *http.Request) {
+	req := EnrollmentRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeEnrollmentResponse(w, http.StatusBadRequest, &EnrollmentResponse{Error: "could not decode enrollment request"})
+		return
+	}
+
+	resp, err := e.enroll(req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, models.ErrInvalidEnrollmentToken) || errors.Is(err, authz.ErrDenied) {
+			status = http.StatusForbidden
+		}
+		writeEnrollmentResponse(w, status, &EnrollmentResponse{Error: err.Error()})
+		return
+	}
+	writeEnrollmentResponse(w, http.StatusOK, resp)
+}
+
+func (e *enroller) natsHandler(msg *natsgo.Msg) {
+	req := EnrollmentRequest{}
+	resp := &EnrollmentResponse{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		resp.Error = "could not decode enrollment request"
+	} else if r, err := e.enroll(req); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp = r
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("[ERROR]: could not encode enrollment response, reason: %v", err)
+		return
+	}
+	if err := msg.Respond(data); err != nil {
+		log.Printf("[ERROR]: could not send enrollment response, reason: %v", err)
+	}
+}
+
+func (e *enroller) enroll(req EnrollmentRequest) (*EnrollmentResponse, error) {
+	if !validAgentID.MatchString(req.AgentID) {
+		return nil, fmt.Errorf("the agent id is not valid")
+	}
+
+	csr, err := parseCSR([]byte(req.CSR))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.authz.Authorize(authz.EnrollmentTokenIdentity, authz.ActionIssue, string(certificate.TypeAgent), req.AgentID); err != nil {
+		return nil, err
+	}
+
+	// The token is consumed in the same transaction that saves the certificate, so a request that
+	// fails when the certificate is checked, signed or saved doesn't use the token
+	var certBytes []byte
+	var cert *x509.Certificate
+	var issueErr error
+	description := fmt.Sprintf("Agent %s", req.AgentID)
+	err = e.model.EnrollAgent(req.Token, req.AgentID, description, func(*models.EnrollmentToken) (*x509.Certificate, error) {
+		certBytes, cert, issueErr = e.issueAgentCertificate(req.AgentID, csr)
+		return cert, issueErr
+	})
+	if issueErr != nil {
+		return nil, issueErr
+	}
+	if errors.Is(err, models.ErrInvalidEnrollmentToken) {
+		log.Printf("[WARN]: agent %s presented an invalid enrollment token", req.AgentID)
+		return nil, err
+	}
+
+	serial := int64(0)
+	if err == nil {
+		serial = cert.SerialNumber.Int64()
+	}
+	recordAudit(e.model, authz.EnrollmentTokenIdentity, "serve-enroll enroll", map[string]any{"agent_id": req.AgentID}, serial, err)
+	if err != nil {
+		log.Printf("[ERROR]: could not save certificate for agent %s, reason: %v", req.AgentID, err)
+		return nil, fmt.Errorf("could not save the agent certificate")
+	}
+
+	log.Printf("... agent %s enrolled with certificate %x", req.AgentID, cert.SerialNumber.Bytes())
+	return &EnrollmentResponse{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})),
+		CA:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: e.caCert.Raw})),
+	}, nil
+}
+
+// issueAgentCertificate signs the certificate of an agent for the public key of its CSR
+func (e *enroller) issueAgentCertificate(agentID string, csr *x509.CertificateRequest) ([]byte, *x509.Certificate, error) {
+	certRequest := e.certRequest
+	certRequest.AgentId = agentID
+	cert, err := NewX509AgentCertificate(certRequest, e.caCert, e.urls)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := e.policy.Enforce(string(certificate.TypeAgent), cert, csr.PublicKey, e.caCert); err != nil {
+		return nil, nil, err
+	}
+
+	certBytes, cert, err := signCertificate(cert, csr.PublicKey, e.caCert, e.caPrivKey)
+	if err != nil {
+		log.Printf("[ERROR]: could not create certificate for agent %s, reason: %v", agentID, err)
+		if errors.As(err, new(*certlint.LintError)) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("could not create the agent certificate")
+	}
+	return certBytes, cert, nil
+}
+
+func writeEnrollmentResponse(w http.ResponseWriter, status int, resp *EnrollmentResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("[ERROR]: could not encode enrollment response, reason: %v", err)
+	}
+}
+
+// parseCSR decodes a PEM encoded certificate request and checks its signature
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("the CSR is not a PEM encoded certificate request")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the CSR, reason: %v", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("the CSR signature is not valid, reason: %v", err)
+	}
+	return csr, nil
+}
+
+// AgentURI returns the Subject Alternative Name URI that identifies an agent
+func AgentURI(agentID string) *url.URL {
+	return &url.URL{Scheme: "urn", Opaque: "openuem:agent:" + agentID}
+}
+
+func NewX509AgentCertificate(certRequest nats.CertificateRequest, caCert *x509.Certificate, urls PKIURLs) (*x509.Certificate, error) {
+	serialNumber, err := utils.GenerateSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:         certRequest.AgentId,
+			OrganizationalUnit: []string{"agent"},
+			Organization:       rdnValues(certRequest.Organization),
+			Country:            rdnValues(certRequest.Country),
+			Province:           rdnValues(certRequest.Province),
+			Locality:           rdnValues(certRequest.Locality),
+			StreetAddress:      rdnValues(certRequest.Address),
+			PostalCode:         rdnValues(certRequest.PostalCode),
+		},
+		Issuer:                caCert.Subject,
+		URIs:                  []*url.URL{AgentURI(certRequest.AgentId)},
+		NotBefore:             time.Now().Add(-5 * time.Minute).UTC(),
+		NotAfter:              time.Now().AddDate(certRequest.YearsValid, certRequest.MonthsValid, certRequest.DaysValid),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		OCSPServer:            certRequest.OCSPResponders,
+		CRLDistributionPoints: urls.CRL,
+		IssuingCertificateURL: urls.CAIssuers,
+	}, nil
+}
+
+func serveEnrollmentFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "cacert",
+			Usage:    "the path to your CA certificate file in PEM format",
+			EnvVars:  []string{"CA_CRT_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cakey",
+			Usage:    "the path to your CA private key file in PEM format",
+			EnvVars:  []string{"CA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Usage: "the address where the HTTPS enrollment endpoint listens, e.g :8445. It's disabled unless it's set",
+		},
+		&cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "the path to the server certificate used for the HTTPS enrollment endpoint, required if listen is set",
+		},
+		&cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "the path to the server private key used for the HTTPS enrollment endpoint, required if listen is set",
+		},
+		&cli.StringFlag{
+			Name:    "nats-servers",
+			Usage:   "comma-separated list of NATS servers where enrollment requests will be received, e.g nats.example.com:4433",
+			EnvVars: []string{"NATS_SERVERS"},
+		},
+		&cli.StringFlag{
+			Name:  "nats-cert",
+			Usage: "the path to the client certificate used to connect to NATS",
+		},
+		&cli.StringFlag{
+			Name:  "nats-key",
+			Usage: "the path to the client private key used to connect to NATS",
+		},
+		&cli.StringFlag{
+			Name:  "org",
+			Value: "",
+			Usage: "organization name associated with this CA",
+		},
+		&cli.StringFlag{
+			Name:  "country",
+			Value: "",
+			Usage: "two-letter ISO_3166 country code",
+		},
+		&cli.StringFlag{
+			Name:  "province",
+			Value: "",
+			Usage: "the province your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "locality",
+			Value: "",
+			Usage: "the locality your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Value: "",
+			Usage: "the address your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "postal-code",
+			Value: "",
+			Usage: "the postal code associated with your organization's address",
+		},
+		&cli.IntFlag{
+			Name:  "years-valid",
+			Value: 1,
+			Usage: "the number of years for which the agent certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "months-valid",
+			Value: 0,
+			Usage: "the number of months for which the agent certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "days-valid",
+			Value: 0,
+			Usage: "the number of days for which the agent certificates will be valid",
+		},
+		&cli.StringFlag{
+			Name:     "ocsp",
+			Usage:    "the url of the OCSP responder, e.g https://ocsp.example.com",
+			EnvVars:  []string{"OCSP"},
+			Required: true,
+		},
+		policyFlag(),
+		certPolicyFlag(),
+		dbURLFlag(),
+	}, pkiConfigFlags()...)
+}
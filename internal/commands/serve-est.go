@@ -0,0 +1,519 @@
+package commands
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/openuem-cert-manager/internal/authz"
+	"github.com/open-uem/openuem-cert-manager/internal/certlint"
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/smallstep/pkcs7"
+	"github.com/urfave/cli/v2"
+)
+
+// Ref: https://datatracker.ietf.org/doc/html/rfc7030
+const estPathPrefix = "/.well-known/est"
+
+var oidSHA256WithRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+
+type estServer struct {
+	cCtx      *cli.Context
+	model     *models.Model
+	caCert    *x509.Certificate
+	caPrivKey *rsa.PrivateKey
+	username  string
+	password  string
+	authz     *authz.Authorizer
+	policy    *certpolicy.Policy
+}
+
+func ServeEST() *cli.Command {
+	return &cli.Command{
+		Name:   "serve-est",
+		Usage:  "Start an EST (RFC 7030) server to enroll network devices and third-party clients against your CA",
+		Action: serveEST,
+		Flags:  serveESTFlags(),
+	}
+}
+
+func serveEST(cCtx *cli.Context) error {
+	if !isValidCertificateType(cCtx.String("type")) {
+		return fmt.Errorf("type is not one of 'console', 'worker', 'sftp', 'updater' or 'agent'")
+	}
+
+	if (cCtx.String("username") == "") != (cCtx.String("password") == "") {
+		return fmt.Errorf("both username and password must be set to use HTTP basic authentication")
+	}
+
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	log.Printf("... reading CA cert PEM file")
+	caCert, err := utils.ReadPEMCertificate(cCtx.String("cacert"))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := authz.NewAuthorizer(cCtx.String("policy"), model)
+	if err != nil {
+		return err
+	}
+
+	certPolicy, err := certpolicy.LoadOptional(cCtx.String("cert-policy"))
+	if err != nil {
+		return err
+	}
+
+	if err := loadPKIConfig(cCtx, model); err != nil {
+		return err
+	}
+
+	s := &estServer{
+		cCtx:      cCtx,
+		model:     model,
+		caCert:    caCert,
+		caPrivKey: caPrivKey,
+		username:  cCtx.String("username"),
+		password:  cCtx.String("password"),
+		authz:     authorizer,
+		policy:    certPolicy,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+estPathPrefix+"/cacerts", s.caCerts)
+	mux.HandleFunc("POST "+estPathPrefix+"/simpleenroll", s.simpleEnroll)
+	mux.HandleFunc("POST "+estPathPrefix+"/simplereenroll", s.simpleReenroll)
+	mux.HandleFunc("GET "+estPathPrefix+"/csrattrs", s.csrAttrs)
+
+	// Clients may authenticate with a certificate issued by our CA
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+
+	srv := &http.Server{
+		Addr:    cCtx.String("listen"),
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  clientCAs,
+		},
+	}
+
+	log.Printf("... listening for EST requests on %s", srv.Addr)
+	return runHTTPServer(srv, cCtx.String("tls-cert"), cCtx.String("tls-key"))
+}
+
+func (s *estServer) caCerts(w http.ResponseWriter, r *http.Request) {
+	data, err := pkcs7.DegenerateCertificate(s.caCert.Raw)
+	if err != nil {
+		log.Printf("[ERROR]: could not encode CA certificate, reason: %v", err)
+		http.Error(w, "could not encode CA certificate", http.StatusInternalServerError)
+		return
+	}
+	writeESTResponse(w, "application/pkcs7-mime", data)
+}
+
+func (s *estServer) csrAttrs(w http.ResponseWriter, r *http.Request) {
+	data, err := asn1.Marshal([]asn1.ObjectIdentifier{oidSHA256WithRSAEncryption})
+	if err != nil {
+		http.Error(w, "could not encode CSR attributes", http.StatusInternalServerError)
+		return
+	}
+	writeESTResponse(w, "application/csrattrs", data)
+}
+
+func (s *estServer) simpleEnroll(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authenticated(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="OpenUEM EST"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	csr, err := readESTRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.authz.Authorize(identity, authz.ActionIssue, s.cCtx.String("type"), csr.Subject.CommonName); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	s.issue(w, identity, "simpleenroll", csr, nil)
+}
+
+func (s *estServer) simpleReenroll(w http.ResponseWriter, r *http.Request) {
+	// A reenrollment must be authenticated with the certificate being renewed
+	current := s.clientCertificate(r)
+	if current == nil {
+		http.Error(w, "a valid client certificate is required to reenroll", http.StatusUnauthorized)
+		return
+	}
+
+	csr, err := readESTRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if csr.Subject.String() != current.Subject.String() {
+		http.Error(w, "the CSR subject doesn't match the current certificate subject", http.StatusBadRequest)
+		return
+	}
+
+	if !sameSubjectAltNames(csr, current) {
+		http.Error(w, "the CSR subject alternative names don't match the current certificate", http.StatusBadRequest)
+		return
+	}
+
+	identity := authz.CertificateIdentity(current)
+	if err := s.authz.Authorize(identity, authz.ActionRenew, s.cCtx.String("type"), fmt.Sprintf("%x", current.SerialNumber.Bytes())); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	s.issue(w, identity, "simplereenroll", csr, current)
+}
+
+// issue signs a certificate for the CSR, the certificate being renewed, if any, is revoked as superseded
+func (s *estServer) issue(w http.ResponseWriter, identity string, operation string, csr *x509.CertificateRequest, current *x509.Certificate) {
+	cert, err := NewX509ClientCertificate(s.cCtx, s.caCert)
+	if err != nil {
+		http.Error(w, "could not generate certificate template", http.StatusInternalServerError)
+		return
+	}
+
+	if err := setCSRIdentity(cert, csr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.policy.Enforce(s.cCtx.String("type"), cert, csr.PublicKey, s.caCert); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	certBytes, cert, err := signCertificate(cert, csr.PublicKey, s.caCert, s.caPrivKey)
+	if err != nil {
+		log.Printf("[ERROR]: could not create certificate for %s, reason: %v", csr.Subject.CommonName, err)
+		if errors.As(err, new(*certlint.LintError)) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "could not create certificate", http.StatusInternalServerError)
+		return
+	}
+
+	description := s.cCtx.String("description")
+	if description == "" {
+		description = fmt.Sprintf("EST %s", csr.Subject.CommonName)
+	}
+	err = s.model.SaveCertificate(cert.SerialNumber.Int64(), certificate.Type(s.cCtx.String("type")), description, cert.NotAfter, false, "")
+	recordAudit(s.model, identity, "serve-est "+operation, map[string]any{"type": s.cCtx.String("type"), "subject": csr.Subject.String()}, cert.SerialNumber.Int64(), err)
+	if err != nil {
+		log.Printf("[ERROR]: could not save certificate for %s, reason: %v", csr.Subject.CommonName, err)
+		http.Error(w, "could not save certificate", http.StatusInternalServerError)
+		return
+	}
+
+	if current != nil {
+		// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-5.3.1 4 - Superseded
+		info := fmt.Sprintf("renewed by %x", cert.SerialNumber.Bytes())
+		err = s.model.AddRevocation(current.SerialNumber.Int64(), 4, info)
+		recordAudit(s.model, identity, "serve-est revoke", map[string]any{"reason": 4, "info": info}, current.SerialNumber.Int64(), err)
+		if err != nil {
+			log.Printf("[ERROR]: could not revoke renewed certificate %x, reason: %v", current.SerialNumber.Bytes(), err)
+			http.Error(w, "the certificate was renewed but the old one could not be revoked", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data, err := pkcs7.DegenerateCertificate(certBytes)
+	if err != nil {
+		http.Error(w, "could not encode certificate", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("... EST certificate %x issued to %s", cert.SerialNumber.Bytes(), csr.Subject.CommonName)
+	writeESTResponse(w, "application/pkcs7-mime; smime-type=certs-only", data)
+}
+
+// setCSRIdentity copies the requested identity to a certificate template, the rest of the
+// template comes from the server settings. The SANs are checked as the ones set in the command line
+// and agent URIs can't be requested, they're only issued by serve-enroll
+func setCSRIdentity(cert *x509.Certificate, csr *x509.CertificateRequest) error {
+	for _, name := range csr.DNSNames {
+		if err := validateDNSName(name); err != nil {
+			return err
+		}
+	}
+
+	ips := []string{}
+	for _, ip := range csr.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	validIPs, err := validateIPSANs(strings.Join(ips, ","))
+	if err != nil {
+		return err
+	}
+
+	for _, email := range csr.EmailAddresses {
+		if strings.Contains(email, ",") {
+			return fmt.Errorf("the email SAN %q is not a valid email address, e.g user@example.com", email)
+		}
+		if _, err := validateEmailSANs(email); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range csr.URIs {
+		if strings.Contains(u.String(), ",") {
+			return fmt.Errorf("the URI SAN %q can't contain commas", u.String())
+		}
+		if _, err := validateURISANs(u.String()); err != nil {
+			return err
+		}
+		if strings.EqualFold(u.Scheme, "urn") && strings.HasPrefix(strings.ToLower(u.Opaque), "openuem:") {
+			return fmt.Errorf("the URI SAN %q can't be requested, OpenUEM URIs are only issued by the enrollment server", u.String())
+		}
+	}
+
+	cert.Subject.CommonName = csr.Subject.CommonName
+	cert.DNSNames = csr.DNSNames
+	cert.IPAddresses = validIPs
+	cert.EmailAddresses = csr.EmailAddresses
+	cert.URIs = csr.URIs
+	return nil
+}
+
+// sameSubjectAltNames checks that a renewal requests the SANs of the certificate being renewed, so a
+// renewal can't add names the certificate wasn't issued for
+func sameSubjectAltNames(csr *x509.CertificateRequest, current *x509.Certificate) bool {
+	names := func(dnsNames []string, ips []net.IP, emails []string, uris []*url.URL) []string {
+		all := []string{}
+		for _, name := range dnsNames {
+			all = append(all, "dns:"+strings.ToLower(name))
+		}
+		for _, ip := range ips {
+			all = append(all, "ip:"+ip.String())
+		}
+		for _, email := range emails {
+			all = append(all, "email:"+email)
+		}
+		for _, u := range uris {
+			all = append(all, "uri:"+u.String())
+		}
+		slices.Sort(all)
+		return slices.Compact(all)
+	}
+	return slices.Equal(names(csr.DNSNames, csr.IPAddresses, csr.EmailAddresses, csr.URIs),
+		names(current.DNSNames, current.IPAddresses, current.EmailAddresses, current.URIs))
+}
+
+// authenticated checks the HTTP basic credentials or, if none were sent, the client certificate and
+// returns the identity of the client
+func (s *estServer) authenticated(r *http.Request) (string, bool) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		if s.username == "" {
+			return "", false
+		}
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.password)) == 1
+		return authz.BasicIdentity(user), userOK && passOK
+	}
+
+	cert := s.clientCertificate(r)
+	if cert == nil {
+		return "", false
+	}
+	return authz.CertificateIdentity(cert), true
+}
+
+// clientCertificate returns the verified TLS client certificate if it has the type of the certificates
+// this server issues and it hasn't been revoked
+func (s *estServer) clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if err := checkCertificateType(s.model, cert, s.cCtx.String("type")); err != nil {
+		log.Printf("[WARN]: the client certificate was rejected, reason: %v", err)
+		return nil
+	}
+
+	revoked, err := s.model.IsRevoked(cert.SerialNumber.Int64())
+	if err != nil {
+		log.Printf("[ERROR]: could not check if certificate %x is revoked, reason: %v", cert.SerialNumber.Bytes(), err)
+		return nil
+	}
+	if revoked {
+		return nil
+	}
+	return cert
+}
+
+// readESTRequest decodes a base64 encoded PKCS#10 request
+func readESTRequest(r *http.Request) (*x509.CertificateRequest, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("could not read request")
+	}
+
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("the request is not base64 encoded")
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the certificate request")
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("the certificate request signature is not valid")
+	}
+	return csr, nil
+}
+
+func writeESTResponse(w http.ResponseWriter, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	if _, err := w.Write([]byte(base64.StdEncoding.EncodeToString(data))); err != nil {
+		log.Printf("[ERROR]: could not write EST response, reason: %v", err)
+	}
+}
+
+func serveESTFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "cacert",
+			Usage:    "the path to your CA certificate file in PEM format",
+			EnvVars:  []string{"CA_CRT_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cakey",
+			Usage:    "the path to your CA private key file in PEM format",
+			EnvVars:  []string{"CA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: ":8446",
+			Usage: "the address where the EST server listens",
+		},
+		&cli.StringFlag{
+			Name:     "tls-cert",
+			Usage:    "the path to the EST server certificate in PEM format",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "tls-key",
+			Usage:    "the path to the EST server private key in PEM format",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "username",
+			Usage:   "the username for HTTP basic authentication, if not set clients must authenticate with a certificate",
+			EnvVars: []string{"EST_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "password",
+			Usage:   "the password for HTTP basic authentication",
+			EnvVars: []string{"EST_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:  "type",
+			Value: "agent",
+			Usage: "OpenUEM client type assigned to the certificates issued (one of 'console', 'worker', 'sftp', 'updater' or 'agent')",
+		},
+		&cli.StringFlag{
+			Name:  "description",
+			Value: "",
+			Usage: "an optional description for the certificates issued, the requested common name is used by default",
+		},
+		&cli.StringFlag{
+			Name:  "org",
+			Value: "",
+			Usage: "organization name associated with this CA",
+		},
+		&cli.StringFlag{
+			Name:  "country",
+			Value: "",
+			Usage: "two-letter ISO_3166 country code",
+		},
+		&cli.StringFlag{
+			Name:  "province",
+			Value: "",
+			Usage: "the province your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "locality",
+			Value: "",
+			Usage: "the locality your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Value: "",
+			Usage: "the address your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "postal-code",
+			Value: "",
+			Usage: "the postal code associated with your organization's address",
+		},
+		&cli.IntFlag{
+			Name:  "years-valid",
+			Value: 1,
+			Usage: "the number of years for which the certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "months-valid",
+			Value: 0,
+			Usage: "the number of months for which the certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "days-valid",
+			Value: 0,
+			Usage: "the number of days for which the certificates will be valid",
+		},
+		&cli.StringFlag{
+			Name:     "ocsp",
+			Usage:    "the url of the OCSP responder, e.g https://ocsp.example.com",
+			EnvVars:  []string{"OCSP"},
+			Required: true,
+		},
+		policyFlag(),
+		certPolicyFlag(),
+		dbURLFlag(),
+	}, pkiConfigFlags()...)
+}
@@ -0,0 +1,137 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/urfave/cli/v2"
+)
+
+func newTestModel(t *testing.T) *models.Model {
+	t.Helper()
+	model, err := models.New(models.SQLiteScheme + filepath.Join(t.TempDir(), "pki.db"))
+	if err != nil {
+		t.Fatalf("could not open the SQLite database: %v", err)
+	}
+	t.Cleanup(model.Close)
+	return model
+}
+
+// newTestCA returns a self-signed CA certificate and its key
+func newTestCA(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "OpenUEM Test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// newTestClientCert issues a client certificate with the CA and saves it with the type
+func newTestClientCert(t *testing.T, model *models.Model, caCert *x509.Certificate, caKey *rsa.PrivateKey, serial int64, certType certificate.Type) *x509.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: string(certType)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := model.SaveCertificate(serial, certType, string(certType), cert.NotAfter, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// newTestContext returns a command context with the flags set to the values
+func newTestContext(t *testing.T, values map[string]string) *cli.Context {
+	t.Helper()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for name, value := range values {
+		set.String(name, value, "")
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func TestESTRejectsOtherCertificateTypes(t *testing.T) {
+	model := newTestModel(t)
+	caCert, caKey := newTestCA(t)
+	agent := newTestClientCert(t, model, caCert, caKey, 100, certificate.TypeAgent)
+	console := newTestClientCert(t, model, caCert, caKey, 101, certificate.TypeConsole)
+
+	s := &estServer{
+		cCtx:      newTestContext(t, map[string]string{"type": "console"}),
+		model:     model,
+		caCert:    caCert,
+		caPrivKey: caKey,
+	}
+
+	request := func(path string, cert *x509.Certificate) int {
+		r := httptest.NewRequest(http.MethodPost, estPathPrefix+path, strings.NewReader(""))
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, caCert}}}
+		w := httptest.NewRecorder()
+		if path == "/simplereenroll" {
+			s.simpleReenroll(w, r)
+		} else {
+			s.simpleEnroll(w, r)
+		}
+		return w.Code
+	}
+
+	// An agent certificate can't be renewed or exchanged for a console certificate
+	for _, path := range []string{"/simplereenroll", "/simpleenroll"} {
+		if code := request(path, agent); code != http.StatusUnauthorized {
+			t.Fatalf("%s with an agent certificate returned %d", path, code)
+		}
+	}
+
+	// A console certificate is accepted and the empty request is rejected after authenticating
+	for _, path := range []string{"/simplereenroll", "/simpleenroll"} {
+		if code := request(path, console); code != http.StatusBadRequest {
+			t.Fatalf("%s with a console certificate returned %d", path, code)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/smallstep/pkcs7"
+	"github.com/urfave/cli/v2"
+)
+
+// certMaxAge is how long clients may cache the certificates of the repository
+const certMaxAge = 24 * time.Hour
+
+type repoServer struct {
+	model  *models.Model
+	caCert *x509.Certificate
+	chain  []*x509.Certificate
+	crl    *crlSigner
+}
+
+func ServeRepository() *cli.Command {
+	return &cli.Command{
+		Name:   "serve-repo",
+		Usage:  "Start an HTTP server that publishes the CA certificates, chain bundles and the latest CRL at stable URLs for the AIA and CDP extensions",
+		Action: serveRepository,
+		Flags:  serveRepositoryFlags(),
+	}
+}
+
+func serveRepository(cCtx *cli.Context) error {
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	log.Printf("... reading CA cert PEM file")
+	caCert, err := utils.ReadPEMCertificate(cCtx.String("cacert"))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
+	if err != nil {
+		return err
+	}
+
+	chain := []*x509.Certificate{}
+	for _, filename := range splitSANs(cCtx.String("chain")) {
+		cert, err := utils.ReadPEMCertificate(filename)
+		if err != nil {
+			return fmt.Errorf("could not read chain certificate %s, reason: %s", filename, err.Error())
+		}
+		chain = append(chain, cert)
+	}
+
+	if cCtx.Int("crl-validity") < 1 {
+		return fmt.Errorf("the CRL must be valid for at least one hour")
+	}
+
+	s := &repoServer{
+		model:  model,
+		caCert: caCert,
+		chain:  chain,
+		crl:    newCRLSigner(model, caCert, caPrivKey, time.Duration(cCtx.Int("crl-validity"))*time.Hour, "serve-repo crl"),
+	}
+
+	log.Printf("... signing the CRL")
+	if err := s.crl.refresh(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.crl.run(done)
+
+	srv := &http.Server{
+		Addr:    cCtx.String("listen"),
+		Handler: s.Handler(),
+	}
+
+	log.Printf("... listening for repository requests on %s", srv.Addr)
+	return runHTTPServer(srv, cCtx.String("tls-cert"), cCtx.String("tls-key"))
+}
+
+// Handler serves:
+//
+//	/ca.cer and /ca.pem               the CA certificate in DER and PEM format
+//	/certs/<name>.cer and .pem        each certificate of the chain by its common name
+//	/chain.pem and /chain.p7c         the CA certificate and its chain as a PEM bundle and a PKCS#7 certs-only file
+//	/ca.crl                           the latest CRL in DER format
+func (s *repoServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ca.cer", func(w http.ResponseWriter, r *http.Request) {
+		serveRepoFile(w, r, "application/pkix-cert", s.caCert.Raw, s.caCert.NotBefore, certMaxAge)
+	})
+	mux.HandleFunc("GET /ca.pem", func(w http.ResponseWriter, r *http.Request) {
+		serveRepoFile(w, r, "application/x-pem-file", encodeCertificates(s.caCert), s.caCert.NotBefore, certMaxAge)
+	})
+	mux.HandleFunc("GET /certs/{file}", s.chainCertificate)
+	mux.HandleFunc("GET /chain.pem", func(w http.ResponseWriter, r *http.Request) {
+		serveRepoFile(w, r, "application/x-pem-file", encodeCertificates(s.bundle()...), s.caCert.NotBefore, certMaxAge)
+	})
+	mux.HandleFunc("GET /chain.p7c", s.chainPKCS7)
+	mux.HandleFunc("GET /ca.crl", s.latestCRL)
+	return mux
+}
+
+func (s *repoServer) chainCertificate(w http.ResponseWriter, r *http.Request) {
+	file := r.PathValue("file")
+	name, ext := strings.TrimSuffix(file, filepath.Ext(file)), filepath.Ext(file)
+	for _, cert := range s.chain {
+		if chainCertificateName(cert) != name {
+			continue
+		}
+		switch ext {
+		case ".cer":
+			serveRepoFile(w, r, "application/pkix-cert", cert.Raw, cert.NotBefore, certMaxAge)
+			return
+		case ".pem":
+			serveRepoFile(w, r, "application/x-pem-file", encodeCertificates(cert), cert.NotBefore, certMaxAge)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *repoServer) chainPKCS7(w http.ResponseWriter, r *http.Request) {
+	der := []byte{}
+	for _, cert := range s.bundle() {
+		der = append(der, cert.Raw...)
+	}
+
+	data, err := pkcs7.DegenerateCertificate(der)
+	if err != nil {
+		log.Printf("[ERROR]: could not encode the certificate chain, reason: %v", err)
+		http.Error(w, "could not encode the certificate chain", http.StatusInternalServerError)
+		return
+	}
+	serveRepoFile(w, r, "application/pkcs7-mime", data, s.caCert.NotBefore, certMaxAge)
+}
+
+func (s *repoServer) latestCRL(w http.ResponseWriter, r *http.Request) {
+	// A new CRL may be signed at the next check if a certificate is revoked
+	crl := s.crl.latest()
+	serveRepoFile(w, r, "application/pkix-crl", crl.der, crl.thisUpdate, crlCheckInterval)
+}
+
+// bundle returns the CA certificate followed by its chain
+func (s *repoServer) bundle() []*x509.Certificate {
+	return append([]*x509.Certificate{s.caCert}, s.chain...)
+}
+
+// chainCertificateName is the name of a chain certificate in the repository URLs, derived from its
+// common name so it doesn't change when the file is renamed
+func chainCertificateName(cert *x509.Certificate) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		default:
+			return '-'
+		}
+	}, cert.Subject.CommonName)
+
+	if name == "" {
+		sum := sha256.Sum256(cert.Raw)
+		name = hex.EncodeToString(sum[:8])
+	}
+	return name
+}
+
+func encodeCertificates(certs ...*x509.Certificate) []byte {
+	data := []byte{}
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return data
+}
+
+// serveRepoFile writes a file with caching headers, an ETag derived from its content lets clients
+// revalidate their copy with If-None-Match
+func serveRepoFile(w http.ResponseWriter, r *http.Request, contentType string, data []byte, modified time.Time, maxAge time.Duration) {
+	sum := sha256.Sum256(data)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	http.ServeContent(w, r, "", modified, bytes.NewReader(data))
+}
+
+func serveRepositoryFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "cacert",
+			Usage:    "the path to your CA certificate file in PEM format",
+			EnvVars:  []string{"CA_CRT_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cakey",
+			Usage:    "the path to your CA private key file in PEM format, used to sign the CRL",
+			EnvVars:  []string{"CA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "chain",
+			Usage: "comma-separated list of PEM files with the certificates above your CA up to the root, they're added to the chain bundles",
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: ":8080",
+			Usage: "the address where the repository server listens",
+		},
+		&cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "the path to the server certificate in PEM format, AIA and CDP URLs usually use plain HTTP",
+		},
+		&cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "the path to the server private key in PEM format",
+		},
+		&cli.IntFlag{
+			Name:  "crl-validity",
+			Value: 24,
+			Usage: "the number of hours until the next update of the CRL, a new CRL is signed when a certificate is revoked or once half of this time has passed",
+		},
+		dbURLFlag(),
+	}
+}
@@ -0,0 +1,427 @@
+package commands
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/openuem-cert-manager/internal/authz"
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/smallstep/pkcs7"
+	"github.com/smallstep/scep"
+	"github.com/urfave/cli/v2"
+)
+
+// Ref: https://datatracker.ietf.org/doc/html/rfc8894
+const scepCapabilities = "POSTPKIOperation\nRenewal\nSHA-1\nSHA-256\nAES\nDES3\nSCEPStandard\n"
+
+type scepServer struct {
+	cCtx      *cli.Context
+	model     *models.Model
+	caCert    *x509.Certificate
+	caPrivKey *rsa.PrivateKey
+	challenge string
+	authz     *authz.Authorizer
+	policy    *certpolicy.Policy
+}
+
+func ServeSCEP() *cli.Command {
+	return &cli.Command{
+		Name:   "serve-scep",
+		Usage:  "Start a SCEP server to enroll devices that only support the Simple Certificate Enrollment Protocol",
+		Action: serveSCEP,
+		Flags:  serveSCEPFlags(),
+	}
+}
+
+func serveSCEP(cCtx *cli.Context) error {
+	if !isValidCertificateType(cCtx.String("type")) {
+		return fmt.Errorf("type is not one of 'console', 'worker', 'sftp', 'updater' or 'agent'")
+	}
+
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	log.Printf("... reading CA cert PEM file")
+	caCert, err := utils.ReadPEMCertificate(cCtx.String("cacert"))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading CA private key PEM file")
+	caPrivKey, err := utils.ReadPEMPrivateKey(cCtx.String("cakey"))
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := authz.NewAuthorizer(cCtx.String("policy"), model)
+	if err != nil {
+		return err
+	}
+
+	certPolicy, err := certpolicy.LoadOptional(cCtx.String("cert-policy"))
+	if err != nil {
+		return err
+	}
+
+	if err := loadPKIConfig(cCtx, model); err != nil {
+		return err
+	}
+
+	s := &scepServer{
+		cCtx:      cCtx,
+		model:     model,
+		caCert:    caCert,
+		caPrivKey: caPrivKey,
+		challenge: cCtx.String("challenge"),
+		authz:     authorizer,
+		policy:    certPolicy,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scep", s.handler)
+
+	srv := &http.Server{
+		Addr:    cCtx.String("listen"),
+		Handler: mux,
+	}
+
+	log.Printf("... listening for SCEP requests on %s", srv.Addr)
+	return runHTTPServer(srv, cCtx.String("tls-cert"), cCtx.String("tls-key"))
+}
+
+func (s *scepServer) handler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("operation") {
+	case "GetCACert":
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		if _, err := w.Write(s.caCert.Raw); err != nil {
+			log.Printf("[ERROR]: could not write SCEP response, reason: %v", err)
+		}
+	case "GetCACaps":
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := w.Write([]byte(scepCapabilities)); err != nil {
+			log.Printf("[ERROR]: could not write SCEP response, reason: %v", err)
+		}
+	case "PKIOperation":
+		s.pkiOperation(w, r)
+	default:
+		http.Error(w, "unsupported SCEP operation", http.StatusBadRequest)
+	}
+}
+
+func (s *scepServer) pkiOperation(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err = base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+	case http.MethodPost:
+		data, err = io.ReadAll(io.LimitReader(r.Body, 1024*1024))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "could not read the PKI message", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		http.Error(w, "could not parse the PKI message", http.StatusBadRequest)
+		return
+	}
+
+	if err := msg.DecryptPKIEnvelope(s.caCert, s.caPrivKey); err != nil {
+		http.Error(w, "could not decrypt the PKI message", http.StatusBadRequest)
+		return
+	}
+
+	var resp *scep.PKIMessage
+	crt, err := s.issue(msg)
+	if err != nil {
+		log.Printf("[WARN]: SCEP %s transaction %s rejected, reason: %v", msg.MessageType, msg.TransactionID, err)
+		resp, err = msg.Fail(s.caCert, s.caPrivKey, scep.BadRequest)
+	} else {
+		resp, err = msg.Success(s.caCert, s.caPrivKey, crt)
+	}
+	if err != nil {
+		log.Printf("[ERROR]: could not create SCEP response, reason: %v", err)
+		http.Error(w, "could not create the SCEP response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pki-message")
+	if _, err := w.Write(resp.Raw); err != nil {
+		log.Printf("[ERROR]: could not write SCEP response, reason: %v", err)
+	}
+}
+
+func (s *scepServer) issue(msg *scep.PKIMessage) (*x509.Certificate, error) {
+	csr := msg.CSR
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("the CSR signature is not valid")
+	}
+
+	// The requested identity is checked before a one-time challenge is consumed
+	cert, err := NewX509ClientCertificate(s.cCtx, s.caCert)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setCSRIdentity(cert, csr); err != nil {
+		return nil, err
+	}
+
+	var renewed *x509.Certificate
+	identity, operation, token := "", "", ""
+	switch msg.MessageType {
+	case scep.PKCSReq:
+		identity, token, err = s.checkChallenge(msg.ChallengePassword)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.authz.Authorize(identity, authz.ActionIssue, s.cCtx.String("type"), csr.Subject.CommonName); err != nil {
+			return nil, err
+		}
+		operation = "enroll"
+	case scep.RenewalReq:
+		signer, err := s.checkRenewal(msg, csr)
+		if err != nil {
+			return nil, err
+		}
+		renewed, identity, operation = signer, authz.CertificateIdentity(signer), "renew"
+		if err := s.authz.Authorize(identity, authz.ActionRenew, s.cCtx.String("type"), fmt.Sprintf("%x", signer.SerialNumber.Bytes())); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("message type %s is not supported", msg.MessageType)
+	}
+
+	if err := s.policy.Enforce(s.cCtx.String("type"), cert, csr.PublicKey, s.caCert); err != nil {
+		return nil, err
+	}
+
+	description := s.cCtx.String("description")
+	if description == "" {
+		description = fmt.Sprintf("SCEP %s", csr.Subject.CommonName)
+	}
+	certType := certificate.Type(s.cCtx.String("type"))
+
+	var issued *x509.Certificate
+	if token != "" {
+		// The token is consumed in the same transaction that saves the certificate, so a request that
+		// fails when the certificate is signed or saved doesn't use the challenge
+		var issueErr error
+		err = s.model.EnrollCertificate(token, certType, csr.Subject.CommonName, description, func(*models.EnrollmentToken) (*x509.Certificate, error) {
+			_, issued, issueErr = signCertificate(cert, csr.PublicKey, s.caCert, s.caPrivKey)
+			return issued, issueErr
+		})
+		if issueErr != nil {
+			return nil, issueErr
+		}
+		if errors.Is(err, models.ErrInvalidEnrollmentToken) {
+			return nil, fmt.Errorf("the challenge password is not valid")
+		}
+	} else {
+		_, issued, err = signCertificate(cert, csr.PublicKey, s.caCert, s.caPrivKey)
+		if err != nil {
+			return nil, err
+		}
+		err = s.model.SaveCertificate(issued.SerialNumber.Int64(), certType, description, issued.NotAfter, false, "")
+	}
+
+	serial := int64(0)
+	if err == nil {
+		serial = issued.SerialNumber.Int64()
+	}
+	recordAudit(s.model, identity, "serve-scep "+operation, map[string]any{"type": s.cCtx.String("type"), "subject": csr.Subject.String()}, serial, err)
+	if err != nil {
+		return nil, err
+	}
+	cert = issued
+
+	if renewed != nil {
+		// Ref: https://datatracker.ietf.org/doc/html/rfc5280#section-5.3.1 4 - Superseded
+		info := fmt.Sprintf("renewed by %x", cert.SerialNumber.Bytes())
+		err = s.model.AddRevocation(renewed.SerialNumber.Int64(), 4, info)
+		recordAudit(s.model, identity, "serve-scep revoke", map[string]any{"reason": 4, "info": info}, renewed.SerialNumber.Int64(), err)
+		if err != nil {
+			return nil, fmt.Errorf("the certificate was renewed but the old one could not be revoked, reason: %v", err)
+		}
+	}
+
+	log.Printf("... SCEP certificate %x issued to %s", cert.SerialNumber.Bytes(), csr.Subject.CommonName)
+	return cert, nil
+}
+
+// checkChallenge accepts the static challenge password or an enrollment token and returns the
+// identity of the client and the token, the token is only consumed when the certificate is saved
+func (s *scepServer) checkChallenge(challenge string) (string, string, error) {
+	if challenge == "" {
+		return "", "", fmt.Errorf("a challenge password is required")
+	}
+
+	if s.challenge != "" && subtle.ConstantTimeCompare([]byte(challenge), []byte(s.challenge)) == 1 {
+		return authz.SCEPChallengeIdentity, "", nil
+	}
+	return authz.EnrollmentTokenIdentity, challenge, nil
+}
+
+// checkRenewal verifies that a renewal is signed with a valid certificate issued by our CA with
+// the type this server issues for the same subject and SANs and returns that certificate
+func (s *scepServer) checkRenewal(msg *scep.PKIMessage, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	p7, err := pkcs7.Parse(msg.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, fmt.Errorf("the renewal request must be signed by the current certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.caCert)
+	if _, err := signer.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: time.Now(),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("the renewal request is not signed by a certificate issued by this CA")
+	}
+
+	if err := checkCertificateType(s.model, signer, s.cCtx.String("type")); err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.model.IsRevoked(signer.SerialNumber.Int64())
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("the certificate %x has been revoked", signer.SerialNumber.Bytes())
+	}
+
+	if signer.Subject.String() != csr.Subject.String() {
+		return nil, fmt.Errorf("the CSR subject doesn't match the current certificate subject")
+	}
+	if !sameSubjectAltNames(csr, signer) {
+		return nil, fmt.Errorf("the CSR subject alternative names don't match the current certificate")
+	}
+	return signer, nil
+}
+
+func serveSCEPFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "cacert",
+			Usage:    "the path to your CA certificate file in PEM format",
+			EnvVars:  []string{"CA_CRT_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cakey",
+			Usage:    "the path to your CA private key file in PEM format",
+			EnvVars:  []string{"CA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: ":8447",
+			Usage: "the address where the SCEP server listens",
+		},
+		&cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "the path to the server certificate, SCEP is usually served over plain HTTP",
+		},
+		&cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "the path to the server private key",
+		},
+		&cli.StringFlag{
+			Name:    "challenge",
+			Usage:   "a static challenge password, enrollment tokens are accepted as one-time challenge passwords too",
+			EnvVars: []string{"SCEP_CHALLENGE"},
+		},
+		&cli.StringFlag{
+			Name:  "type",
+			Value: "agent",
+			Usage: "OpenUEM client type assigned to the certificates issued (one of 'console', 'worker', 'sftp', 'updater' or 'agent')",
+		},
+		&cli.StringFlag{
+			Name:  "description",
+			Value: "",
+			Usage: "an optional description for the certificates issued, the requested common name is used by default",
+		},
+		&cli.StringFlag{
+			Name:  "org",
+			Value: "",
+			Usage: "organization name associated with this CA",
+		},
+		&cli.StringFlag{
+			Name:  "country",
+			Value: "",
+			Usage: "two-letter ISO_3166 country code",
+		},
+		&cli.StringFlag{
+			Name:  "province",
+			Value: "",
+			Usage: "the province your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "locality",
+			Value: "",
+			Usage: "the locality your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Value: "",
+			Usage: "the address your organization is located",
+		},
+		&cli.StringFlag{
+			Name:  "postal-code",
+			Value: "",
+			Usage: "the postal code associated with your organization's address",
+		},
+		&cli.IntFlag{
+			Name:  "years-valid",
+			Value: 1,
+			Usage: "the number of years for which the certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "months-valid",
+			Value: 0,
+			Usage: "the number of months for which the certificates will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "days-valid",
+			Value: 0,
+			Usage: "the number of days for which the certificates will be valid",
+		},
+		&cli.StringFlag{
+			Name:     "ocsp",
+			Usage:    "the url of the OCSP responder, e.g https://ocsp.example.com",
+			EnvVars:  []string{"OCSP"},
+			Required: true,
+		},
+		policyFlag(),
+		certPolicyFlag(),
+		dbURLFlag(),
+	}, pkiConfigFlags()...)
+}
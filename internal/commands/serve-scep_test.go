@@ -0,0 +1,182 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/open-uem/ent/certificate"
+	"github.com/open-uem/openuem-cert-manager/internal/certpolicy"
+	"github.com/smallstep/scep"
+	"github.com/smallstep/scep/x509util"
+)
+
+// newSCEPMessage returns the message a SCEP client sends for a CSR with the challenge, signed with the
+// signer certificate or a self-signed one
+func newSCEPMessage(t *testing.T, caCert *x509.Certificate, msgType scep.MessageType, challenge string, key *rsa.PrivateKey, signer *x509.Certificate) *scep.PKIMessage {
+	t.Helper()
+	der, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{Subject: pkix.Name{CommonName: "printer01"}},
+		ChallengePassword:  challenge,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signer == nil {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "printer01"},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer, err = x509.ParseCertificate(der); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: msgType,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   key,
+		SignerCert:  signer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server parses and decrypts the message as it's received
+	parsed, err := scep.ParsePKIMessage(msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestSCEPEnrollmentToken(t *testing.T) {
+	model := newTestModel(t)
+	caCert, caKey := newTestCA(t)
+
+	if err := model.SaveEnrollmentToken("one-time", "printers", "office", "tenant1", 1, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &scepServer{
+		cCtx:      newTestContext(t, map[string]string{"type": "agent", "days-valid": "30", "ocsp": "http://ocsp.example.com"}),
+		model:     model,
+		caCert:    caCert,
+		caPrivKey: caKey,
+		policy:    &certpolicy.Policy{Types: map[string]certpolicy.Constraints{"agent": {MinRSABits: 4096}}},
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enroll := func() (*x509.Certificate, error) {
+		msg := newSCEPMessage(t, caCert, scep.PKCSReq, "one-time", key, nil)
+		if err := msg.DecryptPKIEnvelope(caCert, caKey); err != nil {
+			t.Fatal(err)
+		}
+		return s.issue(msg)
+	}
+
+	// A certificate rejected by the policy doesn't use the token
+	if _, err := enroll(); err == nil {
+		t.Fatal("the policy didn't reject the certificate")
+	}
+	tokens, err := model.GetEnrollmentTokens()
+	if err != nil || len(tokens) != 1 || tokens[0].Uses != 0 {
+		t.Fatalf("the token was used by a rejected request: %+v, %v", tokens, err)
+	}
+
+	s.policy = nil
+	cert, err := enroll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The enrollment keeps the site and tenant of the token
+	site, tenant := "", ""
+	if err := model.DB.QueryRow(`SELECT site, tenant FROM agent_enrollments WHERE serial = ?`, cert.SerialNumber.Int64()).Scan(&site, &tenant); err != nil {
+		t.Fatal(err)
+	}
+	if site != "office" || tenant != "tenant1" {
+		t.Fatalf("unexpected enrollment site %q and tenant %q", site, tenant)
+	}
+
+	if _, err := enroll(); err == nil {
+		t.Fatal("the one-time token was used twice")
+	}
+}
+
+func TestSCEPRenewalRejectsOtherCertificateTypes(t *testing.T) {
+	model := newTestModel(t)
+	caCert, caKey := newTestCA(t)
+
+	s := &scepServer{
+		cCtx:      newTestContext(t, map[string]string{"type": "agent", "days-valid": "30", "ocsp": "http://ocsp.example.com"}),
+		model:     model,
+		caCert:    caCert,
+		caPrivKey: caKey,
+	}
+
+	renew := func(certType certificate.Type, serial int64) error {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "printer01"},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := model.SaveCertificate(serial, certType, "printer01", signer.NotAfter, false, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		msg := newSCEPMessage(t, caCert, scep.RenewalReq, "", key, signer)
+		if err := msg.DecryptPKIEnvelope(caCert, caKey); err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.issue(msg)
+		return err
+	}
+
+	if err := renew(certificate.TypeConsole, 200); err == nil {
+		t.Fatal("a console certificate was renewed as an agent certificate")
+	}
+	if revoked, err := model.IsRevoked(200); err != nil || revoked {
+		t.Fatalf("the rejected certificate was revoked, %v", err)
+	}
+
+	if err := renew(certificate.TypeAgent, 201); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := model.IsRevoked(201); err != nil || !revoked {
+		t.Fatalf("the renewed certificate was not revoked, %v", err)
+	}
+}
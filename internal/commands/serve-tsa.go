@@ -0,0 +1,231 @@
+package commands
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitorus/timestamp"
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/openuem-cert-manager/internal/tsa"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+)
+
+type tsaServer struct {
+	model     *models.Model
+	authority *tsa.Authority
+}
+
+func ServeTSA() *cli.Command {
+	return &cli.Command{
+		Name:   "serve-tsa",
+		Usage:  "Start an RFC 3161 time-stamping authority that answers TimeStampReq requests over HTTP so code signatures stay valid after the signing certificate expires",
+		Action: serveTSA,
+		Flags:  serveTSAFlags(),
+	}
+}
+
+func serveTSA(cCtx *cli.Context) error {
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	log.Printf("... reading TSA cert PEM file")
+	tsaCert, err := utils.ReadPEMCertificate(cCtx.String("tsa-cert"))
+	if err != nil {
+		return err
+	}
+	if err := tsa.CheckCertificate(tsaCert); err != nil {
+		return err
+	}
+	if time.Now().After(tsaCert.NotAfter) {
+		return fmt.Errorf("the TSA certificate expired on %s", tsaCert.NotAfter.Format(time.RFC3339))
+	}
+
+	log.Printf("... reading TSA private key PEM file")
+	tsaKey, err := utils.ReadPEMPrivateKey(cCtx.String("tsa-key"))
+	if err != nil {
+		return err
+	}
+
+	chain := []*x509.Certificate{}
+	if cCtx.String("cacert") != "" {
+		caCert, err := utils.ReadPEMCertificate(cCtx.String("cacert"))
+		if err != nil {
+			return err
+		}
+		if err := tsaCert.CheckSignatureFrom(caCert); err != nil {
+			return fmt.Errorf("the TSA certificate was not issued by the CA, reason: %s", err.Error())
+		}
+		chain = append(chain, caCert)
+	}
+
+	policy, err := parseOID(cCtx.String("policy"))
+	if err != nil {
+		return err
+	}
+
+	if cCtx.Int("accuracy") < 0 {
+		return fmt.Errorf("the accuracy can't be negative")
+	}
+
+	s := &tsaServer{
+		model: model,
+		authority: &tsa.Authority{
+			Cert:     tsaCert,
+			Signer:   tsaKey,
+			Chain:    chain,
+			Policy:   policy,
+			Accuracy: time.Duration(cCtx.Int("accuracy")) * time.Second,
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", s.timestamp)
+
+	srv := &http.Server{
+		Addr:    cCtx.String("listen"),
+		Handler: mux,
+	}
+
+	log.Printf("... listening for time-stamp requests on %s", srv.Addr)
+	return runHTTPServer(srv, cCtx.String("tls-cert"), cCtx.String("tls-key"))
+}
+
+// timestamp answers a TimeStampReq, rejected requests get a TimeStampResp with the reason so
+// clients can tell them from transport errors
+// Ref: https://datatracker.ietf.org/doc/html/rfc3161#section-3.4
+func (s *tsaServer) timestamp(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "could not read request", http.StatusBadRequest)
+		return
+	}
+
+	req, err := timestamp.ParseRequest(body)
+	if err != nil {
+		s.reject(w, timestamp.BadDataFormat, "could not parse the time-stamp request")
+		return
+	}
+
+	var reqErr *tsa.RequestError
+	if errors.As(s.authority.Check(req), &reqErr) {
+		s.reject(w, reqErr.Failure, reqErr.Message)
+		return
+	}
+
+	token := &models.TimestampToken{
+		HashAlgorithm:  req.HashAlgorithm.String(),
+		MessageImprint: hex.EncodeToString(req.HashedMessage),
+		Policy:         s.authority.Policy.String(),
+		Requester:      r.RemoteAddr,
+	}
+	if req.Nonce != nil {
+		token.Nonce = req.Nonce.Text(16)
+	}
+
+	resp, err := s.model.IssueTimestampToken(token, func(serial int64, genTime time.Time) ([]byte, error) {
+		return s.authority.Sign(req, big.NewInt(serial), genTime)
+	})
+	if err != nil {
+		log.Printf("[ERROR]: could not issue a time-stamp token, reason: %v", err)
+		s.reject(w, timestamp.SystemFailure, "could not issue the time-stamp token")
+		return
+	}
+
+	log.Printf("... time-stamp token %d issued to %s", token.Serial, r.RemoteAddr)
+	writeTSAResponse(w, resp)
+}
+
+func (s *tsaServer) reject(w http.ResponseWriter, failure timestamp.FailureInfo, message string) {
+	log.Printf("[WARN]: time-stamp request rejected, reason: %s", message)
+	resp, err := tsa.Reject(failure)
+	if err != nil {
+		http.Error(w, "could not encode the time-stamp response", http.StatusInternalServerError)
+		return
+	}
+	writeTSAResponse(w, resp)
+}
+
+func writeTSAResponse(w http.ResponseWriter, resp []byte) {
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	if _, err := w.Write(resp); err != nil {
+		log.Printf("[ERROR]: could not write time-stamp response, reason: %v", err)
+	}
+}
+
+// parseOID parses an object identifier in dotted format e.g 1.3.6.1.4.1.99999.1
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	oid := asn1.ObjectIdentifier{}
+	for _, arc := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(arc)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not a valid OID", s)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 || oid[0] > 2 {
+		return nil, fmt.Errorf("%q is not a valid OID", s)
+	}
+	return oid, nil
+}
+
+func serveTSAFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "tsa-cert",
+			Usage:    "the path to the TSA certificate file in PEM format created with create-tsa-cert",
+			EnvVars:  []string{"TSA_CRT_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "tsa-key",
+			Usage:    "the path to the TSA private key file in PEM format",
+			EnvVars:  []string{"TSA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "cacert",
+			Usage:   "the path to your CA certificate file in PEM format, it's added to the tokens of the clients that ask for the certificates",
+			EnvVars: []string{"CA_CRT_FILENAME"},
+		},
+		&cli.StringFlag{
+			Name:     "policy",
+			Usage:    "the OID of the TSA policy under which tokens are issued e.g 1.3.6.1.4.1.99999.1",
+			EnvVars:  []string{"TSA_POLICY"},
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "accuracy",
+			Value: 1,
+			Usage: "the accuracy of the time of the tokens in seconds, 0 leaves it out",
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: ":8450",
+			Usage: "the address where the TSA listens",
+		},
+		&cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "the path to the server certificate in PEM format",
+		},
+		&cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "the path to the server private key in PEM format",
+		},
+		dbURLFlag(),
+	}
+}
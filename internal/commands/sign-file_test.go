@@ -0,0 +1,184 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitorus/pkcs7"
+	"github.com/open-uem/openuem-cert-manager/internal/tsa"
+	"github.com/urfave/cli/v2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// newTestLeafCert issues a certificate for the template with the CA
+func newTestLeafCert(t *testing.T, caCert *x509.Certificate, caKey *rsa.PrivateKey, template *x509.Certificate) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeTestCACert saves the CA certificate in PEM format and returns its path
+func writeTestCACert(t *testing.T, dir string, caCert *x509.Certificate) string {
+	t.Helper()
+	filename := filepath.Join(dir, "ca.cer")
+	if err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func runSignFileCommand(args ...string) error {
+	app := &cli.App{Commands: []*cli.Command{SignFile(), VerifyFile()}}
+	return app.Run(append([]string{"openuem-cert-manager"}, args...))
+}
+
+func TestVerifyFileRejectsBackdatedSignatures(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := newTestCA(t)
+	cert, key := newTestLeafCert(t, caCert, caKey, &x509.Certificate{
+		SerialNumber: big.NewInt(300),
+		Subject:      pkix.Name{CommonName: "Expired Code Signing"},
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     time.Now().Add(-24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+
+	in := filepath.Join(dir, "script.ps1")
+	data := []byte("Write-Output OpenUEM")
+	if err := os.WriteFile(in, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The holder of the expired key sets a signing time when the certificate was valid, the earlier
+	// attribute is sorted first and it's the one that is read
+	sd, err := pkcs7.NewSignedData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	backdated := pkcs7.Attribute{Type: pkcs7.OIDAttributeSigningTime, Value: time.Now().Add(-36 * time.Hour).UTC()}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{ExtraSignedAttributes: []pkcs7.Attribute{backdated}}); err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	signature, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(in+".p7s", signature, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSignFileCommand("verify-file", "--in", in, "--cacert", writeTestCACert(t, dir, caCert))
+	if err == nil || !strings.Contains(err.Error(), "is not trusted") {
+		t.Fatalf("a backdated signature of an expired certificate was accepted, %v", err)
+	}
+}
+
+func TestSignFileTimeStamp(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := newTestCA(t)
+	cert, key := newTestLeafCert(t, caCert, caKey, &x509.Certificate{
+		SerialNumber: big.NewInt(301),
+		Subject:      pkix.Name{CommonName: "Code Signing"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+
+	eku, err := asn1.Marshal([]asn1.ObjectIdentifier{{1, 3, 6, 1, 5, 5, 7, 3, 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsaCert, tsaKey := newTestLeafCert(t, caCert, caKey, &x509.Certificate{
+		SerialNumber:    big.NewInt(302),
+		Subject:         pkix.Name{CommonName: "OpenUEM Test TSA"},
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 37}, Critical: true, Value: eku}},
+	})
+	s := &tsaServer{
+		model:     newTestModel(t),
+		authority: &tsa.Authority{Cert: tsaCert, Signer: tsaKey, Chain: []*x509.Certificate{caCert}, Policy: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(s.timestamp))
+	defer srv.Close()
+
+	pfxData, err := pkcs12.Modern.Encode(key, cert, []*x509.Certificate{caCert}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx := filepath.Join(dir, "codesigning.pfx")
+	if err := os.WriteFile(pfx, pfxData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	in := filepath.Join(dir, "script.ps1")
+	if err := os.WriteFile(in, []byte("Write-Output OpenUEM"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runSignFileCommand("sign-file", "--pfx", pfx, "--pass", "secret", "--in", in, "--tsa", srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := os.ReadFile(in + ".p7s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	ts, chain, err := verifyTimeStampToken(p7, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts == nil || !chain[0].Equal(tsaCert) {
+		t.Fatalf("the signature was not time-stamped by the TSA")
+	}
+
+	if err := runSignFileCommand("verify-file", "--in", in, "--cacert", writeTestCACert(t, dir, caCert)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A TSA that is not issued by a trusted CA is rejected
+	otherCA, _ := newTestCA(t)
+	otherDir := t.TempDir()
+	if err := runSignFileCommand("verify-file", "--in", in, "--cacert", writeTestCACert(t, otherDir, otherCA)); err == nil {
+		t.Fatal("the signature was accepted with an untrusted CA")
+	}
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherCA)
+	if _, _, err := verifyTimeStampToken(p7, otherRoots); err == nil {
+		t.Fatal("the time-stamp of an untrusted TSA was accepted")
+	}
+}
@@ -0,0 +1,388 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/sassoftware/relic/v7/lib/atomicfile"
+	"github.com/sassoftware/relic/v7/lib/authenticode"
+	"github.com/sassoftware/relic/v7/lib/certloader"
+	"github.com/sassoftware/relic/v7/lib/comdoc"
+	"github.com/sassoftware/relic/v7/lib/pkcs7"
+	"github.com/sassoftware/relic/v7/lib/pkcs9"
+	"github.com/sassoftware/relic/v7/signers/sigerrors"
+	"github.com/urfave/cli/v2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// msiMagic is the signature of the compound documents used by Windows Installer packages
+var msiMagic = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+func SignPE() *cli.Command {
+	return &cli.Command{
+		Name:   "sign-pe",
+		Usage:  "Embed an Authenticode signature in a Windows executable, DLL or MSI package with the PFX file created with code-signing-cert",
+		Action: signPE,
+		Flags:  signPEFlags(),
+	}
+}
+
+func VerifyPE() *cli.Command {
+	return &cli.Command{
+		Name:   "verify-pe",
+		Usage:  "Check the Authenticode signatures of a Windows executable, DLL or MSI package",
+		Action: verifyPE,
+		Flags:  verifyPEFlags(),
+	}
+}
+
+func signPE(cCtx *cli.Context) (err error) {
+	model, err := openAuditModel(cCtx)
+	if err != nil {
+		return err
+	}
+	if model != nil {
+		defer model.Close()
+	}
+
+	serial := int64(0)
+	defer func() { recordCLIAudit(cCtx, model, serial, err) }()
+
+	pass, err := readPassword(cCtx, "pass")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading code signing PFX file")
+	cert, err := readCodeSigningPFX(cCtx.String("pfx"), pass)
+	if err != nil {
+		return err
+	}
+	serial = cert.Leaf.SerialNumber.Int64()
+
+	if cCtx.String("tsa") != "" {
+		cert.Timestamper = &rfc3161Timestamper{url: cCtx.String("tsa"), client: &http.Client{Timeout: 30 * time.Second}}
+	}
+
+	params := &authenticode.OpusParams{
+		Description: cCtx.String("description"),
+		URL:         cCtx.String("url"),
+	}
+
+	// The file is signed in place when in and out are the same
+	in, out := cCtx.String("in"), cCtx.String("out")
+	flag := os.O_RDONLY
+	if filepath.Clean(in) == filepath.Clean(out) {
+		flag, out = os.O_RDWR, in
+	}
+	f, err := os.OpenFile(in, flag, 0)
+	if err != nil {
+		return fmt.Errorf("could not open %s, reason: %s", in, err.Error())
+	}
+	defer f.Close()
+
+	isMSI, err := hasMSIMagic(f)
+	if err != nil {
+		return fmt.Errorf("could not read %s, reason: %s", in, err.Error())
+	}
+
+	if isMSI {
+		log.Printf("... signing MSI package %s", in)
+		err = signMSIFile(cCtx.Context, f, out, cert, params)
+	} else {
+		log.Printf("... signing PE file %s", in)
+		err = signPEFile(cCtx.Context, f, out, cert, params)
+	}
+	if err != nil {
+		return fmt.Errorf("could not sign %s, reason: %s", in, err.Error())
+	}
+
+	if info, err := os.Stat(in); err == nil && out != in {
+		if err := os.Chmod(out, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("✅ Done! Your signed file has been stored in %s\n\n", out)
+	return nil
+}
+
+func signPEFile(ctx context.Context, f *os.File, out string, cert *certloader.Certificate, params *authenticode.OpusParams) error {
+	digest, err := authenticode.DigestPE(f, crypto.SHA256, false)
+	if err != nil {
+		return err
+	}
+
+	patch, _, err := digest.Sign(ctx, cert, params)
+	if err != nil {
+		return err
+	}
+
+	if err := patch.Apply(f, out); err != nil {
+		return err
+	}
+
+	// The checksum of the optional header covers the signature so it's computed again
+	signed, err := os.OpenFile(out, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer signed.Close()
+	return authenticode.FixPEChecksum(signed)
+}
+
+// signMSIFile signs an MSI package with the MsiDigitalSignatureEx stream that covers the metadata
+// of the streams too
+func signMSIFile(ctx context.Context, f *os.File, out string, cert *certloader.Certificate, params *authenticode.OpusParams) error {
+	cdf, err := comdoc.ReadFile(f)
+	if err != nil {
+		return err
+	}
+
+	imprint, prehash, err := authenticode.DigestMSI(cdf, crypto.SHA256, true)
+	if err != nil {
+		return err
+	}
+
+	sig, err := authenticode.SignMSIImprint(ctx, imprint, crypto.SHA256, cert, params)
+	if err != nil {
+		return err
+	}
+
+	af, err := atomicfile.WriteInPlace(f, out)
+	if err != nil {
+		return err
+	}
+	defer af.Close()
+
+	signed, err := comdoc.WriteFile(af.GetFile())
+	if err != nil {
+		return err
+	}
+	if err := authenticode.InsertMSISignature(signed, sig.Raw, prehash); err != nil {
+		return err
+	}
+	if err := signed.Close(); err != nil {
+		return err
+	}
+	return af.Commit()
+}
+
+func verifyPE(cCtx *cli.Context) error {
+	var roots *x509.CertPool
+	if cCtx.String("cacert") != "" {
+		certs, err := readCertificateFile(cCtx.String("cacert"))
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		for _, c := range certs {
+			roots.AddCert(c)
+		}
+	}
+
+	in := cCtx.String("in")
+	f, err := os.Open(in)
+	if err != nil {
+		return fmt.Errorf("could not open %s, reason: %s", in, err.Error())
+	}
+	defer f.Close()
+
+	isMSI, err := hasMSIMagic(f)
+	if err != nil {
+		return fmt.Errorf("could not read %s, reason: %s", in, err.Error())
+	}
+
+	sigs := []pkcs9.TimestampedSignature{}
+	if isMSI {
+		log.Printf("... verifying the signature of MSI package %s", in)
+		sig, err := authenticode.VerifyMSI(f, false)
+		if errors.As(err, &sigerrors.NotSignedError{}) {
+			return fmt.Errorf("%s is not signed", in)
+		}
+		if err != nil {
+			return fmt.Errorf("the signature of %s is not valid, reason: %s", in, err.Error())
+		}
+		sigs = append(sigs, sig.TimestampedSignature)
+	} else {
+		log.Printf("... verifying the signatures of PE file %s", in)
+		peSigs, err := authenticode.VerifyPE(f, false)
+		if errors.As(err, &sigerrors.NotSignedError{}) {
+			return fmt.Errorf("%s is not signed", in)
+		}
+		if err != nil {
+			return fmt.Errorf("the signature of %s is not valid, reason: %s", in, err.Error())
+		}
+		for _, sig := range peSigs {
+			sigs = append(sigs, sig.TimestampedSignature)
+		}
+	}
+
+	if len(sigs) == 0 {
+		return fmt.Errorf("%s is not signed", in)
+	}
+
+	for _, sig := range sigs {
+		fmt.Printf("%s: signed by %s, serial %s\n", in, sig.Certificate.Subject.String(), sig.Certificate.SerialNumber.String())
+		if sig.CounterSignature != nil {
+			fmt.Printf("%s: time-stamped at %s by %s\n", in, sig.CounterSignature.SigningTime.Format(time.RFC3339), sig.CounterSignature.Certificate.Subject.String())
+		} else {
+			fmt.Printf("%s: not time-stamped, the signature is only valid while the certificate is\n", in)
+		}
+
+		// A time-stamped signature is checked at the time of the token so it's still valid when
+		// the certificate expires
+		if err := sig.VerifyChain(roots, nil, x509.ExtKeyUsageCodeSigning); err != nil {
+			return fmt.Errorf("the certificate chain of the signature of %s is not trusted, reason: %s", in, err.Error())
+		}
+	}
+
+	log.Printf("✅ Done! %d valid signatures found in %s\n\n", len(sigs), in)
+	return nil
+}
+
+// readCodeSigningPFX reads the certificate, the chain and the private key of a PFX file, the
+// certificate must be valid and have the codeSigning extended key usage
+func readCodeSigningPFX(filename, password string) (*certloader.Certificate, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s, reason: %s", filename, err.Error())
+	}
+
+	if password == "" {
+		password = pkcs12.DefaultPassword
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s, reason: %s", filename, err.Error())
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("the private key in %s can't be used to sign", filename)
+	}
+	if !slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageCodeSigning) {
+		return nil, fmt.Errorf("the certificate in %s doesn't have the codeSigning extended key usage", filename)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("the certificate in %s is not valid now, it's valid from %s to %s", filename, leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	return &certloader.Certificate{
+		Leaf:         leaf,
+		Certificates: append([]*x509.Certificate{leaf}, chain...),
+		PrivateKey:   signer,
+	}, nil
+}
+
+func hasMSIMagic(f *os.File) (bool, error) {
+	magic := make([]byte, len(msiMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, msiMagic), nil
+}
+
+// rfc3161Timestamper gets the time-stamp tokens of the signatures from a TSA e.g serve-tsa
+// Ref: https://datatracker.ietf.org/doc/html/rfc3161#section-3.4
+type rfc3161Timestamper struct {
+	url    string
+	client *http.Client
+}
+
+func (t *rfc3161Timestamper) Timestamp(ctx context.Context, req *pkcs9.Request) (*pkcs7.ContentInfoSignedData, error) {
+	if req.Legacy {
+		return nil, fmt.Errorf("legacy Authenticode time-stamps are not supported")
+	}
+
+	d := req.Hash.New()
+	d.Write(req.EncryptedDigest)
+	msg, httpReq, err := pkcs9.NewRequest(t.url, req.Hash, d.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("could not contact the TSA, reason: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("could not read the TSA response, reason: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the TSA answered with %s", resp.Status)
+	}
+	return msg.ParseResponse(body)
+}
+
+func signPEFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "pfx",
+			Usage:    "the path to the PFX file with the code signing certificate, its chain and private key",
+			EnvVars:  []string{"CODE_SIGNING_PFX_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "pass",
+			Usage:   "the password of the PFX file (default: changeit)",
+			EnvVars: []string{"CODE_SIGNING_PFX_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:     "in",
+			Usage:    "the path to the executable, DLL or MSI package to be signed",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "out",
+			Usage:    "the path where the signed file will be stored, it can be the same as in",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "tsa",
+			Usage:   "the url of an RFC 3161 time-stamping authority e.g http://tsa.example.com:8450, time-stamped signatures are still valid when the certificate expires",
+			EnvVars: []string{"TSA_URL"},
+		},
+		&cli.StringFlag{
+			Name:  "description",
+			Usage: "the program name shown by Windows when the file is run e.g OpenUEM Agent",
+		},
+		&cli.StringFlag{
+			Name:  "url",
+			Usage: "the url with more information about the program e.g https://openuem.eu",
+		},
+		auditDBURLFlag(),
+	}, passwordFlags("pass")...)
+}
+
+func verifyPEFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "in",
+			Usage:    "the path to the signed executable, DLL or MSI package",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "cacert",
+			Usage:   "the path to the CA certificates trusted to issue code signing and TSA certificates in PEM format, the system roots are used if not set",
+			EnvVars: []string{"CA_CRT_FILENAME"},
+		},
+	}
+}
@@ -0,0 +1,254 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/utils"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultSSHExtensions are the extensions that ssh-keygen adds to user certificates by default
+var defaultSSHExtensions = []string{"permit-X11-forwarding", "permit-agent-forwarding", "permit-port-forwarding", "permit-pty", "permit-user-rc"}
+
+// knownSSHExtensions are the extensions understood by OpenSSH, other extensions must be named
+// like name@domain
+// Ref: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.certkeys
+var knownSSHExtensions = []string{"no-touch-required", "permit-X11-forwarding", "permit-agent-forwarding", "permit-port-forwarding", "permit-pty", "permit-user-rc"}
+
+// sshCertRequest has the settings of an OpenSSH certificate shared by user and host certificates
+type sshCertRequest struct {
+	CertType        uint32
+	Principals      []string
+	CriticalOptions map[string]string
+	Extensions      map[string]string
+}
+
+// signSSHCertificate signs the public key set in the public-key flag with the SSH CA, saves the
+// certificate in database and stores it next to the public key like ssh-keygen does
+func signSSHCertificate(cCtx *cli.Context, req *sshCertRequest) (err error) {
+	log.Printf("... connecting to database")
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+
+	serial := uint64(0)
+	defer func() { recordCLIAudit(cCtx, model, int64(serial), err) }()
+
+	log.Printf("... reading SSH CA private key")
+	caKey, err := readSSHCAKey(cCtx.String("ssh-ca-key"))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("... reading SSH public key")
+	pubKey, err := readSSHPublicKey(cCtx.String("public-key"))
+	if err != nil {
+		return err
+	}
+	if ssh.FingerprintSHA256(pubKey) == ssh.FingerprintSHA256(caKey.PublicKey()) {
+		return fmt.Errorf("the SSH CA can't sign a certificate for its own key")
+	}
+
+	validity := time.Duration(cCtx.Int("days-valid"))*24*time.Hour + time.Duration(cCtx.Int("hours-valid"))*time.Hour
+	if validity <= 0 {
+		return fmt.Errorf("the certificate must be valid for at least one hour, set days-valid or hours-valid")
+	}
+
+	serialNumber, err := utils.GenerateSerialNumber()
+	if err != nil {
+		return err
+	}
+	serial = serialNumber.Uint64()
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pubKey,
+		Serial:          serial,
+		CertType:        req.CertType,
+		KeyId:           cCtx.String("key-id"),
+		ValidPrincipals: req.Principals,
+		ValidAfter:      uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: req.CriticalOptions,
+			Extensions:      req.Extensions,
+		},
+	}
+
+	log.Printf("... signing SSH certificate")
+	if err := cert.SignCert(rand.Reader, caKey); err != nil {
+		return fmt.Errorf("could not sign the SSH certificate, reason: %s", err.Error())
+	}
+
+	log.Printf("... saving SSH certificate info to database")
+	certType := models.SSHUserCertificate
+	if req.CertType == ssh.HostCert {
+		certType = models.SSHHostCertificate
+	}
+	if err := model.SaveSSHCertificate(&models.SSHCertificate{
+		Serial:        serial,
+		CertType:      certType,
+		KeyID:         cert.KeyId,
+		Principals:    cert.ValidPrincipals,
+		Fingerprint:   ssh.FingerprintSHA256(pubKey),
+		CAFingerprint: ssh.FingerprintSHA256(caKey.PublicKey()),
+		ValidAfter:    time.Unix(int64(cert.ValidAfter), 0),
+		ValidBefore:   time.Unix(int64(cert.ValidBefore), 0),
+	}); err != nil {
+		return fmt.Errorf("could not save the SSH certificate in the database, reason: %s", err.Error())
+	}
+
+	path := cCtx.String("dst")
+	if path == "" {
+		path = filepath.Dir(cCtx.String("public-key"))
+	}
+	filename := filepath.Join(path, strings.TrimSuffix(filepath.Base(cCtx.String("public-key")), ".pub")+"-cert.pub")
+
+	log.Printf("... saving SSH certificate to %s", filename)
+	if err := os.WriteFile(filename, marshalSSHPublicKey(cert, cert.KeyId), 0644); err != nil {
+		return fmt.Errorf("could not save the SSH certificate, reason: %s", err.Error())
+	}
+
+	log.Printf("✅ Done! Your SSH certificate with serial %d has been stored in %s\n\n", serial, filename)
+	return nil
+}
+
+func readSSHCAKey(filename string) (ssh.Signer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the SSH CA private key, reason: %s", err.Error())
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the SSH CA private key, reason: %s", err.Error())
+	}
+	return signer, nil
+}
+
+// readSSHPublicKeys reads every key of a file in the authorized_keys format
+func readSSHPublicKeys(filename string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the SSH public key %s, reason: %s", filename, err.Error())
+	}
+
+	keys := []ssh.PublicKey{}
+	for len(strings.TrimSpace(string(data))) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the SSH public key %s, reason: %s", filename, err.Error())
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no SSH public key", filename)
+	}
+	return keys, nil
+}
+
+func readSSHPublicKey(filename string) (ssh.PublicKey, error) {
+	keys, err := readSSHPublicKeys(filename)
+	if err != nil {
+		return nil, err
+	}
+	key := keys[0]
+
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, fmt.Errorf("%s is an SSH certificate, not a public key", filename)
+	}
+	if k, ok := key.(ssh.CryptoPublicKey); ok {
+		if rsaKey, ok := k.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("the RSA key in %s has %d bits, at least 2048 are required", filename, rsaKey.N.BitLen())
+		}
+	}
+	return key, nil
+}
+
+// validateSSHPrincipals checks the comma-separated list of principals, a certificate without
+// principals would be valid for any user or host
+func validateSSHPrincipals(principals string) ([]string, error) {
+	values := splitSANs(principals)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("at least one principal is required")
+	}
+	for _, p := range values {
+		if strings.ContainsAny(p, " \t*?") {
+			return nil, fmt.Errorf("the principal %q can't contain blanks or wildcards", p)
+		}
+	}
+	return values, nil
+}
+
+// validateSSHExtensions checks the comma-separated list of extensions, they have no value
+func validateSSHExtensions(extensions string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, e := range splitSANs(extensions) {
+		if !slices.Contains(knownSSHExtensions, e) && !strings.Contains(e, "@") {
+			return nil, fmt.Errorf("the extension %q is not supported by OpenSSH, custom extensions must be named like name@domain", e)
+		}
+		values[e] = ""
+	}
+	return values, nil
+}
+
+// validateSourceAddresses checks the comma-separated list of addresses in CIDR format allowed by the
+// source-address critical option
+func validateSourceAddresses(addresses string) (string, error) {
+	values := splitSANs(addresses)
+	for _, a := range values {
+		if _, _, err := net.ParseCIDR(a); err != nil && net.ParseIP(a) == nil {
+			return "", fmt.Errorf("the source address %q is not an IP address or a network in CIDR format", a)
+		}
+	}
+	return strings.Join(values, ","), nil
+}
+
+// sshCertFlags are shared by the commands that sign OpenSSH certificates
+func sshCertFlags(daysValid int) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "ssh-ca-key",
+			Usage:    "the path to your SSH CA private key file in OpenSSH format",
+			EnvVars:  []string{"SSH_CA_KEY_FILENAME"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "public-key",
+			Usage:    "the path to the OpenSSH public key to be signed e.g id_ed25519.pub",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "key-id",
+			Usage:    "the identity of the certificate, sshd logs it when the certificate is used",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "days-valid",
+			Value: daysValid,
+			Usage: "the number of days for which the certificate will be valid",
+		},
+		&cli.IntFlag{
+			Name:  "hours-valid",
+			Usage: "the number of hours for which the certificate will be valid, added to days-valid",
+		},
+		dbURLFlag(),
+		&cli.StringFlag{
+			Name:  "dst",
+			Usage: "the folder where the certificate will be stored, by default the folder of the public key",
+		},
+	}
+}
@@ -0,0 +1,48 @@
+package commands
+
+import (
+	"net"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+func SSHHostCertificate() *cli.Command {
+	return &cli.Command{
+		Name:   "ssh-host-cert",
+		Usage:  "Sign an OpenSSH host public key with the SSH CA so clients trust the host without asking for its fingerprint",
+		Action: generateSSHHostCert,
+		Flags:  generateSSHHostCertFlags(),
+	}
+}
+
+func generateSSHHostCert(cCtx *cli.Context) error {
+	principals, err := validateSSHPrincipals(cCtx.String("principals"))
+	if err != nil {
+		return err
+	}
+	for _, p := range principals {
+		if net.ParseIP(p) != nil {
+			continue
+		}
+		if err := validateDNSName(p); err != nil {
+			return err
+		}
+	}
+
+	// OpenSSH defines no critical options or extensions for host certificates
+	return signSSHCertificate(cCtx, &sshCertRequest{
+		CertType:   ssh.HostCert,
+		Principals: principals,
+	})
+}
+
+func generateSSHHostCertFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "principals",
+			Usage:    "comma-separated string containing the host names and IP addresses clients use to connect to the host e.g sftp.example.com,192.168.1.10",
+			Required: true,
+		},
+	}, sshCertFlags(365)...)
+}
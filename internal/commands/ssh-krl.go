@@ -0,0 +1,142 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/open-uem/openuem-cert-manager/internal/models"
+	"github.com/open-uem/openuem-cert-manager/internal/sshkrl"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+func SSHRevoke() *cli.Command {
+	return &cli.Command{
+		Name:   "ssh-revoke",
+		Usage:  "Revoke an OpenSSH certificate identified by its serial number, it's added to the next KRL exported with ssh-krl",
+		Action: revokeSSHCert,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "serial",
+				Usage:    "the serial number of the SSH certificate in decimal format as shown by ssh-keygen -L",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "reason",
+				Usage: "a text explaining why this certificate has been revoked",
+			},
+			dbURLFlag(),
+		},
+	}
+}
+
+func SSHKRL() *cli.Command {
+	return &cli.Command{
+		Name:   "ssh-krl",
+		Usage:  "Export the OpenSSH key revocation list (KRL) with the revoked SSH certificates, set it in the RevokedKeys option of sshd",
+		Action: exportSSHKRL,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "ssh-ca-pub",
+				Usage:    "comma-separated string containing the paths to the SSH CA public keys whose revoked certificates are exported, e.g the current and the previous CA during a rotation",
+				EnvVars:  []string{"SSH_CA_PUB_FILENAME"},
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "comment",
+				Usage: "an optional comment stored in the KRL",
+			},
+			dbURLFlag(),
+			&cli.StringFlag{
+				Name:  "dst",
+				Usage: "the folder where the revoked_keys file will be stored",
+			},
+		},
+	}
+}
+
+func revokeSSHCert(cCtx *cli.Context) (err error) {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+	log.Printf("... connected to database")
+
+	serial := uint64(0)
+	defer func() { recordCLIAudit(cCtx, model, int64(serial), err) }()
+
+	serial, err = strconv.ParseUint(cCtx.String("serial"), 10, 63)
+	if err != nil {
+		return fmt.Errorf("could not parse the SSH certificate serial number, reason: %s", err.Error())
+	}
+
+	if err := model.RevokeSSHCertificate(serial, cCtx.String("reason")); err != nil {
+		if errors.Is(err, models.ErrSSHCertificateNotFound) {
+			return err
+		}
+		return fmt.Errorf("could not save the revoked SSH certificate in the database, reason: %s", err.Error())
+	}
+	log.Printf("... saving revocation information to the database")
+
+	log.Printf("✅ Done! Your SSH certificate has been revoked, export a new KRL with ssh-krl and distribute it to your hosts\n\n")
+	return nil
+}
+
+func exportSSHKRL(cCtx *cli.Context) (err error) {
+	model, err := models.New(cCtx.String("dburl"))
+	if err != nil {
+		return fmt.Errorf("could not connect to database, reason: %s", err.Error())
+	}
+	defer model.Close()
+	log.Printf("... connected to database")
+	defer func() { recordCLIAudit(cCtx, model, 0, err) }()
+
+	now := time.Now()
+	krl := &sshkrl.KRL{Version: uint64(now.Unix()), Generated: now, Comment: cCtx.String("comment")}
+
+	total := 0
+	for _, filename := range splitSANs(cCtx.String("ssh-ca-pub")) {
+		keys, err := readSSHPublicKeys(filename)
+		if err != nil {
+			return err
+		}
+
+		for _, caKey := range keys {
+			log.Printf("... reading revoked SSH certificates signed by %s", ssh.FingerprintSHA256(caKey))
+			certs, err := model.GetRevokedSSHCertificates(ssh.FingerprintSHA256(caKey))
+			if err != nil {
+				return fmt.Errorf("could not get the revoked SSH certificates, reason: %s", err.Error())
+			}
+
+			revoked := &sshkrl.RevokedCertificates{CAKey: caKey}
+			for _, c := range certs {
+				revoked.Serials = append(revoked.Serials, c.Serial)
+			}
+			krl.CAs = append(krl.CAs, revoked)
+			total += len(certs)
+		}
+	}
+
+	path := cCtx.String("dst")
+	if path == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(cwd, "certificates")
+	}
+
+	log.Printf("... saving the KRL to %s", filepath.Join(path, "revoked_keys"))
+	if err := os.WriteFile(filepath.Join(path, "revoked_keys"), krl.Marshal(), 0644); err != nil {
+		return fmt.Errorf("could not save the KRL, reason: %s", err.Error())
+	}
+
+	log.Printf("✅ Done! The KRL with %d revoked SSH certificates has been stored in %s\n\n", total, filepath.Join(path, "revoked_keys"))
+	return nil
+}
@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+func SSHUserCertificate() *cli.Command {
+	return &cli.Command{
+		Name:   "ssh-user-cert",
+		Usage:  "Sign an OpenSSH user public key with the SSH CA so the user can log in as its principals e.g for SFTP",
+		Action: generateSSHUserCert,
+		Flags:  generateSSHUserCertFlags(),
+	}
+}
+
+func generateSSHUserCert(cCtx *cli.Context) error {
+	principals, err := validateSSHPrincipals(cCtx.String("principals"))
+	if err != nil {
+		return err
+	}
+
+	extensions, err := validateSSHExtensions(cCtx.String("extensions"))
+	if err != nil {
+		return err
+	}
+
+	// Ref: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.certkeys
+	options := map[string]string{}
+	if command := cCtx.String("force-command"); command != "" {
+		options["force-command"] = command
+	}
+	addresses, err := validateSourceAddresses(cCtx.String("source-address"))
+	if err != nil {
+		return err
+	}
+	if addresses != "" {
+		options["source-address"] = addresses
+	}
+	if cCtx.Bool("verify-required") {
+		options["verify-required"] = ""
+	}
+
+	return signSSHCertificate(cCtx, &sshCertRequest{
+		CertType:        ssh.UserCert,
+		Principals:      principals,
+		CriticalOptions: options,
+		Extensions:      extensions,
+	})
+}
+
+func generateSSHUserCertFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "principals",
+			Usage:    "comma-separated string containing the user names this certificate can log in as e.g openuem,sftp",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "extensions",
+			Value: strings.Join(defaultSSHExtensions, ","),
+			Usage: "comma-separated string containing the extensions of the certificate, an empty value grants no permissions e.g permit-pty",
+		},
+		&cli.StringFlag{
+			Name:  "force-command",
+			Usage: "the command that is run instead of the one requested by the user (force-command critical option) e.g internal-sftp",
+		},
+		&cli.StringFlag{
+			Name:  "source-address",
+			Usage: "comma-separated string containing the addresses in CIDR format the certificate can be used from (source-address critical option) e.g 10.0.0.0/8",
+		},
+		&cli.BoolFlag{
+			Name:  "verify-required",
+			Usage: "require a FIDO key to verify the user presence on every login (verify-required critical option)",
+		},
+	}, sshCertFlags(1)...)
+}
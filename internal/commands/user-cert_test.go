@@ -0,0 +1,142 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// parseUPN returns the UPN otherName of the SAN extension of a certificate and checks that it's encoded
+// as a UTF8String
+func parseUPN(t *testing.T, cert *x509.Certificate) string {
+	t.Helper()
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		names := []asn1.RawValue{}
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var otherName struct {
+				TypeID asn1.ObjectIdentifier
+				Value  asn1.RawValue
+			}
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &otherName, "tag:0"); err != nil {
+				t.Fatal(err)
+			}
+			if !otherName.TypeID.Equal(oidUPN) {
+				t.Fatalf("unexpected otherName type %s", otherName.TypeID)
+			}
+			var value asn1.RawValue
+			if _, err := asn1.Unmarshal(otherName.Value.Bytes, &value); err != nil {
+				t.Fatal(err)
+			}
+			if value.Tag != asn1.TagUTF8String {
+				t.Fatalf("the UPN is encoded with tag %d, not as a UTF8String", value.Tag)
+			}
+			return string(value.Bytes)
+		}
+	}
+	t.Fatal("the certificate doesn't have a UPN")
+	return ""
+}
+
+func TestIssueSmartCardCertificate(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+	v := newTestContext(t, map[string]string{
+		"username":   "jdoe",
+		"profile":    UserProfileSmartCard,
+		"upn":        "jdoe@corp.example.com",
+		"days-valid": "30",
+		"email-sans": "jdoe@example.com",
+		"ip-sans":    "192.168.1.10",
+		"uri-sans":   "urn:openuem:user:jdoe",
+	})
+
+	issued, err := IssueCertificate(KindUser, v, caCert, caKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(issued.CertBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upn := parseUPN(t, cert); upn != "jdoe@corp.example.com" {
+		t.Fatalf("unexpected UPN %q", upn)
+	}
+	if !slices.ContainsFunc(cert.UnknownExtKeyUsage, oidExtKeyUsageSmartCardLogon.Equal) || !slices.Contains(cert.ExtKeyUsage, x509.ExtKeyUsageClientAuth) {
+		t.Fatalf("unexpected extended key usages %v %v", cert.ExtKeyUsage, cert.UnknownExtKeyUsage)
+	}
+	if !slices.ContainsFunc(cert.Subject.Names, func(n pkix.AttributeTypeAndValue) bool { return n.Type.Equal(oidUserID) && n.Value == "jdoe" }) {
+		t.Fatalf("the subject %s doesn't have the UID of the user", cert.Subject)
+	}
+	if bits := cert.PublicKey.(*rsa.PublicKey).N.BitLen(); bits != 2048 {
+		t.Fatalf("the key has %d bits", bits)
+	}
+
+	// The SAN extension replaces the one Go would create, the other SANs must be kept
+	if !slices.Equal(cert.EmailAddresses, []string{"jdoe@example.com"}) {
+		t.Fatalf("unexpected email SANs %v", cert.EmailAddresses)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("192.168.1.10")) {
+		t.Fatalf("unexpected IP SANs %v", cert.IPAddresses)
+	}
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != "urn:openuem:user:jdoe" {
+		t.Fatalf("unexpected URI SANs %v", cert.URIs)
+	}
+}
+
+func TestApplyUserProfileKeepsDNSNames(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(400),
+		Subject:      pkix.Name{CommonName: "jdoe"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"workstation01.corp.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("fd00::10")},
+	}
+	v := newTestContext(t, map[string]string{"username": "jdoe", "profile": UserProfileSmartCard, "upn": "jdoe@corp.example.com"})
+	if err := applyUserProfile(template, v); err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upn := parseUPN(t, cert); upn != "jdoe@corp.example.com" {
+		t.Fatalf("unexpected UPN %q", upn)
+	}
+	if !slices.Equal(cert.DNSNames, template.DNSNames) {
+		t.Fatalf("unexpected DNS SANs %v", cert.DNSNames)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("fd00::10")) {
+		t.Fatalf("unexpected IP SANs %v", cert.IPAddresses)
+	}
+}
@@ -0,0 +1,260 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrACMENotFound = errors.New("acme object not found")
+
+// ErrACMEOrderChanged is returned when an order is no longer in the status a transition expects
+var ErrACMEOrderChanged = errors.New("acme order status has changed")
+
+type ACMEAccount struct {
+	ID         string
+	Thumbprint string
+	JWK        string
+	Contact    []string
+	Status     string
+	Created    time.Time
+}
+
+type ACMEIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type ACMEOrder struct {
+	ID          string
+	AccountID   string
+	Status      string
+	Identifiers []ACMEIdentifier
+	Expires     time.Time
+	Serial      int64
+	Certificate string
+	Error       string
+	Created     time.Time
+}
+
+type ACMEAuthorization struct {
+	ID         string
+	OrderID    string
+	AccountID  string
+	Identifier ACMEIdentifier
+	// CertType is the type of the certificate the authorization is for
+	CertType        string
+	Token           string
+	Status          string
+	ChallengeType   string
+	ChallengeStatus string
+	Error           string
+	Expires         time.Time
+	Validated       *time.Time
+}
+
+func (m *Model) CreateACMEAccount(a *ACMEAccount) error {
+	contact, err := json.Marshal(a.Contact)
+	if err != nil {
+		return err
+	}
+	_, err = m.DB.ExecContext(context.Background(),
+		m.rebind(`INSERT INTO acme_accounts (id, thumbprint, jwk, contact, status, created) VALUES ($1, $2, $3, $4, $5, $6)`),
+		a.ID, a.Thumbprint, a.JWK, string(contact), a.Status, a.Created.UTC())
+	return err
+}
+
+func (m *Model) GetACMEAccount(id string) (*ACMEAccount, error) {
+	return m.getACMEAccount(`SELECT id, thumbprint, jwk, contact, status, created FROM acme_accounts WHERE id = $1`, id)
+}
+
+func (m *Model) GetACMEAccountByThumbprint(thumbprint string) (*ACMEAccount, error) {
+	return m.getACMEAccount(`SELECT id, thumbprint, jwk, contact, status, created FROM acme_accounts WHERE thumbprint = $1`, thumbprint)
+}
+
+func (m *Model) getACMEAccount(query string, arg string) (*ACMEAccount, error) {
+	a := ACMEAccount{}
+	contact := ""
+	err := m.DB.QueryRowContext(context.Background(), m.rebind(query), arg).Scan(&a.ID, &a.Thumbprint, &a.JWK, &contact, &a.Status, &a.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrACMENotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(contact), &a.Contact); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (m *Model) UpdateACMEAccount(a *ACMEAccount) error {
+	contact, err := json.Marshal(a.Contact)
+	if err != nil {
+		return err
+	}
+	_, err = m.DB.ExecContext(context.Background(),
+		m.rebind(`UPDATE acme_accounts SET contact = $1, status = $2, thumbprint = $3, jwk = $4 WHERE id = $5`),
+		string(contact), a.Status, a.Thumbprint, a.JWK, a.ID)
+	return err
+}
+
+// CreateACMEOrder stores an order and its authorizations in a single transaction
+func (m *Model) CreateACMEOrder(o *ACMEOrder, authzs []*ACMEAuthorization) error {
+	ctx := context.Background()
+	identifiers, err := json.Marshal(o.Identifiers)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx,
+		m.rebind(`INSERT INTO acme_orders (id, account_id, status, identifiers, expires, serial, certificate, error, created) VALUES ($1, $2, $3, $4, $5, 0, '', '', $6)`),
+		o.ID, o.AccountID, o.Status, string(identifiers), o.Expires.UTC(), o.Created.UTC()); err != nil {
+		return err
+	}
+
+	for _, a := range authzs {
+		if _, err := tx.ExecContext(ctx,
+			m.rebind(`INSERT INTO acme_authorizations (id, order_id, account_id, identifier_type, identifier_value, cert_type, token, status, challenge_type, challenge_status, error, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, '', $9, '', $10)`),
+			a.ID, o.ID, a.AccountID, a.Identifier.Type, a.Identifier.Value, a.CertType, a.Token, a.Status, a.ChallengeStatus, a.Expires.UTC()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *Model) GetACMEOrder(id string) (*ACMEOrder, error) {
+	return m.getACMEOrder(`SELECT `+acmeOrderColumns+` FROM acme_orders WHERE id = $1`, id)
+}
+
+// GetACMEOrderBySerial returns the order that issued the certificate with that serial number
+func (m *Model) GetACMEOrderBySerial(serial int64) (*ACMEOrder, error) {
+	return m.getACMEOrder(`SELECT `+acmeOrderColumns+` FROM acme_orders WHERE serial = $1 AND serial <> 0`, serial)
+}
+
+const acmeOrderColumns = `id, account_id, status, identifiers, expires, serial, certificate, error, created`
+
+func (m *Model) getACMEOrder(query string, arg any) (*ACMEOrder, error) {
+	o := ACMEOrder{}
+	identifiers := ""
+	err := m.DB.QueryRowContext(context.Background(), m.rebind(query), arg).
+		Scan(&o.ID, &o.AccountID, &o.Status, &identifiers, &o.Expires, &o.Serial, &o.Certificate, &o.Error, &o.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrACMENotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(identifiers), &o.Identifiers); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (m *Model) GetACMEOrderIDs(accountID string) ([]string, error) {
+	rows, err := m.DB.QueryContext(context.Background(), m.rebind(`SELECT id FROM acme_orders WHERE account_id = $1 ORDER BY created`), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		id := ""
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (m *Model) UpdateACMEOrder(o *ACMEOrder) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`UPDATE acme_orders SET status = $1, serial = $2, certificate = $3, error = $4 WHERE id = $5`),
+		o.Status, o.Serial, o.Certificate, o.Error, o.ID)
+	return err
+}
+
+// UpdateACMEOrderStatus moves an order from one status to another only if it's still in the from status,
+// so two requests can't both make the same transition
+func (m *Model) UpdateACMEOrderStatus(id string, from string, to string) error {
+	res, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`UPDATE acme_orders SET status = $1 WHERE id = $2 AND status = $3`), to, id, from)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrACMEOrderChanged
+	}
+	return nil
+}
+
+const acmeAuthorizationColumns = `id, order_id, account_id, identifier_type, identifier_value, cert_type, token, status, challenge_type, challenge_status, error, expires, validated`
+
+func (m *Model) GetACMEAuthorization(id string) (*ACMEAuthorization, error) {
+	authzs, err := m.queryACMEAuthorizations(`SELECT `+acmeAuthorizationColumns+` FROM acme_authorizations WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(authzs) == 0 {
+		return nil, ErrACMENotFound
+	}
+	return authzs[0], nil
+}
+
+func (m *Model) GetACMEAuthorizations(orderID string) ([]*ACMEAuthorization, error) {
+	return m.queryACMEAuthorizations(`SELECT `+acmeAuthorizationColumns+` FROM acme_authorizations WHERE order_id = $1 ORDER BY identifier_value`, orderID)
+}
+
+// GetACMEAuthorizationsByChallenge returns the authorizations whose challenge of the given type is in the given status
+func (m *Model) GetACMEAuthorizationsByChallenge(challengeType string, challengeStatus string) ([]*ACMEAuthorization, error) {
+	return m.queryACMEAuthorizations(`SELECT `+acmeAuthorizationColumns+` FROM acme_authorizations WHERE challenge_type = $1 AND challenge_status = $2 ORDER BY expires`, challengeType, challengeStatus)
+}
+
+func (m *Model) queryACMEAuthorizations(query string, args ...any) ([]*ACMEAuthorization, error) {
+	rows, err := m.DB.QueryContext(context.Background(), m.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	authzs := []*ACMEAuthorization{}
+	for rows.Next() {
+		a := ACMEAuthorization{}
+		validated := sql.NullTime{}
+		if err := rows.Scan(&a.ID, &a.OrderID, &a.AccountID, &a.Identifier.Type, &a.Identifier.Value, &a.CertType, &a.Token, &a.Status,
+			&a.ChallengeType, &a.ChallengeStatus, &a.Error, &a.Expires, &validated); err != nil {
+			return nil, err
+		}
+		if validated.Valid {
+			a.Validated = &validated.Time
+		}
+		authzs = append(authzs, &a)
+	}
+	return authzs, rows.Err()
+}
+
+func (m *Model) UpdateACMEAuthorization(a *ACMEAuthorization) error {
+	validated := sql.NullTime{}
+	if a.Validated != nil {
+		validated = sql.NullTime{Time: a.Validated.UTC(), Valid: true}
+	}
+	_, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`UPDATE acme_authorizations SET status = $1, challenge_type = $2, challenge_status = $3, error = $4, validated = $5 WHERE id = $6`),
+		a.Status, a.ChallengeType, a.ChallengeStatus, a.Error, validated, a.ID)
+	return err
+}
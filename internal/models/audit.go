@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"entgo.io/ent/dialect"
+)
+
+// auditLockID serializes the writers of the audit log so every entry is chained to the last one
+const auditLockID = 0x6f70656e75656d
+
+// auditHeadInit saves the head of an audit log created before the head was stored, SQLite needs the
+// WHERE clause to parse ON CONFLICT after a SELECT
+const auditHeadInit = `INSERT INTO audit_head (id, entries, hash)
+	SELECT 1, COUNT(*), COALESCE((SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1), '') FROM audit_log WHERE true
+	ON CONFLICT DO NOTHING`
+
+// AuditHead is the number of entries of the audit log and the hash of the last one, it's updated with
+// every entry so removing the newest entries doesn't go unnoticed
+type AuditHead struct {
+	Entries int64  `json:"entries"`
+	Hash    string `json:"hash"`
+}
+
+// AuditEntry is an operation recorded in the audit log, each entry contains the hash of the previous one
+// so changing or removing an entry breaks the chain
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	Created    time.Time `json:"created"`
+	Actor      string    `json:"actor"`
+	Command    string    `json:"command"`
+	Parameters string    `json:"parameters"`
+	Serial     int64     `json:"serial,omitempty"`
+	Result     string    `json:"result"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash"`
+}
+
+// AuditHash returns the hash of an entry, it covers every field but the id
+func AuditHash(e *AuditEntry) string {
+	fields := []string{
+		e.PrevHash,
+		e.Created.UTC().Format(time.RFC3339Nano),
+		e.Actor,
+		e.Command,
+		e.Parameters,
+		strconv.FormatInt(e.Serial, 10),
+		e.Result,
+	}
+
+	h := sha256.New()
+	for _, f := range fields {
+		// Length prefixes prevent moving data from one field to the next
+		h.Write([]byte(strconv.Itoa(len(f)) + ":" + f))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AppendAuditEntry chains an entry to the last one in the audit log and stores it
+func (m *Model) AppendAuditEntry(e *AuditEntry) error {
+	ctx := context.Background()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// SQLite transactions take the write lock when they begin so they're already serialized
+	if m.Dialect != dialect.SQLite {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, auditLockID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, auditHeadInit); err != nil {
+		return err
+	}
+
+	prevHash := ""
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE((SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1), '')`).Scan(&prevHash); err != nil {
+		return err
+	}
+
+	// Timestamps are stored with microsecond precision
+	e.Created = time.Now().UTC().Truncate(time.Microsecond)
+	e.PrevHash = prevHash
+	e.Hash = AuditHash(e)
+
+	if err := tx.QueryRowContext(ctx,
+		m.rebind(`INSERT INTO audit_log (created, actor, command, parameters, serial, result, prev_hash, hash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`),
+		e.Created, e.Actor, e.Command, e.Parameters, e.Serial, e.Result, e.PrevHash, e.Hash).Scan(&e.ID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, m.rebind(`UPDATE audit_head SET entries = entries + 1, hash = $1 WHERE id = 1`), e.Hash); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAuditHead returns the head saved with the last entry of the audit log or nil if it has never been saved
+func (m *Model) GetAuditHead() (*AuditHead, error) {
+	head := AuditHead{}
+	err := m.DB.QueryRowContext(context.Background(), `SELECT entries, hash FROM audit_head WHERE id = 1`).Scan(&head.Entries, &head.Hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+// WalkAuditLog calls fn for every entry in the audit log in the order they were appended
+func (m *Model) WalkAuditLog(fn func(e *AuditEntry) error) error {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT id, created, actor, command, parameters, serial, result, prev_hash, hash FROM audit_log ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := AuditEntry{}
+		if err := rows.Scan(&e.ID, &e.Created, &e.Actor, &e.Command, &e.Parameters, &e.Serial, &e.Result, &e.PrevHash, &e.Hash); err != nil {
+			return err
+		}
+		e.Created = e.Created.UTC()
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+type AuthzDenial struct {
+	ID       int64
+	Identity string
+	Action   string
+	CertType string
+	Resource string
+	Created  time.Time
+}
+
+func (m *Model) SaveAuthzDenial(identity string, action string, certType string, resource string) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`INSERT INTO authz_denials (identity, action, cert_type, resource, created) VALUES ($1, $2, $3, $4, $5)`),
+		identity, action, certType, resource, time.Now().UTC())
+	return err
+}
+
+func (m *Model) GetAuthzDenials(since time.Time) ([]AuthzDenial, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		m.rebind(`SELECT id, identity, action, cert_type, resource, created FROM authz_denials WHERE created >= $1 ORDER BY id`), since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	denials := []AuthzDenial{}
+	for rows.Next() {
+		d := AuthzDenial{}
+		if err := rows.Scan(&d.ID, &d.Identity, &d.Action, &d.CertType, &d.Resource, &d.Created); err != nil {
+			return nil, err
+		}
+		denials = append(denials, d)
+	}
+	return denials, rows.Err()
+}
@@ -2,26 +2,53 @@ package models
 
 import (
 	"context"
+	"slices"
 	"time"
 
+	entsql "entgo.io/ent/dialect/sql"
+	ent "github.com/open-uem/ent"
 	"github.com/open-uem/ent/certificate"
 )
 
+// Certificate types of the cert-manager that are not in the ent schema shared with the other OpenUEM
+// components. They're stored in the local_certificates table until the shared schema has them, so the
+// other components never find a type they don't know in the certificates table
+const (
+	CertificateTypeDevice certificate.Type = "device"
+	CertificateTypeRADIUS certificate.Type = "radius"
+)
+
+func isLocalCertificateType(certType certificate.Type) bool {
+	return certType == CertificateTypeDevice || certType == CertificateTypeRADIUS
+}
+
 func (m *Model) SaveCertificate(serial int64, certType certificate.Type, description string, expiry time.Time, createUser bool, user string) error {
+	return m.saveCertificate(context.Background(), m.DB, m.Client, serial, certType, description, expiry, createUser, user)
+}
+
+// saveCertificate stores a certificate with db and client so it can be saved inside a transaction
+func (m *Model) saveCertificate(ctx context.Context, db entsql.ExecQuerier, client *ent.Client, serial int64, certType certificate.Type, description string, expiry time.Time, createUser bool, user string) error {
+	if isLocalCertificateType(certType) {
+		_, err := db.ExecContext(ctx,
+			m.rebind(`INSERT INTO local_certificates (serial, cert_type, description, expiry, created) VALUES ($1, $2, $3, $4, $5)`),
+			serial, string(certType), description, expiry.UTC(), time.Now().UTC())
+		return err
+	}
+
 	if createUser {
-		_, err := m.Client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).SetUID(user).Save(context.Background())
+		_, err := client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).SetUID(user).Save(ctx)
 		if err != nil {
 			return err
 		}
 	} else {
-		_, err := m.Client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).Save(context.Background())
+		_, err := client.Certificate.Create().SetID(serial).SetType(certType).SetDescription(description).SetExpiry(expiry).Save(ctx)
 		if err != nil {
 			return err
 		}
 	}
 
 	if createUser {
-		if _, err := m.Client.User.Create().SetID(user).SetName(description).SetExpiry(expiry).SetRegister("users.completed").Save(context.Background()); err != nil {
+		if _, err := client.User.Create().SetID(user).SetName(description).SetExpiry(expiry).SetRegister("users.completed").Save(ctx); err != nil {
 			return err
 		}
 	}
@@ -30,8 +57,68 @@ func (m *Model) SaveCertificate(serial int64, certType certificate.Type, descrip
 
 func (m *Model) DeleteCertificate(serial int64) error {
 	err := m.Client.Certificate.DeleteOneID(serial).Exec(context.Background())
+	if ent.IsNotFound(err) {
+		_, err = m.DB.ExecContext(context.Background(), m.rebind(`DELETE FROM local_certificates WHERE serial = $1`), serial)
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// GetCertificate returns a certificate of the shared table or, if it's not there, of the local one
+func (m *Model) GetCertificate(serial int64) (*ent.Certificate, error) {
+	cert, err := m.Client.Certificate.Get(context.Background(), serial)
+	if !ent.IsNotFound(err) {
+		return cert, err
+	}
+
+	certs, lerr := m.getLocalCertificates(`WHERE serial = $1`, serial)
+	if lerr != nil {
+		return nil, lerr
+	}
+	if len(certs) == 0 {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+func (m *Model) GetCertificates() ([]*ent.Certificate, error) {
+	certs, err := m.Client.Certificate.Query().Order(ent.Asc(certificate.FieldExpiry)).All(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := m.getLocalCertificates("")
+	if err != nil {
+		return nil, err
+	}
+	certs = append(certs, local...)
+	slices.SortStableFunc(certs, func(a, b *ent.Certificate) int { return a.Expiry.Compare(b.Expiry) })
+	return certs, nil
+}
+
+// getLocalCertificates returns the certificates of the local_certificates table with the fields of
+// the shared schema so they're handled as any other certificate
+func (m *Model) getLocalCertificates(where string, args ...any) ([]*ent.Certificate, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		m.rebind(`SELECT serial, cert_type, description, expiry FROM local_certificates `+where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	certs := []*ent.Certificate{}
+	for rows.Next() {
+		c := ent.Certificate{}
+		if err := rows.Scan(&c.ID, &c.Type, &c.Description, &c.Expiry); err != nil {
+			return nil, err
+		}
+		certs = append(certs, &c)
+	}
+	return certs, rows.Err()
+}
+
+func (m *Model) SetCertificateUser(serial int64, user string) error {
+	return m.Client.Certificate.UpdateOneID(serial).SetUID(user).Exec(context.Background())
+}
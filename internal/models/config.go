@@ -0,0 +1,37 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Settings of the PKI shared by every command that issues certificates
+const (
+	ConfigCRLURL       = "crl_url"
+	ConfigCAIssuersURL = "ca_issuers_url"
+	// ConfigApprovalTypes are the certificate types that must be approved before they're issued
+	ConfigApprovalTypes = "approval_types"
+)
+
+// GetConfig returns the value of a setting or an empty string if it isn't set
+func (m *Model) GetConfig(name string) (string, error) {
+	value := ""
+	err := m.DB.QueryRowContext(context.Background(), m.rebind(`SELECT value FROM pki_config WHERE name = $1`), name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+// SetConfig stores the value of a setting, an empty value removes it
+func (m *Model) SetConfig(name string, value string) error {
+	if value == "" {
+		_, err := m.DB.ExecContext(context.Background(), m.rebind(`DELETE FROM pki_config WHERE name = $1`), name)
+		return err
+	}
+
+	_, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`INSERT INTO pki_config (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value`), name, value)
+	return err
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	entsql "entgo.io/ent/dialect/sql"
+	ent "github.com/open-uem/ent"
+	"github.com/open-uem/ent/certificate"
+)
+
+var ErrInvalidEnrollmentToken = errors.New("the enrollment token is not valid, has expired or has been used too many times")
+
+type EnrollmentToken struct {
+	ID          string
+	Description string
+	Site        string
+	Tenant      string
+	MaxUses     int
+	Uses        int
+	Expiry      time.Time
+	Created     time.Time
+}
+
+// HashEnrollmentToken returns the value stored in database for a token, the token itself is never stored
+func HashEnrollmentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *Model) SaveEnrollmentToken(token string, description string, site string, tenant string, maxUses int, expiry time.Time) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`INSERT INTO enrollment_tokens (id, description, site, tenant, max_uses, uses, expiry, created) VALUES ($1, $2, $3, $4, $5, 0, $6, $7)`),
+		HashEnrollmentToken(token), description, site, tenant, maxUses, expiry.UTC(), time.Now().UTC())
+	return err
+}
+
+func (m *Model) GetEnrollmentTokens() ([]EnrollmentToken, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT id, description, site, tenant, max_uses, uses, expiry, created FROM enrollment_tokens ORDER BY created`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []EnrollmentToken{}
+	for rows.Next() {
+		t := EnrollmentToken{}
+		if err := rows.Scan(&t.ID, &t.Description, &t.Site, &t.Tenant, &t.MaxUses, &t.Uses, &t.Expiry, &t.Created); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (m *Model) DeleteEnrollmentToken(id string) error {
+	res, err := m.DB.ExecContext(context.Background(), m.rebind(`DELETE FROM enrollment_tokens WHERE id = $1`), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UseEnrollmentToken consumes one use of the token, it fails if the token doesn't exist,
+// has expired or has reached its maximum number of uses
+func (m *Model) UseEnrollmentToken(token string) (*EnrollmentToken, error) {
+	return m.useEnrollmentToken(context.Background(), m.DB, token)
+}
+
+func (m *Model) useEnrollmentToken(ctx context.Context, db entsql.ExecQuerier, token string) (*EnrollmentToken, error) {
+	id := HashEnrollmentToken(token)
+
+	res, err := db.ExecContext(ctx,
+		m.rebind(`UPDATE enrollment_tokens SET uses = uses + 1 WHERE id = $1 AND uses < max_uses AND expiry > $2`),
+		id, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n != 1 {
+		return nil, ErrInvalidEnrollmentToken
+	}
+
+	rows, err := db.QueryContext(ctx,
+		m.rebind(`SELECT id, description, site, tenant, max_uses, uses, expiry, created FROM enrollment_tokens WHERE id = $1`), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidEnrollmentToken
+	}
+
+	t := EnrollmentToken{}
+	if err := rows.Scan(&t.ID, &t.Description, &t.Site, &t.Tenant, &t.MaxUses, &t.Uses, &t.Expiry, &t.Created); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// EnrollAgent consumes one use of the token, issues the agent's certificate with issue and stores it linked
+// to the agent and the token in one transaction, so a certificate that can't be issued or saved leaves the
+// token unused. Every agent certificate can be revoked on its own
+func (m *Model) EnrollAgent(token string, agentID string, description string, issue func(t *EnrollmentToken) (*x509.Certificate, error)) error {
+	return m.EnrollCertificate(token, certificate.TypeAgent, agentID, description, issue)
+}
+
+// EnrollCertificate is EnrollAgent for a certificate of any type, the id is the agent id or the subject
+// the certificate was requested for
+func (m *Model) EnrollCertificate(token string, certType certificate.Type, id string, description string, issue func(t *EnrollmentToken) (*x509.Certificate, error)) error {
+	ctx := context.Background()
+	return m.inTx(ctx, func(tx *sql.Tx, client *ent.Client) error {
+		t, err := m.useEnrollmentToken(ctx, tx, token)
+		if err != nil {
+			return err
+		}
+
+		cert, err := issue(t)
+		if err != nil {
+			return err
+		}
+
+		serial := cert.SerialNumber.Int64()
+		if err := m.saveCertificate(ctx, tx, client, serial, certType, description, cert.NotAfter, false, ""); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			m.rebind(`INSERT INTO agent_enrollments (serial, agent_id, token_id, site, tenant, enrolled) VALUES ($1, $2, $3, $4, $5, $6)`),
+			serial, id, t.ID, t.Site, t.Tenant, time.Now().UTC())
+		return err
+	})
+}
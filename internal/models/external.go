@@ -0,0 +1,44 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// ExternalCertificate is a certificate issued by a public CA, e.g. Let's Encrypt. It's not stored with the
+// certificates of the OpenUEM CA, their serial numbers only identify a certificate together with the issuer
+// and are longer than 63 bits
+type ExternalCertificate struct {
+	Issuer      string
+	Serial      string
+	Type        string
+	Description string
+	Expiry      time.Time
+	Created     time.Time
+}
+
+func (m *Model) SaveExternalCertificate(c *ExternalCertificate) error {
+	_, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`INSERT INTO external_certificates (issuer, serial, cert_type, description, expiry, created) VALUES ($1, $2, $3, $4, $5, $6)`),
+		c.Issuer, c.Serial, c.Type, c.Description, c.Expiry.UTC(), time.Now().UTC())
+	return err
+}
+
+func (m *Model) GetExternalCertificates() ([]ExternalCertificate, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		`SELECT issuer, serial, cert_type, description, expiry, created FROM external_certificates ORDER BY created`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	certs := []ExternalCertificate{}
+	for rows.Next() {
+		c := ExternalCertificate{}
+		if err := rows.Scan(&c.Issuer, &c.Serial, &c.Type, &c.Description, &c.Expiry, &c.Created); err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, rows.Err()
+}
@@ -5,38 +5,101 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 
 	"entgo.io/ent/dialect"
 	entsql "entgo.io/ent/dialect/sql"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	ent "github.com/open-uem/ent"
+	_ "modernc.org/sqlite"
 )
 
+// SQLiteScheme is the scheme of the database urls that open a SQLite database file instead of
+// Postgres, e.g sqlite:///var/lib/openuem/openuem.db
+const SQLiteScheme = "sqlite://"
+
 type Model struct {
-	Client *ent.Client
+	Client  *ent.Client
+	DB      *sql.DB
+	Dialect string
 }
 
 func New(dbUrl string) (*Model, error) {
-	model := Model{}
+	model := Model{Dialect: dialect.Postgres}
 
-	db, err := sql.Open("pgx", dbUrl)
+	driver, dsn := "pgx", dbUrl
+	if path, ok := strings.CutPrefix(dbUrl, SQLiteScheme); ok {
+		if path == "" {
+			return nil, fmt.Errorf("the SQLite database url must contain the path to the database file")
+		}
+		model.Dialect = dialect.SQLite
+		driver, dsn = "sqlite", sqliteDSN(path)
+	}
+
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
-		return nil, fmt.Errorf("could not connect with Postgres database: %v", err)
+		return nil, fmt.Errorf("could not connect with %s database: %v", model.Dialect, err)
 	}
 
-	model.Client = ent.NewClient(ent.Driver(entsql.OpenDB(dialect.Postgres, db)))
+	model.DB = db
+	model.Client = ent.NewClient(ent.Driver(entsql.OpenDB(model.Dialect, db)))
 
-	// TODO Automatic migrations only in development
+	// TODO Automatic migrations only in development, in production the cert-manager tables are created
+	// with the migrate command. A SQLite database is only used by the cert-manager so nobody else
+	// creates its schema
 	ctx := context.Background()
-	if os.Getenv("ENV") != "prod" {
+	if os.Getenv("ENV") != "prod" || model.Dialect == dialect.SQLite {
 		if err := model.Client.Schema.Create(ctx); err != nil {
 			return nil, err
 		}
+
+		if err := model.CreateTables(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	return &model, nil
 }
 
+// sqliteDSN enables the foreign keys required by ent and makes every transaction take the write
+// lock when it begins, so transactions are serialized as Postgres does with row and advisory locks.
+// The driver is written in Go so the cert-manager is still built without cgo
+func sqliteDSN(path string) string {
+	options := "_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+	if strings.Contains(path, "?") {
+		return "file:" + path + "&" + options
+	}
+	return "file:" + path + "?" + options
+}
+
+var placeholders = regexp.MustCompile(`\$([0-9]+)`)
+
+// rebind adapts a statement written for Postgres to the dialect of the database. SQLite numbers
+// the $N parameters in the order they appear, so they're rewritten as ?N
+func (m *Model) rebind(query string) string {
+	if m.Dialect != dialect.SQLite {
+		return query
+	}
+	return placeholders.ReplaceAllString(query, "?${1}")
+}
+
+// inTx runs fn in a transaction that is committed if fn succeeds, the ent client passed to fn runs its
+// queries in the same transaction
+func (m *Model) inTx(ctx context.Context, fn func(tx *sql.Tx, client *ent.Client) error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	client := ent.NewClient(ent.Driver(entsql.NewDriver(m.Dialect, entsql.Conn{ExecQuerier: tx})))
+	if err := fn(tx, client); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (m *Model) Close() {
 	m.Client.Close()
 }
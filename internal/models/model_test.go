@@ -0,0 +1,263 @@
+package models
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"entgo.io/ent/dialect"
+	"github.com/open-uem/ent/certificate"
+)
+
+func newTestModel(t *testing.T) *Model {
+	t.Helper()
+	m, err := New(SQLiteScheme + filepath.Join(t.TempDir(), "pki.db"))
+	if err != nil {
+		t.Fatalf("could not open the SQLite database: %v", err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestRebind(t *testing.T) {
+	m := &Model{Dialect: dialect.SQLite}
+	if got := m.rebind(`SELECT $1, $2, $1`); got != `SELECT ?1, ?2, ?1` {
+		t.Fatalf("unexpected statement %q", got)
+	}
+
+	m.Dialect = dialect.Postgres
+	if got := m.rebind(`SELECT $1`); got != `SELECT $1` {
+		t.Fatalf("Postgres statements must not change, got %q", got)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	m := newTestModel(t)
+
+	if err := m.SetConfig(ConfigCRLURL, "http://pki.example.com/ca.crl"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetConfig(ConfigCRLURL, "http://pki.example.com/new.crl"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := m.GetConfig(ConfigCRLURL); err != nil || value != "http://pki.example.com/new.crl" {
+		t.Fatalf("unexpected value %q, %v", value, err)
+	}
+
+	if err := m.SetConfig(ConfigCRLURL, ""); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := m.GetConfig(ConfigCRLURL); err != nil || value != "" {
+		t.Fatalf("the setting was not removed, got %q, %v", value, err)
+	}
+}
+
+func TestCertificates(t *testing.T) {
+	m := newTestModel(t)
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	if err := m.SaveCertificate(1, certificate.TypeProxy, "proxy", expiry.Add(time.Hour), false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveCertificate(2, CertificateTypeDevice, "laptop01", expiry, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveCertificate(3, certificate.TypeUser, "Alice", expiry, true, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The types that are not in the shared schema are kept out of its table
+	if n, err := m.Client.Certificate.Query().Count(t.Context()); err != nil || n != 2 {
+		t.Fatalf("expected 2 certificates in the shared table, got %d, %v", n, err)
+	}
+
+	device, err := m.GetCertificate(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Type != CertificateTypeDevice || device.Description != "laptop01" || !device.Expiry.Equal(expiry) {
+		t.Fatalf("unexpected device certificate %+v", device)
+	}
+
+	user, err := m.GetCertificate(3)
+	if err != nil || user.UID != "alice" {
+		t.Fatalf("the user of the certificate was not saved, got %+v, %v", user, err)
+	}
+
+	certs, err := m.GetCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 3 || certs[2].ID != 1 {
+		t.Fatalf("expected 3 certificates ordered by expiry, got %+v", certs)
+	}
+
+	if _, err := m.GetCertificate(4); err == nil {
+		t.Fatal("a missing certificate was found")
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	m := newTestModel(t)
+
+	if err := m.AddRevocation(10, 1, "key compromise"); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := m.IsRevoked(10); err != nil || !revoked {
+		t.Fatalf("the certificate is not revoked, %v", err)
+	}
+	if revoked, err := m.IsRevoked(11); err != nil || revoked {
+		t.Fatalf("the certificate is revoked, %v", err)
+	}
+	if err := m.AddRevocation(10, 4, "superseded"); err == nil {
+		t.Fatal("a certificate was revoked twice")
+	}
+}
+
+func TestEnrollmentTokenUses(t *testing.T) {
+	m := newTestModel(t)
+
+	if err := m.SaveEnrollmentToken("secret", "office", "", "", 2, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveEnrollmentToken("expired", "office", "", "", 2, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent enrollments can't use a token more times than allowed
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Go(func() {
+			_, err := m.UseEnrollmentToken("secret")
+			errs <- err
+		})
+	}
+	wg.Wait()
+	close(errs)
+
+	used := 0
+	for err := range errs {
+		if err == nil {
+			used++
+		} else if !errors.Is(err, ErrInvalidEnrollmentToken) {
+			t.Fatal(err)
+		}
+	}
+	if used != 2 {
+		t.Fatalf("the token was used %d times", used)
+	}
+
+	if _, err := m.UseEnrollmentToken("expired"); !errors.Is(err, ErrInvalidEnrollmentToken) {
+		t.Fatalf("an expired token was used, %v", err)
+	}
+}
+
+func TestCertRequestApprovals(t *testing.T) {
+	m := newTestModel(t)
+
+	r := &CertRequest{Kind: "server", CertType: "console", Values: map[string]any{"name": "console"}, Requester: "cli:alice", RequiredApprovals: 2, Renews: 7}
+	if err := m.CreateCertRequest(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, err := m.ApproveCertRequest(r.ID, "cli:bob"); err != nil || r.Status != CertRequestPending {
+		t.Fatalf("the request must wait for a second approver, got %+v, %v", r, err)
+	}
+	if _, err := m.ApproveCertRequest(r.ID, "cli:bob"); !errors.Is(err, ErrAlreadyApproved) {
+		t.Fatalf("an approver approved twice, %v", err)
+	}
+	if err := m.ClaimCertRequest(r.ID); !errors.Is(err, ErrCertRequestState) {
+		t.Fatalf("a pending request was claimed, %v", err)
+	}
+
+	approved, err := m.ApproveCertRequest(r.ID, "cli:carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approved.Status != CertRequestApproved || len(approved.Approvers) != 2 || approved.Renews != 7 || approved.Values["name"] != "console" {
+		t.Fatalf("unexpected request %+v", approved)
+	}
+
+	if err := m.ClaimCertRequest(r.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ClaimCertRequest(r.ID); !errors.Is(err, ErrCertRequestState) {
+		t.Fatalf("a request was claimed twice, %v", err)
+	}
+	if err := m.ReleaseCertRequest(r.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ClaimCertRequest(r.ID); err != nil {
+		t.Fatalf("a released request can't be claimed again, %v", err)
+	}
+	if err := m.SetCertRequestSerial(r.ID, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	issued, err := m.GetCertRequests(CertRequestIssued)
+	if err != nil || len(issued) != 1 || issued[0].Serial != 42 {
+		t.Fatalf("unexpected issued requests %+v, %v", issued, err)
+	}
+	if _, err := m.GetCertRequest("missing"); !errors.Is(err, ErrCertRequestNotFound) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	m := newTestModel(t)
+
+	for _, command := range []string{"create-ca", "server-cert", "revoke"} {
+		if err := m.AppendAuditEntry(&AuditEntry{Actor: "cli:root", Command: command, Parameters: "{}", Result: "success"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prevHash := ""
+	entries := int64(0)
+	if err := m.WalkAuditLog(func(e *AuditEntry) error {
+		if e.PrevHash != prevHash || AuditHash(e) != e.Hash {
+			t.Fatalf("entry %d is not chained", e.ID)
+		}
+		prevHash = e.Hash
+		entries++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := m.GetAuditHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head == nil || head.Entries != entries || head.Hash != prevHash {
+		t.Fatalf("the head %+v doesn't match the log, %d entries ending with %s", head, entries, prevHash)
+	}
+
+	// The log is append-only
+	if _, err := m.DB.Exec(`DELETE FROM audit_log WHERE id = 3`); err == nil {
+		t.Fatal("an entry of the audit log was removed")
+	}
+	if _, err := m.DB.Exec(`UPDATE audit_log SET actor = 'cli:mallory' WHERE id = 1`); err == nil {
+		t.Fatal("an entry of the audit log was changed")
+	}
+}
+
+func TestExternalCertificates(t *testing.T) {
+	m := newTestModel(t)
+
+	c := &ExternalCertificate{Issuer: "CN=Pebble", Serial: "0123456789abcdef0123456789abcdef", Type: "proxy", Expiry: time.Now().Add(time.Hour)}
+	if err := m.SaveExternalCertificate(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveExternalCertificate(c); err == nil {
+		t.Fatal("the same certificate was saved twice")
+	}
+
+	certs, err := m.GetExternalCertificates()
+	if err != nil || len(certs) != 1 || certs[0].Serial != c.Serial {
+		t.Fatalf("unexpected external certificates %+v, %v", certs, err)
+	}
+}
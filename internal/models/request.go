@@ -0,0 +1,240 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"entgo.io/ent/dialect"
+)
+
+const (
+	CertRequestPending  = "pending"
+	CertRequestApproved = "approved"
+	CertRequestRejected = "rejected"
+	CertRequestIssued   = "issued"
+)
+
+var (
+	ErrCertRequestNotFound = errors.New("the certificate request doesn't exist")
+	ErrCertRequestState    = errors.New("the certificate request is not in the expected state")
+	ErrAlreadyApproved     = errors.New("the approver has already approved this certificate request")
+)
+
+// CertRequest is a certificate waiting for approval, Values has the settings of the certificate by
+// flag name so it can be issued with the same templates used by the command-line. Renews is the serial
+// of the certificate that is revoked as superseded when the request is issued, if any
+type CertRequest struct {
+	ID                string
+	Kind              string
+	CertType          string
+	Values            map[string]any
+	Requester         string
+	RequiredApprovals int
+	Approvers         []string
+	Status            string
+	Reason            string
+	Serial            int64
+	Renews            int64
+	Created           time.Time
+	Updated           time.Time
+}
+
+func (m *Model) CreateCertRequest(r *CertRequest) error {
+	values, err := json.Marshal(r.Values)
+	if err != nil {
+		return err
+	}
+
+	if r.ID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		r.ID = hex.EncodeToString(b)
+	}
+
+	now := time.Now()
+	r.Status = CertRequestPending
+	r.Created, r.Updated = now, now
+	_, err = m.DB.ExecContext(context.Background(),
+		m.rebind(`INSERT INTO cert_requests (id, kind, cert_type, settings, requester, required_approvals, status, reason, serial, renews, created, updated) VALUES ($1, $2, $3, $4, $5, $6, $7, '', 0, $8, $9, $9)`),
+		r.ID, r.Kind, r.CertType, string(values), r.Requester, r.RequiredApprovals, r.Status, r.Renews, now.UTC())
+	return err
+}
+
+func (m *Model) GetCertRequest(id string) (*CertRequest, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		m.rebind(`SELECT id, kind, cert_type, settings, requester, required_approvals, status, reason, serial, renews, created, updated FROM cert_requests WHERE id = $1`), id)
+	if err != nil {
+		return nil, err
+	}
+	requests, err := m.scanCertRequests(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, ErrCertRequestNotFound
+	}
+	return requests[0], nil
+}
+
+// GetCertRequests returns the requests in a status or all of them if status is empty
+func (m *Model) GetCertRequests(status string) ([]*CertRequest, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		m.rebind(`SELECT id, kind, cert_type, settings, requester, required_approvals, status, reason, serial, renews, created, updated FROM cert_requests WHERE CAST($1 AS TEXT) = '' OR status = CAST($1 AS TEXT) ORDER BY created`), status)
+	if err != nil {
+		return nil, err
+	}
+	return m.scanCertRequests(rows)
+}
+
+func (m *Model) scanCertRequests(rows *sql.Rows) ([]*CertRequest, error) {
+	defer rows.Close()
+
+	requests := []*CertRequest{}
+	for rows.Next() {
+		r := CertRequest{}
+		values := ""
+		if err := rows.Scan(&r.ID, &r.Kind, &r.CertType, &values, &r.Requester, &r.RequiredApprovals, &r.Status, &r.Reason, &r.Serial, &r.Renews, &r.Created, &r.Updated); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(values), &r.Values); err != nil {
+			return nil, err
+		}
+		requests = append(requests, &r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range requests {
+		approvers, err := m.getCertRequestApprovers(r.ID)
+		if err != nil {
+			return nil, err
+		}
+		r.Approvers = approvers
+	}
+	return requests, nil
+}
+
+func (m *Model) getCertRequestApprovers(id string) ([]string, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		m.rebind(`SELECT approver FROM cert_request_approvals WHERE request_id = $1 ORDER BY created`), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	approvers := []string{}
+	for rows.Next() {
+		approver := ""
+		if err := rows.Scan(&approver); err != nil {
+			return nil, err
+		}
+		approvers = append(approvers, approver)
+	}
+	return approvers, rows.Err()
+}
+
+// ApproveCertRequest adds an approval to a pending request, the request is approved once it has
+// the number of distinct approvers required
+func (m *Model) ApproveCertRequest(id string, approver string) (*CertRequest, error) {
+	ctx := context.Background()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	required := 0
+	status := ""
+	// SQLite has no row locks, its transactions take the write lock when they begin
+	query := `SELECT required_approvals, status FROM cert_requests WHERE id = $1 FOR UPDATE`
+	if m.Dialect == dialect.SQLite {
+		query = strings.TrimSuffix(query, " FOR UPDATE")
+	}
+	err = tx.QueryRowContext(ctx, m.rebind(query), id).Scan(&required, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCertRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status != CertRequestPending {
+		return nil, ErrCertRequestState
+	}
+
+	res, err := tx.ExecContext(ctx,
+		m.rebind(`INSERT INTO cert_request_approvals (request_id, approver, created) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`),
+		id, approver, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrAlreadyApproved
+	}
+
+	approvals := 0
+	if err := tx.QueryRowContext(ctx, m.rebind(`SELECT COUNT(*) FROM cert_request_approvals WHERE request_id = $1`), id).Scan(&approvals); err != nil {
+		return nil, err
+	}
+
+	if approvals >= required {
+		if _, err := tx.ExecContext(ctx, m.rebind(`UPDATE cert_requests SET status = $1, updated = $2 WHERE id = $3`),
+			CertRequestApproved, time.Now().UTC(), id); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return m.GetCertRequest(id)
+}
+
+func (m *Model) RejectCertRequest(id string, approver string, reason string) error {
+	return m.setCertRequestStatus(id, CertRequestPending, CertRequestRejected, approver+": "+reason, 0)
+}
+
+// ClaimCertRequest marks an approved request as issued so it can only be signed once, if the
+// certificate can't be issued the claim must be released with ReleaseCertRequest
+func (m *Model) ClaimCertRequest(id string) error {
+	return m.setCertRequestStatus(id, CertRequestApproved, CertRequestIssued, "", 0)
+}
+
+func (m *Model) ReleaseCertRequest(id string) error {
+	return m.setCertRequestStatus(id, CertRequestIssued, CertRequestApproved, "", 0)
+}
+
+func (m *Model) SetCertRequestSerial(id string, serial int64) error {
+	return m.setCertRequestStatus(id, CertRequestIssued, CertRequestIssued, "", serial)
+}
+
+func (m *Model) setCertRequestStatus(id string, from string, to string, reason string, serial int64) error {
+	res, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`UPDATE cert_requests SET status = $1, reason = CASE WHEN CAST($2 AS TEXT) = '' THEN reason ELSE CAST($2 AS TEXT) END, serial = CASE WHEN CAST($3 AS BIGINT) = 0 THEN serial ELSE CAST($3 AS BIGINT) END, updated = $4 WHERE id = $5 AND status = $6`),
+		to, reason, serial, time.Now().UTC(), id, from)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		if _, err := m.GetCertRequest(id); err != nil {
+			return err
+		}
+		return ErrCertRequestState
+	}
+	return nil
+}
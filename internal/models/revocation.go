@@ -2,6 +2,9 @@ package models
 
 import (
 	"context"
+
+	ent "github.com/open-uem/ent"
+	"github.com/open-uem/ent/revocation"
 )
 
 func (m *Model) AddRevocation(serial int64, reason int, info string) error {
@@ -11,3 +14,15 @@ func (m *Model) AddRevocation(serial int64, reason int, info string) error {
 	}
 	return nil
 }
+
+func (m *Model) IsRevoked(serial int64) (bool, error) {
+	return m.Client.Revocation.Query().Where(revocation.ID(serial)).Exist(context.Background())
+}
+
+func (m *Model) GetRevocation(serial int64) (*ent.Revocation, error) {
+	return m.Client.Revocation.Get(context.Background(), serial)
+}
+
+func (m *Model) GetRevocations() ([]*ent.Revocation, error) {
+	return m.Client.Revocation.Query().All(context.Background())
+}
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"entgo.io/ent/dialect"
+)
+
+// tables contains the DDL statements for the tables used only by the cert-manager
+var tables = []string{
+	`CREATE TABLE IF NOT EXISTS enrollment_tokens (
+		id TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT '',
+		site TEXT NOT NULL DEFAULT '',
+		tenant TEXT NOT NULL DEFAULT '',
+		max_uses INTEGER NOT NULL DEFAULT 1,
+		uses INTEGER NOT NULL DEFAULT 0,
+		expiry TIMESTAMPTZ NOT NULL,
+		created TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS agent_enrollments (
+		serial BIGINT PRIMARY KEY,
+		agent_id TEXT NOT NULL,
+		token_id TEXT NOT NULL,
+		site TEXT NOT NULL DEFAULT '',
+		tenant TEXT NOT NULL DEFAULT '',
+		enrolled TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS acme_accounts (
+		id TEXT PRIMARY KEY,
+		thumbprint TEXT NOT NULL UNIQUE,
+		jwk TEXT NOT NULL,
+		contact TEXT NOT NULL DEFAULT '[]',
+		status TEXT NOT NULL,
+		created TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS acme_orders (
+		id TEXT PRIMARY KEY,
+		account_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		identifiers TEXT NOT NULL,
+		expires TIMESTAMPTZ NOT NULL,
+		serial BIGINT NOT NULL DEFAULT 0,
+		certificate TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		created TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS acme_authorizations (
+		id TEXT PRIMARY KEY,
+		order_id TEXT NOT NULL,
+		account_id TEXT NOT NULL,
+		identifier_type TEXT NOT NULL,
+		identifier_value TEXT NOT NULL,
+		cert_type TEXT NOT NULL DEFAULT '',
+		token TEXT NOT NULL,
+		status TEXT NOT NULL,
+		challenge_type TEXT NOT NULL DEFAULT '',
+		challenge_status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		expires TIMESTAMPTZ NOT NULL,
+		validated TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS authz_denials (
+		id BIGSERIAL PRIMARY KEY,
+		identity TEXT NOT NULL,
+		action TEXT NOT NULL,
+		cert_type TEXT NOT NULL,
+		resource TEXT NOT NULL DEFAULT '',
+		created TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS cert_requests (
+		id TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		cert_type TEXT NOT NULL,
+		settings TEXT NOT NULL,
+		requester TEXT NOT NULL,
+		required_approvals INTEGER NOT NULL DEFAULT 1,
+		status TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		serial BIGINT NOT NULL DEFAULT 0,
+		renews BIGINT NOT NULL DEFAULT 0,
+		created TIMESTAMPTZ NOT NULL,
+		updated TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS cert_request_approvals (
+		request_id TEXT NOT NULL,
+		approver TEXT NOT NULL,
+		created TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (request_id, approver)
+	)`,
+	`CREATE TABLE IF NOT EXISTS pki_config (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ssh_certificates (
+		serial BIGINT PRIMARY KEY,
+		cert_type TEXT NOT NULL,
+		key_id TEXT NOT NULL,
+		principals TEXT NOT NULL DEFAULT '',
+		fingerprint TEXT NOT NULL,
+		ca_fingerprint TEXT NOT NULL,
+		valid_after TIMESTAMPTZ NOT NULL,
+		valid_before TIMESTAMPTZ NOT NULL,
+		revoked BOOLEAN NOT NULL DEFAULT FALSE,
+		revoked_at TIMESTAMPTZ,
+		reason TEXT NOT NULL DEFAULT '',
+		created TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS tsa_tokens (
+		serial BIGSERIAL PRIMARY KEY,
+		hash_algorithm TEXT NOT NULL,
+		message_imprint TEXT NOT NULL,
+		nonce TEXT NOT NULL DEFAULT '',
+		policy TEXT NOT NULL,
+		requester TEXT NOT NULL DEFAULT '',
+		response_hash TEXT NOT NULL,
+		created TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS external_certificates (
+		id BIGSERIAL PRIMARY KEY,
+		issuer TEXT NOT NULL,
+		serial TEXT NOT NULL,
+		cert_type TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		expiry TIMESTAMPTZ NOT NULL,
+		created TIMESTAMPTZ NOT NULL,
+		UNIQUE (issuer, serial)
+	)`,
+	`CREATE TABLE IF NOT EXISTS local_certificates (
+		serial BIGINT PRIMARY KEY,
+		cert_type TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		expiry TIMESTAMPTZ NOT NULL,
+		created TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		created TIMESTAMPTZ NOT NULL,
+		actor TEXT NOT NULL,
+		command TEXT NOT NULL,
+		parameters TEXT NOT NULL DEFAULT '{}',
+		serial BIGINT NOT NULL DEFAULT 0,
+		result TEXT NOT NULL,
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_head (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		entries BIGINT NOT NULL,
+		hash TEXT NOT NULL
+	)`,
+	auditHeadInit,
+}
+
+// The audit log is append-only, rows can't be changed or removed
+var postgresTriggers = []string{
+	`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'the audit log is append-only';
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'audit_log_append_only') THEN
+			CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+			FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+		END IF;
+	END
+	$$`,
+}
+
+var sqliteTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'the audit log is append-only');
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'the audit log is append-only');
+	END`,
+}
+
+// sqliteTypes replaces the Postgres types of the DDL statements, the driver only returns
+// DATETIME columns as times and INTEGER PRIMARY KEY is the SQLite auto-increment column
+var sqliteTypes = strings.NewReplacer(
+	"BIGSERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT",
+	"TIMESTAMPTZ", "DATETIME",
+)
+
+// CreateTables creates the tables owned by the cert-manager, they're not part of the ent schema so
+// they're created here if they don't exist
+func (m *Model) CreateTables(ctx context.Context) error {
+	statements := slices.Concat(tables, postgresTriggers)
+	if m.Dialect == dialect.SQLite {
+		statements = slices.Concat(tables, sqliteTriggers)
+	}
+
+	for _, statement := range statements {
+		if m.Dialect == dialect.SQLite {
+			statement = sqliteTypes.Replace(statement)
+		}
+		if _, err := m.DB.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("could not create cert-manager tables: %v", err)
+		}
+	}
+	return nil
+}
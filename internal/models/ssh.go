@@ -0,0 +1,83 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Types of the OpenSSH certificates
+const (
+	SSHUserCertificate = "user"
+	SSHHostCertificate = "host"
+)
+
+var ErrSSHCertificateNotFound = errors.New("the SSH certificate doesn't exist or has already been revoked")
+
+// SSHCertificate is an OpenSSH certificate signed by the SSH CA, CAFingerprint is the SHA256
+// fingerprint of the CA key so the KRL of each CA only has its own certificates
+type SSHCertificate struct {
+	Serial        uint64
+	CertType      string
+	KeyID         string
+	Principals    []string
+	Fingerprint   string
+	CAFingerprint string
+	ValidAfter    time.Time
+	ValidBefore   time.Time
+	Revoked       bool
+	RevokedAt     *time.Time
+	Reason        string
+	Created       time.Time
+}
+
+// SSH serials are unsigned but the database stores them as BIGINT, the SSH CA only issues serials
+// that fit in a positive int64
+func (m *Model) SaveSSHCertificate(c *SSHCertificate) error {
+	c.Created = time.Now()
+	_, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`INSERT INTO ssh_certificates (serial, cert_type, key_id, principals, fingerprint, ca_fingerprint, valid_after, valid_before, revoked, reason, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, FALSE, '', $9)`),
+		int64(c.Serial), c.CertType, c.KeyID, strings.Join(c.Principals, ","), c.Fingerprint, c.CAFingerprint, c.ValidAfter.UTC(), c.ValidBefore.UTC(), c.Created.UTC())
+	return err
+}
+
+func (m *Model) RevokeSSHCertificate(serial uint64, reason string) error {
+	res, err := m.DB.ExecContext(context.Background(),
+		m.rebind(`UPDATE ssh_certificates SET revoked = TRUE, revoked_at = $2, reason = $3 WHERE serial = $1 AND NOT revoked`),
+		int64(serial), time.Now().UTC(), reason)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrSSHCertificateNotFound
+	}
+	return nil
+}
+
+// GetRevokedSSHCertificates returns the revoked certificates signed by a CA that haven't expired,
+// expired certificates are rejected by sshd anyway so they're left out of the KRL
+func (m *Model) GetRevokedSSHCertificates(caFingerprint string) ([]*SSHCertificate, error) {
+	rows, err := m.DB.QueryContext(context.Background(),
+		m.rebind(`SELECT serial, cert_type, key_id, principals, fingerprint, ca_fingerprint, valid_after, valid_before, revoked, revoked_at, reason, created FROM ssh_certificates WHERE ca_fingerprint = $1 AND revoked AND valid_before > $2 ORDER BY serial`),
+		caFingerprint, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	certs := []*SSHCertificate{}
+	for rows.Next() {
+		c := SSHCertificate{}
+		serial, principals := int64(0), ""
+		if err := rows.Scan(&serial, &c.CertType, &c.KeyID, &principals, &c.Fingerprint, &c.CAFingerprint, &c.ValidAfter, &c.ValidBefore, &c.Revoked, &c.RevokedAt, &c.Reason, &c.Created); err != nil {
+			return nil, err
+		}
+		c.Serial = uint64(serial)
+		if principals != "" {
+			c.Principals = strings.Split(principals, ",")
+		}
+		certs = append(certs, &c)
+	}
+	return certs, rows.Err()
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// TimestampToken is a token issued by the TSA, the response isn't stored but its hash allows to
+// check that a response presented later was issued by the TSA
+type TimestampToken struct {
+	Serial         int64
+	HashAlgorithm  string
+	MessageImprint string
+	Nonce          string
+	Policy         string
+	Requester      string
+	ResponseHash   string
+	Created        time.Time
+}
+
+// IssueTimestampToken assigns the next serial number of the TSA to a token and records it, sign is
+// called with the serial number and time of the token inside the transaction so a token that can't
+// be signed leaves no record. Serial numbers come from a sequence so they always increase
+func (m *Model) IssueTimestampToken(t *TimestampToken, sign func(serial int64, genTime time.Time) ([]byte, error)) ([]byte, error) {
+	ctx := context.Background()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	t.Created = time.Now()
+	if err := tx.QueryRowContext(ctx,
+		m.rebind(`INSERT INTO tsa_tokens (hash_algorithm, message_imprint, nonce, policy, requester, response_hash, created) VALUES ($1, $2, $3, $4, $5, '', $6) RETURNING serial`),
+		t.HashAlgorithm, t.MessageImprint, t.Nonce, t.Policy, t.Requester, t.Created.UTC()).Scan(&t.Serial); err != nil {
+		return nil, err
+	}
+
+	resp, err := sign(t.Serial, t.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(resp)
+	t.ResponseHash = hex.EncodeToString(sum[:])
+	if _, err := tx.ExecContext(ctx, m.rebind(`UPDATE tsa_tokens SET response_hash = $2 WHERE serial = $1`), t.Serial, t.ResponseHash); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,88 @@
+package sshkrl
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Ref: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.krl
+const (
+	krlMagic         = "SSHKRL\n\x00"
+	krlFormatVersion = 1
+
+	sectionCertificates = 0x01
+
+	certSectionSerialList = 0x20
+	certSectionKeyID      = 0x23
+)
+
+// KRL is an OpenSSH key revocation list with the certificates revoked by each CA, sshd reads it
+// from the file set in its RevokedKeys option
+type KRL struct {
+	Version   uint64
+	Generated time.Time
+	Comment   string
+	CAs       []*RevokedCertificates
+}
+
+// RevokedCertificates are the certificates of a CA revoked by serial number or key ID
+type RevokedCertificates struct {
+	CAKey   ssh.PublicKey
+	Serials []uint64
+	KeyIDs  []string
+}
+
+// Marshal encodes the KRL in the binary format understood by sshd and ssh-keygen -Q
+func (k *KRL) Marshal() []byte {
+	b := []byte(krlMagic)
+	b = binary.BigEndian.AppendUint32(b, krlFormatVersion)
+	b = binary.BigEndian.AppendUint64(b, k.Version)
+	b = binary.BigEndian.AppendUint64(b, uint64(k.Generated.Unix()))
+	b = binary.BigEndian.AppendUint64(b, 0) // flags
+	b = appendString(b, nil)                // reserved
+	b = appendString(b, []byte(k.Comment))
+
+	for _, ca := range k.CAs {
+		b = append(b, sectionCertificates)
+		b = appendString(b, ca.marshal())
+	}
+	return b
+}
+
+func (r *RevokedCertificates) marshal() []byte {
+	b := appendString(nil, r.CAKey.Marshal())
+	b = appendString(b, nil) // reserved
+
+	if len(r.Serials) > 0 {
+		serials := append([]uint64{}, r.Serials...)
+		sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+
+		list := []byte{}
+		for i, serial := range serials {
+			if i > 0 && serial == serials[i-1] {
+				continue
+			}
+			list = binary.BigEndian.AppendUint64(list, serial)
+		}
+		b = append(b, certSectionSerialList)
+		b = appendString(b, list)
+	}
+
+	if len(r.KeyIDs) > 0 {
+		ids := []byte{}
+		for _, id := range r.KeyIDs {
+			ids = appendString(ids, []byte(id))
+		}
+		b = append(b, certSectionKeyID)
+		b = appendString(b, ids)
+	}
+	return b
+}
+
+func appendString(b []byte, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
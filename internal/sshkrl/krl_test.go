@@ -0,0 +1,124 @@
+package sshkrl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testCAKey(t *testing.T) (ssh.Signer, ssh.PublicKey) {
+	t.Helper()
+	signer, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, signer.PublicKey()
+}
+
+func TestMarshal(t *testing.T) {
+	_, caKey := testCAKey(t)
+	krl := &KRL{
+		Version:   7,
+		Generated: time.Unix(0x01020304, 0),
+		Comment:   "test",
+		CAs:       []*RevokedCertificates{{CAKey: caKey, Serials: []uint64{3, 1, 3}, KeyIDs: []string{"alice"}}},
+	}
+
+	// Ref: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.krl
+	caBlob := hex.EncodeToString(caKey.Marshal())
+	expected := "" +
+		hex.EncodeToString([]byte("SSHKRL\n\x00")) +
+		"00000001" + // format version
+		"0000000000000007" + // KRL version
+		"0000000001020304" + // generated date
+		"0000000000000000" + // flags
+		"00000000" + // reserved
+		"00000004" + hex.EncodeToString([]byte("test")) +
+		"01" + // KRL_SECTION_CERTIFICATES
+		"0000005e" + // section length
+		"00000033" + caBlob +
+		"00000000" + // reserved
+		"20" + // KRL_SECTION_CERT_SERIAL_LIST, sorted without duplicates
+		"00000010" + "0000000000000001" + "0000000000000003" +
+		"23" + // KRL_SECTION_CERT_KEY_ID
+		"00000009" + "00000005" + hex.EncodeToString([]byte("alice"))
+
+	if got := hex.EncodeToString(krl.Marshal()); got != expected {
+		t.Fatalf("unexpected KRL\n got: %s\nwant: %s", got, expected)
+	}
+}
+
+// TestMarshalSSHKeygen checks the revoked certificates with ssh-keygen -Q when it's installed
+func TestMarshalSSHKeygen(t *testing.T) {
+	sshKeygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	ca, caKey := testCAKey(t)
+	dir := t.TempDir()
+
+	krlFile := filepath.Join(dir, "revoked_keys")
+	krl := &KRL{
+		Version:   1,
+		Generated: time.Now(),
+		CAs:       []*RevokedCertificates{{CAKey: caKey, Serials: []uint64{10, 12}, KeyIDs: []string{"mallory"}}},
+	}
+	if err := os.WriteFile(krlFile, krl.Marshal(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := func(serial uint64, keyID string) string {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &ssh.Certificate{
+			Key:             key,
+			Serial:          serial,
+			CertType:        ssh.UserCert,
+			KeyId:           keyID,
+			ValidPrincipals: []string{"user"},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(dir, keyID+"-cert.pub")
+		if err := os.WriteFile(filename, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	tests := []struct {
+		serial  uint64
+		keyID   string
+		revoked bool
+	}{
+		{serial: 10, keyID: "alice", revoked: true},
+		{serial: 11, keyID: "bob"},
+		{serial: 12, keyID: "carol", revoked: true},
+		{serial: 13, keyID: "mallory", revoked: true},
+	}
+
+	for _, tt := range tests {
+		out, err := exec.Command(sshKeygen, "-Q", "-f", krlFile, certFile(tt.serial, tt.keyID)).CombinedOutput()
+		if tt.revoked != strings.Contains(string(out), "REVOKED") {
+			t.Errorf("certificate %d (%s): unexpected ssh-keygen output %q, %v", tt.serial, tt.keyID, out, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package tsa
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/digitorus/pkcs7"
+	"github.com/digitorus/timestamp"
+)
+
+var (
+	oidTSTInfo              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidExtKeyUsage          = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// Hash algorithms accepted in the message imprint of a request, SHA-1 is rejected
+var hashOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+	crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+	crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+}
+
+// Authority signs time-stamp tokens with a certificate that has the timeStamping extended key usage
+// Ref: https://datatracker.ietf.org/doc/html/rfc3161
+type Authority struct {
+	Cert     *x509.Certificate
+	Signer   crypto.Signer
+	Chain    []*x509.Certificate
+	Policy   asn1.ObjectIdentifier
+	Accuracy time.Duration
+}
+
+// RequestError is a request the TSA rejects, Failure is sent to the client in the PKIStatusInfo
+type RequestError struct {
+	Failure timestamp.FailureInfo
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// CheckCertificate checks that a certificate can be used by a TSA, the timeStamping extended key
+// usage must be critical and the only one
+// Ref: https://datatracker.ietf.org/doc/html/rfc3161#section-2.3
+func CheckCertificate(cert *x509.Certificate) error {
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageTimeStamping || len(cert.UnknownExtKeyUsage) > 0 {
+		return fmt.Errorf("the TSA certificate must have the timeStamping extended key usage and no other")
+	}
+	if !slices.ContainsFunc(cert.Extensions, func(e pkix.Extension) bool { return e.Id.Equal(oidExtKeyUsage) && e.Critical }) {
+		return fmt.Errorf("the extended key usage of the TSA certificate must be critical")
+	}
+	return nil
+}
+
+// Check validates a request before a serial number is assigned to its token
+func (a *Authority) Check(req *timestamp.Request) error {
+	if _, ok := hashOIDs[req.HashAlgorithm]; !ok {
+		return &RequestError{Failure: timestamp.BadAlgorithm, Message: "the hash algorithm of the message imprint must be SHA-256, SHA-384 or SHA-512"}
+	}
+	if len(req.HashedMessage) != req.HashAlgorithm.Size() {
+		return &RequestError{Failure: timestamp.BadDataFormat, Message: "the length of the message imprint doesn't match its hash algorithm"}
+	}
+	if len(req.TSAPolicyOID) > 0 && !req.TSAPolicyOID.Equal(a.Policy) {
+		return &RequestError{Failure: timestamp.UnacceptedPolicy, Message: fmt.Sprintf("the policy %s is not supported by this TSA", req.TSAPolicyOID)}
+	}
+	if len(req.Extensions) > 0 {
+		return &RequestError{Failure: timestamp.UnacceptedExtension, Message: "this TSA doesn't support extensions"}
+	}
+	return nil
+}
+
+// Sign returns a granted TimeStampResp with a token for the request, the serial number must be
+// unique for every token of the TSA
+func (a *Authority) Sign(req *timestamp.Request, serial *big.Int, genTime time.Time) ([]byte, error) {
+	if err := a.Check(req); err != nil {
+		return nil, err
+	}
+
+	info, err := a.tstInfo(req, serial, genTime)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := a.signedData(info, req.Certificates)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(response{
+		Status:         pkiStatusInfo{Status: int(timestamp.Granted)},
+		TimeStampToken: asn1.RawValue{FullBytes: token},
+	})
+}
+
+// Reject returns a TimeStampResp that rejects a request
+func Reject(failure timestamp.FailureInfo) ([]byte, error) {
+	return timestamp.CreateErrorResponse(timestamp.Rejection, failure)
+}
+
+func (a *Authority) tstInfo(req *timestamp.Request, serial *big.Int, genTime time.Time) ([]byte, error) {
+	name, err := asn1.Marshal(asn1.RawValue{Tag: 4, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: a.Cert.RawSubject})
+	if err != nil {
+		return nil, err
+	}
+
+	info := tstInfo{
+		Version: 1,
+		Policy:  a.Policy,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: hashOIDs[req.HashAlgorithm], Parameters: asn1.NullRawValue},
+			HashedMessage: req.HashedMessage,
+		},
+		SerialNumber: serial,
+		GenTime:      genTime.UTC().Truncate(time.Second),
+		Nonce:        req.Nonce,
+		TSA:          asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: name},
+	}
+	if a.Accuracy > 0 {
+		info.Accuracy = accuracy{Seconds: int64(a.Accuracy / time.Second), Millis: int64(a.Accuracy % time.Second / time.Millisecond)}
+	}
+	return asn1.Marshal(info)
+}
+
+// signedData signs the TSTInfo in a CMS SignedData with the ESS signing-certificate-v2 attribute
+// that binds the token to the TSA certificate
+// Ref: https://datatracker.ietf.org/doc/html/rfc5816
+func (a *Authority) signedData(info []byte, withCertificates bool) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(info)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetContentType(oidTSTInfo)
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	sd.GetSignedData().Version = 3
+
+	certHash := sha256.Sum256(a.Cert.Raw)
+	issuer, err := asn1.Marshal(asn1.RawValue{Tag: 4, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: a.Cert.RawIssuer})
+	if err != nil {
+		return nil, err
+	}
+	signingCert, err := asn1.Marshal(signingCertificateV2{Certs: []essCertIDv2{{
+		CertHash:     certHash[:],
+		IssuerSerial: issuerSerial{Issuer: generalNames{Name: asn1.RawValue{FullBytes: issuer}}, Serial: a.Cert.SerialNumber},
+	}}})
+	if err != nil {
+		return nil, err
+	}
+
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{{Type: oidSigningCertificateV2, Value: asn1.RawValue{FullBytes: signingCert}}},
+		SkipCertificates:      !withCertificates,
+	}
+	if withCertificates && len(a.Chain) > 0 {
+		err = sd.AddSignerChain(a.Cert, a.Signer, a.Chain, config)
+	} else {
+		err = sd.AddSigner(a.Cert, a.Signer, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sd.Finish()
+}
+
+// Ref: https://datatracker.ietf.org/doc/html/rfc3161#section-2.4.2
+type response struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status int
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       accuracy      `asn1:"optional"`
+	Nonce          *big.Int      `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type accuracy struct {
+	Seconds int64 `asn1:"optional"`
+	Millis  int64 `asn1:"tag:0,optional"`
+}
+
+// Ref: https://datatracker.ietf.org/doc/html/rfc5035#section-3
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// essCertIDv2 leaves out the hash algorithm, SHA-256 is the default
+type essCertIDv2 struct {
+	CertHash     []byte
+	IssuerSerial issuerSerial
+}
+
+type issuerSerial struct {
+	Issuer generalNames
+	Serial *big.Int
+}
+
+type generalNames struct {
+	Name asn1.RawValue
+}
@@ -0,0 +1,174 @@
+package tsa
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/digitorus/pkcs7"
+	"github.com/digitorus/timestamp"
+)
+
+// newTestAuthority returns a TSA whose certificate is issued by a test CA
+func newTestAuthority(t *testing.T) (*Authority, *x509.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "OpenUEM Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eku, err := asn1.Marshal([]asn1.ObjectIdentifier{{1, 3, 6, 1, 5, 5, 7, 3, 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(0x1234),
+		Subject:         pkix.Name{CommonName: "OpenUEM Test TSA"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: oidExtKeyUsage, Critical: true, Value: eku}},
+	}
+	der, err = x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Authority{
+		Cert:     cert,
+		Signer:   key,
+		Policy:   asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1},
+		Accuracy: 1500 * time.Millisecond,
+	}, caCert
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	a, caCert := newTestAuthority(t)
+
+	digest := sha256.Sum256([]byte("OpenUEM"))
+	req := &timestamp.Request{
+		HashAlgorithm: crypto.SHA256,
+		HashedMessage: digest[:],
+		Nonce:         big.NewInt(987654321),
+		Certificates:  true,
+	}
+	serial := big.NewInt(42)
+	genTime := time.Now()
+
+	resp, err := a.Sign(req, serial, genTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ParseResponse verifies the signature with the certificate included in the token
+	ts, err := timestamp.ParseResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Nonce.Cmp(req.Nonce) != 0 {
+		t.Errorf("unexpected nonce %s", ts.Nonce)
+	}
+	if !ts.Policy.Equal(a.Policy) {
+		t.Errorf("unexpected policy %s", ts.Policy)
+	}
+	if ts.SerialNumber.Cmp(serial) != 0 {
+		t.Errorf("unexpected serial %s", ts.SerialNumber)
+	}
+	if ts.HashAlgorithm != crypto.SHA256 || !bytes.Equal(ts.HashedMessage, digest[:]) {
+		t.Errorf("unexpected message imprint %s %x", ts.HashAlgorithm, ts.HashedMessage)
+	}
+	if !ts.Time.Equal(genTime.UTC().Truncate(time.Second)) || ts.Accuracy != a.Accuracy {
+		t.Errorf("unexpected time %s and accuracy %s", ts.Time, ts.Accuracy)
+	}
+
+	// The signature chains to the CA and the ESS attribute identifies the TSA certificate
+	p7, err := pkcs7.Parse(ts.RawToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	if err := p7.VerifyWithOpts(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping}}); err != nil {
+		t.Fatalf("the token signature is not valid: %v", err)
+	}
+
+	signingCert := signingCertificateV2{}
+	if err := p7.UnmarshalSignedAttribute(oidSigningCertificateV2, &signingCert); err != nil {
+		t.Fatal(err)
+	}
+	certHash := sha256.Sum256(a.Cert.Raw)
+	if len(signingCert.Certs) != 1 || !bytes.Equal(signingCert.Certs[0].CertHash, certHash[:]) || signingCert.Certs[0].IssuerSerial.Serial.Cmp(a.Cert.SerialNumber) != 0 {
+		t.Fatalf("the signing certificate attribute doesn't match the TSA certificate: %+v", signingCert)
+	}
+}
+
+func TestSignWithoutCertificates(t *testing.T) {
+	a, _ := newTestAuthority(t)
+
+	digest := sha256.Sum256([]byte("OpenUEM"))
+	resp, err := a.Sign(&timestamp.Request{HashAlgorithm: crypto.SHA256, HashedMessage: digest[:]}, big.NewInt(1), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := timestamp.ParseResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.Certificates) != 0 || ts.Nonce != nil {
+		t.Fatalf("unexpected certificates %d and nonce %v", len(ts.Certificates), ts.Nonce)
+	}
+}
+
+func TestSignRejectsInvalidRequests(t *testing.T) {
+	a, _ := newTestAuthority(t)
+
+	digest := sha256.Sum256([]byte("OpenUEM"))
+	tests := map[string]*timestamp.Request{
+		"SHA-1":          {HashAlgorithm: crypto.SHA1, HashedMessage: digest[:20]},
+		"short imprint":  {HashAlgorithm: crypto.SHA256, HashedMessage: digest[:16]},
+		"unknown policy": {HashAlgorithm: crypto.SHA256, HashedMessage: digest[:], TSAPolicyOID: asn1.ObjectIdentifier{1, 2, 3}},
+	}
+	for name, req := range tests {
+		if _, err := a.Sign(req, big.NewInt(1), time.Now()); err == nil {
+			t.Errorf("%s: the request was signed", name)
+		}
+	}
+}
@@ -33,5 +33,34 @@ func getCommands() []*cli.Command {
 		commands.CreateServerCertificate(),
 		commands.GetCertificateSerial(),
 		commands.CreateCodeSigningCertificate(),
+		commands.EnrollmentToken(),
+		commands.ServeEnrollment(),
+		commands.ServeEST(),
+		commands.ServeSCEP(),
+		commands.ServeACME(),
+		commands.ACMEApproval(),
+		commands.CreateACMECertificate(),
+		commands.ServeAPI(),
+		commands.Authz(),
+		commands.CertRequest(),
+		commands.Audit(),
+		commands.Lint(),
+		commands.PKIConfig(),
+		commands.ServeRepository(),
+		commands.CreateSSHCA(),
+		commands.SSHUserCertificate(),
+		commands.SSHHostCertificate(),
+		commands.SSHRevoke(),
+		commands.SSHKRL(),
+		commands.CreateTSACertificate(),
+		commands.ServeTSA(),
+		commands.SignPE(),
+		commands.VerifyPE(),
+		commands.SignFile(),
+		commands.VerifyFile(),
+		commands.CreateDeviceCertificate(),
+		commands.ExportTrust(),
+		commands.PFXPassword(),
+		commands.Migrate(),
 	}
 }
@@ -4,17 +4,59 @@ set -e
 # Create certificates directory
 mkdir -p /certificates/{agents,nats,ocsp,notification-worker,cert-manager-worker,agents-worker,ca,users,console,updater} 
 
+# The certificates are saved where the CERT_OUTPUT environment variable says (files, k8s-secret or
+# docker-secret), with K8S_NAMESPACE and SECRET_OWNER for those outputs. The CA is always saved as
+# files to sign the rest of certificates
+
+# cert_missing succeeds if no file of the certificate $1 exists, whatever the output and format used
+cert_missing() {
+    for ext in cer key crt pk8 pfx pem yaml; do
+        if [ -f "$1.$ext" ]; then
+            return 1
+        fi
+    done
+    return 0
+}
+
+# split_sans sets DNS_NAMES and IP_SANS from the comma-separated hosts $1, IP addresses can't be
+# DNS names so they're added as IP SANs
+split_sans() {
+    DNS_NAMES=""
+    IP_SANS=""
+    IFS=',' read -ra hosts <<< "$1"
+    for host in "${hosts[@]}"; do
+        if [ -z "$host" ]; then
+            continue
+        elif [[ "$host" =~ ^[0-9.]+$ || "$host" == *:* ]]; then
+            IP_SANS="${IP_SANS:+$IP_SANS,}$host"
+        else
+            DNS_NAMES="${DNS_NAMES:+$DNS_NAMES,}$host"
+        fi
+    done
+}
+
+# Create the tables owned by the cert-manager, they're only created automatically outside production
+/bin/openuem-cert-manager migrate --dburl "$DATABASE_URL"
+
 # Create CA certificate and private key
-if [ ! -f /certificates/ca/ca.cer ] && [ ! -f /certificates/ca/ca.key ]; then
+if cert_missing /certificates/ca/ca; then
     /bin/openuem-cert-manager create-ca --name "OpenUEM CA" --dst "/certificates/ca" \
         --org "$ORGNAME" --country "$COUNTRY" --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
         --address "$ORGADDRESS" --years-valid 10
+
+    # The certificates of the services are created without approval only with a new CA, afterwards
+    # the types saved with pki-config (console, worker, nats and code-signing by default) must be
+    # requested and approved with cert-request. The types are restored even if a command fails
+    APPROVAL_TYPES=$(/bin/openuem-cert-manager pki-config show --dburl "$DATABASE_URL" | sed -n 's/^approval-types: //p')
+    trap '/bin/openuem-cert-manager pki-config set --approval-types "${APPROVAL_TYPES:-none}" --dburl "$DATABASE_URL"' EXIT
+    /bin/openuem-cert-manager pki-config set --approval-types none --dburl "$DATABASE_URL"
 fi
 
 # Create NATS server certificate and private key
-if [ ! -f /certificates/nats/nats.cer ] && [ ! -f /certificates/nats/nats.key ]; then
+if cert_missing /certificates/nats/nats; then
+    split_sans "$NATS_SERVER,nats-server,localhost"
     /bin/openuem-cert-manager server-cert --name "OpenUEM NATS" --dst "/certificates/nats" \
-        --type="nats" --client-too --dns-names "$NATS_SERVER,nats-server,localhost" --org "$ORGNAME" \
+        --type="nats" --client-too --dns-names "$DNS_NAMES" --ip-sans "$IP_SANS" --org "$ORGNAME" \
         --country "$COUNTRY" --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
         --address "$ORGADDRESS" --years-valid 2 --filename "nats" \
         --ocsp "$OCSP" \
@@ -23,7 +65,7 @@ if [ ! -f /certificates/nats/nats.cer ] && [ ! -f /certificates/nats/nats.key ];
 fi
 
 # Create OCSP server certificate and private key
-if [ ! -f /certificates/ocsp/ocsp.cer ] && [ ! -f /certificates/ocsp/ocsp.key ]; then
+if cert_missing /certificates/ocsp/ocsp; then
     /bin/openuem-cert-manager server-cert --name "OpenUEM OCSP" --dst "/certificates/ocsp" \
         --type="ocsp" --sign-ocsp --org "$ORGNAME" --country "$COUNTRY" --province "$ORGPROVINCE" \
         --locality "$ORGLOCALITY" --address "$ORGADDRESS" --years-valid 2 --filename "ocsp" \
@@ -32,9 +74,9 @@ if [ ! -f /certificates/ocsp/ocsp.cer ] && [ ! -f /certificates/ocsp/ocsp.key ];
 fi
 
 # Create notification worker client certificate and private key
-if [ ! -f /certificates/notification-worker/worker.cer ] && [ ! -f /certificates/notification-worker/worker.key ]; then
+if cert_missing /certificates/notification-worker/worker; then
     /bin/openuem-cert-manager client-cert --name "OpenUEM Notification Worker" \
-    --dst "/certificates/notification-worker" --type="worker" --org "$ORGNAME" \
+    --dst "/certificates/notification-worker" --k8s-secret-name "notification-worker" --type="worker" --org "$ORGNAME" \
     --country "$COUNTRY" --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
     --address "$ORGADDRESS" --years-valid 2 --filename "worker" \
     --ocsp "$OCSP" --description "Notification Worker's certificate" \
@@ -42,9 +84,9 @@ if [ ! -f /certificates/notification-worker/worker.cer ] && [ ! -f /certificates
 fi
 
 # Create cert-manager worker client certificate and private key
-if [ ! -f /certificates/cert-manager-worker/worker.cer ] && [ ! -f /certificates/cert-manager-worker/worker.key ]; then
+if cert_missing /certificates/cert-manager-worker/worker; then
     /bin/openuem-cert-manager client-cert --name "OpenUEM Cert-Manager Worker" \
-    --dst "/certificates/cert-manager-worker" --type="worker" --org "$ORGNAME" \
+    --dst "/certificates/cert-manager-worker" --k8s-secret-name "cert-manager-worker" --type="worker" --org "$ORGNAME" \
     --country "$COUNTRY" --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
     --address "$ORGADDRESS" --years-valid 2 --filename "worker" \
     --ocsp "$OCSP" --description "Cert-Manager Worker's certificate" \
@@ -52,9 +94,9 @@ if [ ! -f /certificates/cert-manager-worker/worker.cer ] && [ ! -f /certificates
 fi
 
 # Create agent worker client certificate and private key
-if [ ! -f /certificates/agents-worker/worker.cer ] && [ ! -f /certificates/agents-worker/worker.key ]; then
+if cert_missing /certificates/agents-worker/worker; then
     /bin/openuem-cert-manager client-cert --name "OpenUEM Agent Worker" \
-    --dst "/certificates/agents-worker" --type="worker" --org "$ORGNAME" \
+    --dst "/certificates/agents-worker" --k8s-secret-name "agents-worker" --type="worker" --org "$ORGNAME" \
     --country "$COUNTRY" --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
     --address "$ORGADDRESS" --years-valid 2 --filename "worker" \
     --ocsp "$OCSP" --description "Agent Worker's certificate" \
@@ -62,9 +104,10 @@ if [ ! -f /certificates/agents-worker/worker.cer ] && [ ! -f /certificates/agent
 fi
 
 # Create console client/server certificate and private key 
-if [ ! -f /certificates/console/console.cer ] && [ ! -f /certificates/console/console.key ]; then
+if cert_missing /certificates/console/console; then
+    split_sans "$SERVER_NAME,console,localhost"
     /bin/openuem-cert-manager server-cert --name "OpenUEM Console" --dst "/certificates/console" \
-    --type="console" --client-too --dns-names "$SERVER_NAME,console,localhost" --org "$ORGNAME" \
+    --type="console" --client-too --dns-names "$DNS_NAMES" --ip-sans "$IP_SANS" --org "$ORGNAME" \
     --country "$COUNTRY" --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
     --address "$ORGADDRESS" --years-valid 2 --filename "console" \
     --ocsp "$OCSP" --description "Console certificate" \
@@ -72,9 +115,10 @@ if [ ! -f /certificates/console/console.cer ] && [ ! -f /certificates/console/co
 fi
 
 # Create console reverse proxy certificate and private key
-if [ -n "$REVERSE_PROXY_SERVER" ] && [ ! -f /certificates/console/proxy.cer ] && [ ! -f /certificates/console/proxy.key ]; then
+if [ -n "$REVERSE_PROXY_SERVER" ] && cert_missing /certificates/console/proxy; then
+    split_sans "$REVERSE_PROXY_SERVER"
     /bin/openuem-cert-manager server-cert --name "OpenUEM Reverse Proxy" --dst "/certificates/console" \
-    --type="proxy" --dns-names "$REVERSE_PROXY_SERVER" --org "$ORGNAME" \
+    --type="proxy" --dns-names "$DNS_NAMES" --ip-sans "$IP_SANS" --org "$ORGNAME" \
     --country "$COUNTRY" --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
     --address "$ORGADDRESS" --years-valid 2 --filename "proxy" \
     --ocsp "$OCSP" --description "Reverse Proxy certificate" \
@@ -82,7 +126,7 @@ if [ -n "$REVERSE_PROXY_SERVER" ] && [ ! -f /certificates/console/proxy.cer ] &&
 fi
 
 # Create console SFTP credentials both certificate and private key
-if [ ! -f /certificates/console/sftp.cer ] && [ ! -f /certificates/console/sftp.key ]; then
+if cert_missing /certificates/console/sftp; then
     /bin/openuem-cert-manager client-cert --name "OpenUEM SFTP Client" --dst "/certificates/console" \
     --type="console" --org "$ORGNAME" --country "$COUNTRY" \
     --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
@@ -92,7 +136,7 @@ if [ ! -f /certificates/console/sftp.cer ] && [ ! -f /certificates/console/sftp.
 fi
 
 # Create server updater certificate and private key
-if [ ! -f /certificates/updater/updater.cer ] && [ ! -f /certificates/updater/updater.key ]; then
+if cert_missing /certificates/updater/updater; then
     /bin/openuem-cert-manager client-cert --name "OpenUEM Updater Client" --dst "/certificates/updater" \
     --type="updater" --org "$ORGNAME" --country "$COUNTRY" \
     --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
@@ -102,7 +146,7 @@ if [ ! -f /certificates/updater/updater.cer ] && [ ! -f /certificates/updater/up
 fi
 
 # Create agent client/server certificate and private key 
-if [ ! -f /certificates/agents/agent.cer ] && [ ! -f /certificates/agents/agent.key ]; then
+if cert_missing /certificates/agents/agent; then
     /bin/openuem-cert-manager client-cert --name "OpenUEM Agent" --dst "/certificates/agents" \
     --type="agent" --org "$ORGNAME" --country "$COUNTRY" --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
     --address "$ORGADDRESS" --years-valid 2 --filename "agent" \
@@ -111,10 +155,10 @@ if [ ! -f /certificates/agents/agent.cer ] && [ ! -f /certificates/agents/agent.
 fi
 
 # Create admin client certificate and private key for console access
-if [ ! -f /certificates/users/admin.pfx ]; then
+if cert_missing /certificates/users/admin; then
     /bin/openuem-cert-manager user-cert --username admin --dst "/certificates/users" \
     --org "$ORGNAME" --country "$COUNTRY" --province "$ORGPROVINCE" --locality "$ORGLOCALITY" \
     --address "$ORGADDRESS" --years-valid 2 \
-    --ocsp "$OCSP" --description "OpenUEM Administrator" \
+    --ocsp "$OCSP" --description "OpenUEM Administrator" --pass-out "/certificates/users/admin.password" \
     --cacert "/certificates/ca/ca.cer" --cakey "/certificates/ca/ca.key" --dburl "$DATABASE_URL"
 fi
\ No newline at end of file
@@ -0,0 +1,25 @@
+#!/bin/bash
+set -e
+
+# Runs the acme-cert tests against Pebble, Pebble serves its directory with a certificate
+# signed by its own test CA so acme-cert is told to trust it with --directory-ca
+ROOT="$(cd "$(dirname "$0")/.." && pwd)"
+PEBBLE_CA="$ROOT/scripts/pebble/pebble.minica.pem"
+
+docker compose -f "$ROOT/scripts/pebble/docker-compose.yml" up -d
+trap 'docker compose -f "$ROOT/scripts/pebble/docker-compose.yml" down' EXIT
+
+if [ ! -f "$PEBBLE_CA" ]; then
+    curl -fsSL -o "$PEBBLE_CA" https://raw.githubusercontent.com/letsencrypt/pebble/main/test/certs/pebble.minica.pem
+fi
+
+# Wait for the directory
+for i in $(seq 1 30); do
+    if curl -fs --cacert "$PEBBLE_CA" https://localhost:14000/dir > /dev/null; then
+        break
+    fi
+    sleep 1
+done
+
+cd "$ROOT"
+PEBBLE_DIRECTORY=https://localhost:14000/dir PEBBLE_CA="$PEBBLE_CA" go test -count=1 -run Pebble ./internal/commands/